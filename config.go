@@ -15,11 +15,24 @@ const (
 
 type (
 	Config struct {
-		ListenAddress string          `toml:"listen" validate:"required" mapstruct:"listen"`
-		Debug         bool            `toml:"debug" mapstructure:"debug"`
-		Auth          mid.AuthConfig  `toml:"auth" validate:"omitempty" mapstruct:"auth"`
-		ACL           mid.ACLConfig   `toml:"acl" validate:"omitempty" mapstruct:"acl"`
-		Audit         mid.AuditConfig `toml:"audit" validate:"omitempty" mapstruct:"audit"`
-		Trace         mid.TraceConfig `toml:"trace" validate:"omitempty" mapstruct:"trace"`
+		ListenAddress string                `toml:"listen" validate:"required" mapstruct:"listen"`
+		Debug         bool                  `toml:"debug" mapstructure:"debug"`
+		Auth          mid.AuthConfig        `toml:"auth" validate:"omitempty" mapstruct:"auth"`
+		ACL           mid.ACLConfig         `toml:"acl" validate:"omitempty" mapstruct:"acl"`
+		RBAC          mid.RBACConfig        `toml:"rbac" validate:"omitempty" mapstruct:"rbac"`
+		Policy        mid.PolicyConfig      `toml:"policy" validate:"omitempty" mapstruct:"policy"`
+		Tenant        mid.TenantConfig      `toml:"tenant" validate:"omitempty" mapstruct:"tenant"`
+		Audit         mid.AuditConfig       `toml:"audit" validate:"omitempty" mapstruct:"audit"`
+		Trace         mid.TraceConfig       `toml:"trace" validate:"omitempty" mapstruct:"trace"`
+		Outbound      mid.OutboundConfig    `toml:"outbound" validate:"omitempty" mapstruct:"outbound"`
+		Timeout       mid.TimeoutConfig     `toml:"timeout" validate:"omitempty" mapstruct:"timeout"`
+		Timing        mid.TimingConfig      `toml:"timing" validate:"omitempty" mapstruct:"timing"`
+		Metrics       mid.MetricsConfig     `toml:"metrics" validate:"omitempty" mapstruct:"metrics"`
+		RateLimit     mid.RateLimitConfig   `toml:"rateLimit" validate:"omitempty" mapstruct:"rateLimit"`
+		Concurrency   mid.ConcurrencyConfig `toml:"concurrency" validate:"omitempty" mapstruct:"concurrency"`
+		Idempotency   mid.IdempotencyConfig `toml:"idempotency" validate:"omitempty" mapstruct:"idempotency"`
+		// TrustedProxies optional ips or cidrs allowed to set X-Forwarded-For. Without them no echo.IPExtractor is set,
+		// and rate limits and anonymous fingerprints key on the connection address
+		TrustedProxies []string `toml:"trustedProxies" mapstructure:"trustedProxies"`
 	}
 )
@@ -3,7 +3,11 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/guestin/kboot"
@@ -19,6 +23,8 @@ import (
 
 var _gWeb *web
 
+const auditShutdownTimeout = time.Second * 10
+
 type web struct {
 	ctx     context.Context
 	echoCtx *echo.Echo
@@ -35,6 +41,11 @@ func (this *web) Init() error {
 	eCtx.HTTPErrorHandler = this.globalErrorHandle
 	eCtx.Validator = kboot.MValidator()
 	eCtx.Binder = &_binder{under: &echo.DefaultBinder{}}
+	ipExtractor, err := newIPExtractor(this.cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	eCtx.IPExtractor = ipExtractor
 	// custom context
 	eCtx.Use(mid.WithContext(this.ctx))
 	// request id
@@ -46,12 +57,64 @@ func (this *web) Init() error {
 	return nil
 }
 
+// newIPExtractor takes the client ip from X-Forwarded-For when it is set by trusted proxies. Without trusted proxies
+// no extractor is installed and ctx.RealIP keeps its default behavior, limits and scopes key on the connection address
+func newIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return nil, nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy '%s' is not a valid ip or cidr: %w", proxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
 func (this *web) Start() error {
+	if this.cfg.ACL.Enabled {
+		this.reportUndeclaredRoutes()
+	}
 	return this.echoCtx.Start(this.cfg.ListenAddress)
 }
 
+func (this *web) reportUndeclaredRoutes() {
+	routes := mid.UndeclaredRoutes(this.echoCtx)
+	if len(routes) == 0 {
+		return
+	}
+	for _, route := range routes {
+		this.logger.Warn("route has no declared permission requirement",
+			zap.String("method", route.Method),
+			zap.String("path", route.Path))
+	}
+	this.logger.Warn(fmt.Sprintf("%d route(s) without declared permission requirement, use mid.Require to declare", len(routes)))
+}
+
 func (this *web) Shutdown() error {
-	return this.echoCtx.Shutdown(this.ctx)
+	err := this.echoCtx.Shutdown(this.ctx)
+	// in-flight requests are done, deliver the queued audit records.
+	// the unit context may be cancelled already, so use a dedicated deadline
+	auditCtx, cancel := context.WithTimeout(context.Background(), auditShutdownTimeout)
+	defer cancel()
+	if auditErr := mid.CloseAuditDispatchers(auditCtx); auditErr != nil {
+		this.logger.Warn("close audit dispatchers failed", zap.Error(auditErr))
+	}
+	if spanErr := mid.CloseSpanProcessors(auditCtx); spanErr != nil {
+		this.logger.Warn("close span processors failed", zap.Error(spanErr))
+	}
+	return err
 }
 
 func (this *web) globalErrorHandle(err error, ctx echo.Context) {
@@ -84,8 +147,8 @@ func (this *web) globalErrorHandle(err error, ctx echo.Context) {
 	if !ctx.Response().Committed {
 		_ = ctx.JSON(status, kerrors.WrapSensitiveErr(rsp))
 	}
-	if rsp.GetCode() < kerrors.CodeInternalServer {
-		// excepted business error
+	if kerrors.IsExpectedCode(rsp.GetCode()) {
+		// excepted business error, or shed under overload
 		return
 	}
 	this.logger.Warn("api global error handler",
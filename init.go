@@ -25,6 +25,17 @@ func _init(unit kboot.Unit) (kboot.ExecFunc, error) {
 		Debug:         false,
 		Auth:          mid.DefaultAuthConfig,
 		ACL:           mid.DefaultACLConfig,
+		RBAC:          mid.DefaultRBACConfig,
+		Policy:        mid.DefaultPolicyConfig,
+		Tenant:        mid.DefaultTenantConfig,
+		Audit:         mid.DefaultAuditConfig,
+		Outbound:      mid.DefaultOutboundConfig,
+		Timeout:       mid.DefaultTimeoutConfig,
+		Timing:        mid.DefaultTimingConfig,
+		Metrics:       mid.DefaultMetricsConfig,
+		RateLimit:     mid.DefaultRateLimitConfig,
+		Concurrency:   mid.DefaultConcurrencyConfig,
+		Idempotency:   mid.DefaultIdempotencyConfig,
 	}
 	err := kboot.UnmarshalSubConfig(ModuleName, cfg,
 		kboot.MustBindEnv(CfgKeyListen),
@@ -33,6 +44,34 @@ func _init(unit kboot.Unit) (kboot.ExecFunc, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.ACL.Cache == nil && cfg.ACL.CacheTTL > 0 {
+		// created here, so it can be invalidated through GetConfig().ACL.Cache
+		cfg.ACL.Cache = mid.NewACLPermissionCache(cfg.ACL.CacheTTL, cfg.ACL.CacheSize)
+	}
+	if cfg.ACL.Policy == nil && len(cfg.Policy.Rules) > 0 {
+		// rules only, rebuild it with mid.NewPolicyEngine to add attribute resolvers
+		cfg.ACL.Policy = mid.NewPolicyEngine(cfg.Policy)
+	}
+	if cfg.ACL.ACLPermissionLoadFunc == nil && cfg.RBAC.RolesClaim != "" {
+		// roles from the auth session, set RBAC.RoleResolver and call mid.NewRBAC to look them up elsewhere
+		cfg.ACL.ACLPermissionLoadFunc = mid.NewRBAC(cfg.RBAC).ACLPermissionLoadFunc()
+	}
+	if cfg.Metrics.Registry == nil {
+		// created here, so the counts can be read through GetConfig().Metrics.Registry
+		cfg.Metrics.Registry = mid.NewMetricsRegistry()
+	}
+	if cfg.Concurrency.Registry == nil {
+		cfg.Concurrency.Registry = cfg.Metrics.Registry
+	}
+	if cfg.Auth.Logger == nil {
+		cfg.Auth.Logger = _gWeb.logger
+	}
+	if cfg.Audit.Logger == nil {
+		cfg.Audit.Logger = _gWeb.logger
+	}
+	if cfg.Debug {
+		cfg.Timing.ServerTiming = true
+	}
 	_gWeb.cfg = cfg
 	err = _gWeb.Init()
 	if err != nil {
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+)
+
+// BodyCapture keeps the first Limit bytes written to it and counts the rest
+type BodyCapture struct {
+	limit int64
+	data  []byte
+	total int64
+}
+
+func NewBodyCapture(limit int64) *BodyCapture {
+	return &BodyCapture{limit: limit}
+}
+
+func (this *BodyCapture) Write(p []byte) (int, error) {
+	if room := this.limit - int64(len(this.data)); room > 0 {
+		if int64(len(p)) < room {
+			room = int64(len(p))
+		}
+		this.data = append(this.data, p[:room]...)
+	}
+	this.total += int64(len(p))
+	return len(p), nil
+}
+
+// Bytes the captured prefix
+func (this *BodyCapture) Bytes() []byte {
+	return this.data
+}
+
+// Total bytes written, captured or not
+func (this *BodyCapture) Total() int64 {
+	return this.total
+}
+
+func (this *BodyCapture) Truncated() bool {
+	return this.total > int64(len(this.data))
+}
+
+// TruncationMarker appended to logged bodies, empty if nothing was cut
+func (this *BodyCapture) TruncationMarker() string {
+	if !this.Truncated() {
+		return ""
+	}
+	return fmt.Sprintf("...(truncated, %d of %d bytes)", len(this.data), this.total)
+}
+
+// NewCaptureReader captures what the consumer reads from rc, without buffering the whole body.
+// Seeking is kept if rc supports it (e.g. mid.ReqBodyReplay), bytes read again are not captured twice
+func NewCaptureReader(rc io.ReadCloser, capture *BodyCapture) io.ReadCloser {
+	reader := &captureReader{ReadCloser: rc, capture: capture}
+	if seeker, ok := rc.(io.ReadSeekCloser); ok {
+		return &captureReadSeeker{captureReader: reader, seeker: seeker}
+	}
+	return reader
+}
+
+type captureReader struct {
+	io.ReadCloser
+	capture *BodyCapture
+	// pos current offset, high the furthest offset captured
+	pos  int64
+	high int64
+}
+
+func (this *captureReader) Read(p []byte) (int, error) {
+	n, err := this.ReadCloser.Read(p)
+	if end := this.pos + int64(n); end > this.high {
+		from := this.high - this.pos
+		if from < 0 {
+			from = 0
+		}
+		_, _ = this.capture.Write(p[from:n])
+		this.high = end
+	}
+	this.pos += int64(n)
+	return n, err
+}
+
+type captureReadSeeker struct {
+	*captureReader
+	seeker io.Seeker
+}
+
+func (this *captureReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := this.seeker.Seek(offset, whence)
+	if err == nil {
+		this.pos = pos
+	}
+	return pos, err
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureReader(t *testing.T) {
+	capture := NewBodyCapture(4)
+	reader := NewCaptureReader(io.NopCloser(strings.NewReader("0123456789")), capture)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, "0123", string(capture.Bytes()))
+	assert.Equal(t, int64(10), capture.Total())
+	assert.Equal(t, "...(truncated, 4 of 10 bytes)", capture.TruncationMarker())
+}
+
+func TestCaptureReader_Replay(t *testing.T) {
+	capture := NewBodyCapture(100)
+	reader := NewCaptureReader(NewReplayBuffer(io.NopCloser(bytes.NewBufferString("hello"))), capture)
+	seeker, ok := reader.(io.ReadSeekCloser)
+	assert.True(t, ok, "seeking kept for ReqBodyReplay")
+	_, _ = io.ReadAll(reader)
+	_, err := seeker.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(reader)
+	assert.Equal(t, "hello", string(data))
+	// replayed bytes are not captured twice
+	assert.Equal(t, "hello", string(capture.Bytes()))
+	assert.False(t, capture.Truncated())
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathPattern matches request paths with glob or echo route template syntax:
+//
+//	/users/:id      ':name' matches exactly one segment
+//	/static/*.js    segment glob, same as path.Match
+//	/public/**      '**' (or a trailing echo style '*') matches any remaining segments
+type PathPattern struct {
+	raw      string
+	segments []string
+	tailAny  bool
+}
+
+func CompilePathPattern(pattern string) (*PathPattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("path pattern '%s' must start with '/'", pattern)
+	}
+	out := &PathPattern{raw: pattern}
+	segments := splitPath(pattern)
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch {
+		case seg == "**":
+			if !last {
+				return nil, fmt.Errorf("path pattern '%s': '**' only allowed as last segment", pattern)
+			}
+			out.tailAny = true
+			continue
+		case seg == "*" && last:
+			// echo route '/static/*' matches everything below
+			out.tailAny = true
+			continue
+		case strings.HasPrefix(seg, ":"):
+			seg = "*"
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("path pattern '%s': %v", pattern, err)
+		}
+		out.segments = append(out.segments, seg)
+	}
+	return out, nil
+}
+
+func MustCompilePathPattern(pattern string) *PathPattern {
+	p, err := CompilePathPattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (this *PathPattern) String() string {
+	return this.raw
+}
+
+// Match reports whether the pattern matches the registered route template. The request path is
+// only consulted when no route matched, and never when it contains dot segments, since echo routes
+// the raw path and '/public/../admin' must not pass as '/admin'
+func (this *PathPattern) Match(routePath string, reqPath string) bool {
+	if routePath != "" {
+		return routePath == this.raw || this.MatchPath(routePath)
+	}
+	return reqPath != "" && !HasDotSegment(reqPath) && this.MatchPath(CleanPath(reqPath))
+}
+
+func (this *PathPattern) MatchPath(p string) bool {
+	segments := splitPath(p)
+	if len(segments) < len(this.segments) {
+		return false
+	}
+	if !this.tailAny && len(segments) != len(this.segments) {
+		return false
+	}
+	for i, pattern := range this.segments {
+		if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CleanPath returns the canonical form of a url path, without query and dot segments
+func CleanPath(p string) string {
+	if idx := strings.IndexAny(p, "?#"); idx != -1 {
+		p = p[:idx]
+	}
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	return path.Clean(p)
+}
+
+// HasDotSegment reports whether the url path contains a '.' or '..' segment
+func HasDotSegment(p string) bool {
+	if idx := strings.IndexAny(p, "?#"); idx != -1 {
+		p = p[:idx]
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
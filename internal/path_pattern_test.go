@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPattern_Match(t *testing.T) {
+	cases := []struct {
+		pattern string
+		route   string
+		path    string
+		expect  bool
+	}{
+		{"/users/:id", "/users/:id", "", true},
+		{"/users/:id", "", "/users/42", true},
+		{"/users/:id", "", "/users/42/orders", false},
+		{"/static/*", "", "/static/js/app.js", true},
+		{"/static/*.js", "", "/static/app.js", true},
+		{"/static/*.js", "", "/static/app.css", false},
+		{"/public/**", "", "/public", true},
+		{"/public/**", "", "/public/a/b/c", true},
+		{"/public", "", "/public?x=/admin", true},
+		{"/public", "", "/public/../admin", false},
+		{"/admin", "", "/public/../admin", false},
+		{"/admin", "", "/./admin", false},
+		{"/public/**", "", "/public/../admin", false},
+		{"/public/**", "/admin", "/public/../admin", false},
+		{"/users/42", "/users/:id", "/users/42", false},
+		{"/health", "", "/health/", true},
+	}
+	for _, c := range cases {
+		p, err := CompilePathPattern(c.pattern)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expect, p.Match(c.route, c.path), c.pattern+" => "+c.route+c.path)
+	}
+}
+
+func TestCompilePathPattern_Invalid(t *testing.T) {
+	for _, p := range []string{"users", "/a/**/b", "/a/[b"} {
+		_, err := CompilePathPattern(p)
+		assert.Error(t, err, p)
+	}
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TTLCache is a concurrency safe LRU cache whose entries expire after ttl.
+// maxSize <= 0 means unbounded.
+type TTLCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	items   map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type ttlCacheEntry[V any] struct {
+	key      string
+	value    V
+	expireAt time.Time
+}
+
+func NewTTLCache[V any](ttl time.Duration, maxSize int) *TTLCache[V] {
+	return &TTLCache[V]{
+		ttl:     ttl,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (this *TTLCache[V]) Get(key string) (V, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var zero V
+	elem, ok := this.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := elem.Value.(*ttlCacheEntry[V])
+	if !this.now().Before(entry.expireAt) {
+		this.removeElement(elem)
+		return zero, false
+	}
+	this.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (this *TTLCache[V]) Set(key string, value V) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	expireAt := this.now().Add(this.ttl)
+	if elem, ok := this.items[key]; ok {
+		entry := elem.Value.(*ttlCacheEntry[V])
+		entry.value = value
+		entry.expireAt = expireAt
+		this.lru.MoveToFront(elem)
+		return
+	}
+	this.items[key] = this.lru.PushFront(&ttlCacheEntry[V]{key: key, value: value, expireAt: expireAt})
+	for this.maxSize > 0 && this.lru.Len() > this.maxSize {
+		this.removeElement(this.lru.Back())
+	}
+}
+
+func (this *TTLCache[V]) Delete(key string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elem, ok := this.items[key]; ok {
+		this.removeElement(elem)
+	}
+}
+
+// DeleteFunc removes all entries whose key matches f
+func (this *TTLCache[V]) DeleteFunc(f func(key string) bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for key, elem := range this.items {
+		if f(key) {
+			this.removeElement(elem)
+		}
+	}
+}
+
+func (this *TTLCache[V]) Purge() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.items = make(map[string]*list.Element)
+	this.lru.Init()
+}
+
+func (this *TTLCache[V]) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.lru.Len()
+}
+
+func (this *TTLCache[V]) removeElement(elem *list.Element) {
+	this.lru.Remove(elem)
+	delete(this.items, elem.Value.(*ttlCacheEntry[V]).key)
+}
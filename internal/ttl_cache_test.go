@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLCache(t *testing.T) {
+	now := time.Now()
+	cache := NewTTLCache[int](time.Minute, 2)
+	cache.now = func() time.Time { return now }
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	_, _ = cache.Get("a")
+	cache.Set("c", 3) // evicts b, the least recently used
+	_, ok := cache.Get("b")
+	assert.False(t, ok)
+	v, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	now = now.Add(time.Minute)
+	_, ok = cache.Get("a")
+	assert.False(t, ok, "entry should expire")
+	assert.Equal(t, 1, cache.Len())
+
+	cache.Set("x:1", 1)
+	cache.DeleteFunc(func(key string) bool { return key == "x:1" })
+	_, ok = cache.Get("x:1")
+	assert.False(t, ok)
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+}
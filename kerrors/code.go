@@ -17,8 +17,14 @@ const (
 	CodeNotFound      = 4404
 	CodeDuplicateAdd  = 4409
 	CodeInvalidParams = 4422
+	// CodeTooManyRequests rejected by the rate limiter, HttpStatus2Code(http.StatusTooManyRequests)
+	CodeTooManyRequests = 4429
 
 	CodeInternalServer = 5000
+	// CodeServiceUnavailable shed under overload, HttpStatus2Code(http.StatusServiceUnavailable)
+	CodeServiceUnavailable = 5503
+	// CodeTimeout the handler overran its deadline, HttpStatus2Code(http.StatusGatewayTimeout)
+	CodeTimeout = 5504
 
 	CodeDbNormalErr       = 6000
 	CodeRecordCreateErr   = 6001
@@ -29,16 +35,19 @@ const (
 )
 
 var codeText = map[int]string{
-	CodeOk:            "Success",
-	CodeOptErr:        "其他错误",
-	CodeUnauthorized:  "用户未登录或登录已失效",
-	CodeForbidden:     "无权限",
-	CodeNotFound:      "无记录",
-	CodeDuplicateAdd:  "重复添加",
-	CodeBadRequest:    "请求参数不正确",
-	CodeInvalidParams: "请求参数不正确",
+	CodeOk:              "Success",
+	CodeOptErr:          "其他错误",
+	CodeUnauthorized:    "用户未登录或登录已失效",
+	CodeForbidden:       "无权限",
+	CodeNotFound:        "无记录",
+	CodeDuplicateAdd:    "重复添加",
+	CodeBadRequest:      "请求参数不正确",
+	CodeInvalidParams:   "请求参数不正确",
+	CodeTooManyRequests: "请求过于频繁",
 
-	CodeInternalServer: "服务异常",
+	CodeInternalServer:     "服务异常",
+	CodeServiceUnavailable: "服务繁忙",
+	CodeTimeout:            "请求超时",
 
 	CodeDbNormalErr:       "数据库操作失败",
 	CodeRecordCreateErr:   "数据添加失败",
@@ -59,11 +68,17 @@ func HttpStatus2Code(status int) int {
 	return (status/100)*1000 + status
 }
 
+// IsExpectedCode reports codes the client is expected to handle, business errors and requests
+// shed under overload, which are answered as is and not logged as server errors
+func IsExpectedCode(code int) bool {
+	return code < CodeInternalServer || code == CodeServiceUnavailable
+}
+
 func WrapSensitiveErr(err merrors.Error) merrors.Error {
 	if err == nil {
 		return nil
 	}
-	if err.GetCode() < CodeInternalServer {
+	if IsExpectedCode(err.GetCode()) {
 		return err
 	}
 	return merrors.Errorf0(err.GetCode(), fmt.Sprintf("%s,请联系系统管理员处理", CodeText(err.GetCode())))
@@ -112,6 +112,16 @@ func ErrInvalidParamsf(format string, arg ...interface{}) merrors.Error {
 	return Errorf(CodeInvalidParams, format, arg...)
 }
 
+//goland:noinspection ALL
+func ErrTooManyRequests(msg ...interface{}) merrors.Error {
+	return NewErr(CodeTooManyRequests, msg...)
+}
+
+//goland:noinspection ALL
+func ErrTooManyRequestsf(format string, arg ...interface{}) merrors.Error {
+	return Errorf(CodeTooManyRequests, format, arg...)
+}
+
 //goland:noinspection ALL
 func ErrInternal(msg ...interface{}) merrors.Error {
 	return NewErr(CodeInternalServer, msg...)
@@ -122,6 +132,26 @@ func ErrInternalf(format string, arg ...interface{}) merrors.Error {
 	return Errorf(CodeInternalServer, format, arg...)
 }
 
+//goland:noinspection ALL
+func ErrServiceUnavailable(msg ...interface{}) merrors.Error {
+	return NewErr(CodeServiceUnavailable, msg...)
+}
+
+//goland:noinspection ALL
+func ErrServiceUnavailablef(format string, arg ...interface{}) merrors.Error {
+	return Errorf(CodeServiceUnavailable, format, arg...)
+}
+
+//goland:noinspection ALL
+func ErrTimeout(msg ...interface{}) merrors.Error {
+	return NewErr(CodeTimeout, msg...)
+}
+
+//goland:noinspection ALL
+func ErrTimeoutf(format string, arg ...interface{}) merrors.Error {
+	return Errorf(CodeTimeout, format, arg...)
+}
+
 //endregion
 
 // Errors
@@ -1,17 +1,35 @@
 package mid
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/guestin/log"
 	"github.com/labstack/echo/v4"
 )
 
 type (
 	ACLContext interface {
+		// AllPermissions loads the permissions of current user lazily, empty if loading failed
 		AllPermissions() []ACLPermission
 		MatchedPermissions() []ACLPermission
 	}
+	// ACLDecisionContext optional interface of ACLContext, implemented by the context of mid.ACL
+	ACLDecisionContext interface {
+		// RequiredActions the actions declared for current route by Require
+		RequiredActions() []string
+		// PolicyDecision the decision of ACLConfig.Policy, nil if no policy evaluated
+		PolicyDecision() *PolicyDecision
+		// Decision the final decision of current request, nil if ACL not enforced
+		Decision() *ACLDecision
+	}
+	// ACLPermissionLoader optional interface of ACLContext, implemented by the context of mid.ACL
+	ACLPermissionLoader interface {
+		// LoadPermissions same as AllPermissions, but reports the loading error
+		LoadPermissions() ([]ACLPermission, error)
+	}
 	ACLPermission interface {
 		Match(ctx echo.Context) bool
 	}
@@ -21,29 +39,101 @@ type (
 		Skipper               Skipper
 		BeforeFunc            BeforeFunc
 		ACLPermissionLoadFunc ACLPermissionLoadFunc
+		// Policy optional attribute based rules, evaluated before permissions:
+		// deny rejects, allow accepts, no rule applied falls back to permission check
+		Policy *PolicyEngine
+		// CacheTTL / CacheSize used to create Cache when it is nil, CacheTTL <= 0 disables cache
+		CacheTTL  time.Duration `toml:"cacheTTL" json:"cacheTTL" mapstructure:"cacheTTL"`
+		CacheSize int           `toml:"cacheSize" json:"cacheSize" mapstructure:"cacheSize"`
+		// Cache optional, keep the reference to invalidate permissions of users
+		Cache *ACLPermissionCache
+		// DryRun log denials without enforcing them
+		DryRun bool `toml:"dryRun" json:"dryRun" mapstructure:"dryRun"`
+		// Logger optional, defaults to the trace logger of request
+		Logger log.ZapLog
 	}
 )
 
 var DefaultACLConfig = ACLConfig{
-	Enabled: false,
+	Enabled:   false,
+	CacheTTL:  0,
+	CacheSize: 10000,
 }
 
 type _aclCtx struct {
+	ctx               echo.Context
+	loader            ACLPermissionLoadFunc
+	loaded            bool
+	loadErr           error
 	allPermissions    []ACLPermission
 	matchedPermission []ACLPermission
+	requiredActions   []string
+	policyDecision    *PolicyDecision
+	decision          *ACLDecision
 }
 
 func (this *_aclCtx) AllPermissions() []ACLPermission {
-	return this.allPermissions
+	permissions, _ := this.LoadPermissions()
+	return permissions
+}
+
+func (this *_aclCtx) LoadPermissions() ([]ACLPermission, error) {
+	if !this.loaded {
+		this.loaded = true
+		permissions, err := this.loader(this.ctx)
+		if err != nil {
+			this.loadErr = err
+		} else {
+			this.allPermissions = permissions[:]
+		}
+	}
+	return this.allPermissions, this.loadErr
 }
 
 func (this *_aclCtx) MatchedPermissions() []ACLPermission {
 	return this.matchedPermission
 }
 
-func (this *_aclCtx) reset() {
+func (this *_aclCtx) RequiredActions() []string {
+	return this.requiredActions
+}
+
+func (this *_aclCtx) PolicyDecision() *PolicyDecision {
+	return this.policyDecision
+}
+
+func (this *_aclCtx) Decision() *ACLDecision {
+	return this.decision
+}
+
+func (this *_aclCtx) reset(ctx echo.Context, loader ACLPermissionLoadFunc) {
+	this.ctx = ctx
+	this.loader = loader
+	this.loaded = false
+	this.loadErr = nil
 	this.allPermissions = make([]ACLPermission, 0)
 	this.matchedPermission = make([]ACLPermission, 0)
+	this.requiredActions = nil
+	this.policyDecision = nil
+	this.decision = nil
+}
+
+// matchActions every required action must be granted by at least one permission, returns the first missing one
+func (this *_aclCtx) matchActions(permissions []ACLPermission, actions []string) string {
+	for _, action := range actions {
+		granted := false
+		for _, perm := range permissions {
+			if granter, ok := perm.(ACLActionGranter); ok && granter.GrantAction(action) {
+				this.matchedPermission = append(this.matchedPermission, perm)
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return action
+		}
+	}
+	return ""
 }
 
 func CurrentACLContext(ctx echo.Context) ACLContext {
@@ -55,7 +145,19 @@ func ACL(config ACLConfig) echo.MiddlewareFunc {
 		config.Skipper = DefaultSkipper
 	}
 	if config.ACLPermissionLoadFunc == nil {
-		panic("ACL permission loader not be nil")
+		if config.Policy == nil {
+			panic("ACL permission loader not be nil")
+		}
+		config.ACLPermissionLoadFunc = func(echo.Context) ([]ACLPermission, error) {
+			return []ACLPermission{}, nil
+		}
+	}
+	if config.Cache == nil && config.CacheTTL > 0 {
+		config.Cache = NewACLPermissionCache(config.CacheTTL, config.CacheSize)
+	}
+	loader := config.ACLPermissionLoadFunc
+	if config.Cache != nil {
+		loader = config.Cache.Wrap(loader)
 	}
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		ctxPool := &sync.Pool{
@@ -63,40 +165,115 @@ func ACL(config ACLConfig) echo.MiddlewareFunc {
 		}
 		return func(ctx echo.Context) error {
 			aclCtx := ctxPool.Get().(*_aclCtx)
-			aclCtx.reset()
+			// permissions are loaded on demand, not for skipped requests
+			aclCtx.reset(ctx, loader)
 			defer func() {
+				aclCtx.reset(nil, nil)
 				ctxPool.Put(aclCtx)
 				ctx.Set(CtxAclKey, nil)
 			}()
 			ctx.Set(CtxAclKey, aclCtx)
-
-			permissions, err := config.ACLPermissionLoadFunc(ctx)
-			if err != nil {
-				return err
-			}
-			aclCtx.allPermissions = permissions[:]
 			if !config.Enabled {
 				return next(ctx)
 			}
 			if config.Skipper != nil && config.Skipper(ctx) {
 				return next(ctx)
 			}
+			span := StartSpan(ctx, "acl")
+			endStage := startStage(ctx, "acl")
 			if config.BeforeFunc != nil {
-				err = config.BeforeFunc(ctx)
+				err := config.BeforeFunc(ctx)
 				if err != nil {
+					span.RecordError(err)
+					span.End()
+					endStage()
 					return err
 				}
 			}
-			for i := range permissions {
-				perm := permissions[i]
-				if perm.Match(ctx) {
-					aclCtx.matchedPermission = append(aclCtx.matchedPermission, perm)
-				}
+			decision, err := aclDecide(ctx, aclCtx, config.Policy)
+			endStage()
+			if err != nil {
+				span.RecordError(err)
+				span.End()
+				return err
 			}
-			if len(aclCtx.matchedPermission) == 0 {
-				return kerrors.ErrForbidden()
+			span.SetAttribute("acl.allowed", decision.Allowed)
+			span.SetAttribute("acl.reason", decision.Reason)
+			if !decision.Allowed && !config.DryRun {
+				span.SetStatus(SpanStatusError, decision.Reason)
+			}
+			span.End()
+			aclCtx.decision = decision
+			if auditCtx, ok := ctx.Get(CtxAuditKey).(AuditACLContext); ok && auditCtx != nil {
+				auditCtx.SetACLDecision(decision)
+			}
+			if decision.Allowed {
+				return next(ctx)
 			}
-			return next(ctx)
+			countACLDenial(ctx)
+			if config.DryRun {
+				decision.DryRun = true
+				aclLogger(ctx, config).Warn("acl denied (dry run)", decision.logFields()...)
+				return next(ctx)
+			}
+			aclLogger(ctx, config).Debug("acl denied", decision.logFields()...)
+			return kerrors.ErrForbidden()
+		}
+	}
+}
+
+func aclDecide(ctx echo.Context, aclCtx *_aclCtx, policy *PolicyEngine) (*ACLDecision, error) {
+	actions, declared := RouteRequirement(ctx)
+	aclCtx.requiredActions = actions
+	if policy != nil {
+		policyDecision, err := policy.Evaluate(ctx, actions)
+		if err != nil {
+			return nil, err
 		}
+		aclCtx.policyDecision = &policyDecision
+		switch policyDecision.Effect {
+		case PolicyDeny:
+			return newACLDecision(ctx, aclCtx).deny(fmt.Sprintf("denied by policy rule '%s'", policyDecision.Rule)), nil
+		case PolicyAllow:
+			// granted by the rule, declared actions and permissions are not checked
+			return newACLDecision(ctx, aclCtx).allow(fmt.Sprintf("allowed by policy rule '%s'", policyDecision.Rule)), nil
+		}
+	}
+	if declared && len(actions) == 0 {
+		return newACLDecision(ctx, aclCtx).allow("route declared public"), nil
+	}
+	permissions, err := aclCtx.LoadPermissions()
+	if err != nil {
+		return nil, err
+	}
+	// route with declared requirement, check required actions only
+	if declared {
+		missing := aclCtx.matchActions(permissions, actions)
+		decision := newACLDecision(ctx, aclCtx).evaluated(permissions, aclCtx.matchedPermission)
+		if missing != "" {
+			return decision.deny(fmt.Sprintf("action '%s' not granted", missing)), nil
+		}
+		return decision.allow("all required actions granted"), nil
+	}
+	for i := range permissions {
+		perm := permissions[i]
+		if perm.Match(ctx) {
+			aclCtx.matchedPermission = append(aclCtx.matchedPermission, perm)
+		}
+	}
+	decision := newACLDecision(ctx, aclCtx).evaluated(permissions, aclCtx.matchedPermission)
+	if len(aclCtx.matchedPermission) == 0 {
+		return decision.deny("no permission matched"), nil
+	}
+	return decision.allow("permission matched"), nil
+}
+
+func aclLogger(ctx echo.Context, config ACLConfig) log.ZapLog {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	if logger, ok := ctx.Get(CtxZapLoggerKey).(log.ZapLog); ok {
+		return logger
 	}
+	return nopLogger
 }
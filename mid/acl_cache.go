@@ -0,0 +1,84 @@
+package mid
+
+import (
+	"strings"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/internal"
+	"github.com/labstack/echo/v4"
+)
+
+// ACLPermissionCache caches loaded permissions per user, with TTL and size bound.
+// Entries are scoped by tenant when mid.Tenant resolved one.
+type ACLPermissionCache struct {
+	cache *internal.TTLCache[[]ACLPermission]
+}
+
+// NewACLPermissionCache maxSize <= 0 means unbounded
+func NewACLPermissionCache(ttl time.Duration, maxSize int) *ACLPermissionCache {
+	return &ACLPermissionCache{cache: internal.NewTTLCache[[]ACLPermission](ttl, maxSize)}
+}
+
+const aclCacheKeySep = "\x00"
+
+func aclCacheKey(tenantId, userId string) string {
+	return tenantId + aclCacheKeySep + userId
+}
+
+func (this *ACLPermissionCache) Get(tenantId, userId string) ([]ACLPermission, bool) {
+	return this.cache.Get(aclCacheKey(tenantId, userId))
+}
+
+func (this *ACLPermissionCache) Set(tenantId, userId string, permissions []ACLPermission) {
+	this.cache.Set(aclCacheKey(tenantId, userId), permissions)
+}
+
+// Invalidate drops the cached permissions of users in all tenants, e.g. after an admin changes their roles
+func (this *ACLPermissionCache) Invalidate(userIds ...string) {
+	users := make(map[string]struct{}, len(userIds))
+	for _, userId := range userIds {
+		users[userId] = struct{}{}
+	}
+	this.cache.DeleteFunc(func(key string) bool {
+		_, ok := users[key[strings.Index(key, aclCacheKeySep)+1:]]
+		return ok
+	})
+}
+
+// InvalidateTenantUser drops the cached permissions of a user in one tenant
+func (this *ACLPermissionCache) InvalidateTenantUser(tenantId, userId string) {
+	this.cache.Delete(aclCacheKey(tenantId, userId))
+}
+
+// InvalidateTenant drops the cached permissions of all users in a tenant
+func (this *ACLPermissionCache) InvalidateTenant(tenantId string) {
+	prefix := tenantId + aclCacheKeySep
+	this.cache.DeleteFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+func (this *ACLPermissionCache) InvalidateAll() {
+	this.cache.Purge()
+}
+
+func (this *ACLPermissionCache) Len() int {
+	return this.cache.Len()
+}
+
+// Wrap returns a loader which serves permissions from cache, keyed by current tenant and user id
+func (this *ACLPermissionCache) Wrap(loader ACLPermissionLoadFunc) ACLPermissionLoadFunc {
+	return func(ctx echo.Context) ([]ACLPermission, error) {
+		tenantId := currentTenantId(ctx)
+		userId := callerAuthContext(ctx).GetUserId()
+		if permissions, ok := this.Get(tenantId, userId); ok {
+			return permissions, nil
+		}
+		permissions, err := loader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		this.Set(tenantId, userId, permissions)
+		return permissions, nil
+	}
+}
@@ -0,0 +1,72 @@
+package mid
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// ACLDecision records why mid.ACL accepted or rejected a request
+type ACLDecision struct {
+	Allowed bool `json:"allowed"`
+	// DryRun the request was denied but let through, see ACLConfig.DryRun
+	DryRun          bool            `json:"dryRun,omitempty"`
+	UserId          string          `json:"userId"`
+	TenantId        string          `json:"tenantId,omitempty"`
+	Method          string          `json:"method"`
+	Route           string          `json:"route"`
+	RequiredActions []string        `json:"requiredActions,omitempty"`
+	Evaluated       []string        `json:"evaluated,omitempty"`
+	Matched         []string        `json:"matched,omitempty"`
+	Policy          *PolicyDecision `json:"policy,omitempty"`
+	Reason          string          `json:"reason"`
+}
+
+func newACLDecision(ctx echo.Context, aclCtx *_aclCtx) *ACLDecision {
+	return &ACLDecision{
+		UserId:          callerAuthContext(ctx).GetUserId(),
+		TenantId:        currentTenantId(ctx),
+		Method:          ctx.Request().Method,
+		Route:           ctx.Path(),
+		RequiredActions: aclCtx.requiredActions,
+		Policy:          aclCtx.policyDecision,
+	}
+}
+
+func (this *ACLDecision) allow(reason string) *ACLDecision {
+	this.Allowed = true
+	this.Reason = reason
+	return this
+}
+
+func (this *ACLDecision) deny(reason string) *ACLDecision {
+	this.Allowed = false
+	this.Reason = reason
+	return this
+}
+
+func (this *ACLDecision) evaluated(permissions []ACLPermission, matched []ACLPermission) *ACLDecision {
+	this.Evaluated = permissionStrings(permissions)
+	this.Matched = permissionStrings(matched)
+	return this
+}
+
+func (this *ACLDecision) logFields() []zap.Field {
+	return []zap.Field{
+		zap.String("userId", this.UserId),
+		zap.String("method", this.Method),
+		zap.String("route", this.Route),
+		zap.Strings("requiredActions", this.RequiredActions),
+		zap.Strings("evaluated", this.Evaluated),
+		zap.String("reason", this.Reason),
+	}
+}
+
+func permissionStrings(permissions []ACLPermission) []string {
+	out := make([]string, 0, len(permissions))
+	for _, perm := range permissions {
+		out = append(out, fmt.Sprint(perm))
+	}
+	return out
+}
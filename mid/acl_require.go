@@ -0,0 +1,154 @@
+package mid
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ACLActionGranter is an optional interface of ACLPermission,
+	// implemented by permissions which grant named actions, e.g. 'order:write'
+	ACLActionGranter interface {
+		GrantAction(action string) bool
+	}
+)
+
+// routeRequirements the actions declared by Require, keyed by the route itself, so equal routes of other
+// echo instances or hosts are not affected. requests find them through an index per echo instance
+var routeRequirements = struct {
+	sync.RWMutex
+	actions map[*echo.Route][]string
+	// version bumped by Require, indexes of an older version are rebuilt
+	version uint64
+	indexes map[*echo.Echo]*routeRequirementIndex
+}{
+	actions: make(map[*echo.Route][]string),
+	indexes: make(map[*echo.Echo]*routeRequirementIndex),
+}
+
+type routeRequirementIndex struct {
+	version uint64
+	// host of echo.Echo.Routers, empty for the default router -> routeKey -> actions
+	hosts map[string]map[string][]string
+}
+
+func newRouteRequirementIndex(e *echo.Echo, version uint64) *routeRequirementIndex {
+	out := &routeRequirementIndex{version: version, hosts: make(map[string]map[string][]string)}
+	add := func(host string, router *echo.Router) {
+		routes := make(map[string][]string)
+		for _, route := range router.Routes() {
+			if actions, ok := routeRequirements.actions[route]; ok {
+				routes[routeKey(route.Method, route.Path)] = actions
+			}
+		}
+		out.hosts[host] = routes
+	}
+	add("", e.Router())
+	for host, router := range e.Routers() {
+		add(host, router)
+	}
+	return out
+}
+
+func routeKey(method, path string) string {
+	return method + " " + path
+}
+
+// normalizeRouteKey 'METHOD /route/template' lowercased with single spacing.
+// config loaders may change the case of map keys, kboot loads through viper, which lowercases them
+func normalizeRouteKey(key string) string {
+	return strings.ToLower(strings.Join(strings.Fields(key), " "))
+}
+
+// routeOverrides re-keys per route config by normalizeRouteKey, looked up by lookupRouteOverride.
+// panics when two keys only differ by case or spacing
+func routeOverrides[V any](kind string, routes map[string]V) map[string]V {
+	out := make(map[string]V, len(routes))
+	for key, v := range routes {
+		normalized := normalizeRouteKey(key)
+		if _, ok := out[normalized]; ok {
+			panic(fmt.Sprintf("%s routes have duplicate keys for '%s', keys are case insensitive", kind, key))
+		}
+		out[normalized] = v
+	}
+	return out
+}
+
+func lookupRouteOverride[V any](routes map[string]V, method, path string) (V, bool) {
+	v, ok := routes[normalizeRouteKey(routeKey(method, path))]
+	return v, ok
+}
+
+// Require declares the actions required by route, checked by mid.ACL against the caller's loaded permissions.
+// Declaring no action marks the route as public.
+//
+//	mid.Require(eCtx.PUT("/orders/:id", mid.Wrap(UpdateOrder)), "order:write")
+func Require(route *echo.Route, actions ...string) *echo.Route {
+	routeRequirements.Lock()
+	defer routeRequirements.Unlock()
+	routeRequirements.actions[route] = append([]string{}, actions...)
+	routeRequirements.version++
+	return route
+}
+
+// RouteRequirement returns the actions declared for the route of the current request, ok is false if nothing declared
+func RouteRequirement(ctx echo.Context) ([]string, bool) {
+	e := ctx.Echo()
+	if e == nil {
+		return nil, false
+	}
+	routeRequirements.RLock()
+	index := routeRequirements.indexes[e]
+	stale := index == nil || index.version != routeRequirements.version
+	routeRequirements.RUnlock()
+	if stale {
+		routeRequirements.Lock()
+		index = newRouteRequirementIndex(e, routeRequirements.version)
+		routeRequirements.indexes[e] = index
+		routeRequirements.Unlock()
+	}
+	// the router serving the request, see echo.Echo.ServeHTTP
+	routes, ok := index.hosts[ctx.Request().Host]
+	if !ok {
+		routes = index.hosts[""]
+	}
+	actions, ok := routes[routeKey(ctx.Request().Method, ctx.Path())]
+	return actions, ok
+}
+
+// UndeclaredRoutes lists the routes of e lacking any declared requirement
+func UndeclaredRoutes(e *echo.Echo) []*echo.Route {
+	routeRequirements.RLock()
+	defer routeRequirements.RUnlock()
+	out := make([]*echo.Route, 0)
+	for _, route := range e.Routes() {
+		if route.Method == echo.RouteNotFound {
+			continue
+		}
+		if _, ok := routeRequirements.actions[route]; !ok {
+			out = append(out, route)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path == out[j].Path {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+// MatchAction reports whether granted covers required, supports trailing wildcard: '*', 'order:*'
+func MatchAction(granted, required string) bool {
+	if granted == required || granted == "*" {
+		return true
+	}
+	if strings.HasSuffix(granted, "*") {
+		return strings.HasPrefix(required, granted[:len(granted)-1])
+	}
+	return false
+}
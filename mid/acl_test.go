@@ -0,0 +1,215 @@
+package mid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testActionPermission grants actions to every route
+type testActionPermission string
+
+func (this testActionPermission) Match(echo.Context) bool { return false }
+
+func (this testActionPermission) GrantAction(action string) bool {
+	return MatchAction(string(this), action)
+}
+
+func TestACLDecision(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		e := echo.New()
+		e.HTTPErrorHandler = errorHandle
+		e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+		e.Use(AuthWithConfig(AuthConfig{Enabled: true, WhitelistRules: []WhitelistRule{{Path: "/**"}}}, testAPIKeyProvider{}))
+		e.Use(ACL(ACLConfig{
+			Enabled: true,
+			DryRun:  dryRun,
+			ACLPermissionLoadFunc: func(ctx echo.Context) ([]ACLPermission, error) {
+				if CurrentAuthContext(ctx).GetUserId() == "app-a" {
+					return []ACLPermission{testActionPermission("order:*")}, nil
+				}
+				return []ACLPermission{}, nil
+			},
+		}))
+		var decision *ACLDecision
+		handler := func(ctx echo.Context) error {
+			decision = CurrentACLContext(ctx).(ACLDecisionContext).Decision()
+			return nil
+		}
+		Require(e.PUT("/acl-decision/orders/:id", Wrap(handler)), "order:write")
+		Require(e.GET("/acl-decision/health", Wrap(handler)))
+		call := func(method, path, apiKey string) map[string]interface{} {
+			decision = nil
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-Api-Key", apiKey)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			rsp := map[string]interface{}{}
+			_ = json.Unmarshal(rec.Body.Bytes(), &rsp)
+			return rsp
+		}
+
+		call(http.MethodPut, "/acl-decision/orders/1", "a")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "app-a", decision.UserId)
+		assert.Equal(t, []string{"order:write"}, decision.RequiredActions)
+
+		call(http.MethodGet, "/acl-decision/health", "")
+		assert.Equal(t, "route declared public", decision.Reason)
+
+		rsp := call(http.MethodPut, "/acl-decision/orders/1", "b")
+		if dryRun {
+			// let through, the decision tells it was denied
+			assert.False(t, decision.Allowed)
+			assert.True(t, decision.DryRun)
+			assert.Equal(t, "action 'order:write' not granted", decision.Reason)
+		} else {
+			assert.Nil(t, decision)
+			assert.Equal(t, float64(kerrors.CodeForbidden), rsp["code"])
+		}
+	}
+}
+
+func TestACLWithoutAuth(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Use(ACL(ACLConfig{
+		Enabled: true,
+		ACLPermissionLoadFunc: func(ctx echo.Context) ([]ACLPermission, error) {
+			return []ACLPermission{}, nil
+		},
+		Cache:  NewACLPermissionCache(0, 10),
+		Policy: NewPolicyEngine(PolicyConfig{}),
+	}))
+	Require(e.GET("/acl-no-auth", Wrap(func() error { return nil })), "report:read")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/acl-no-auth", nil))
+	rsp := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	// denied as an anonymous caller instead of panicking
+	assert.Equal(t, float64(kerrors.CodeForbidden), rsp["code"])
+}
+
+func TestACLPermissionCache(t *testing.T) {
+	cache := NewACLPermissionCache(time.Millisecond*50, 10)
+	loads := map[string]int{}
+	fail := false
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(AuthWithConfig(AuthConfig{Enabled: true, WhitelistRules: []WhitelistRule{{Path: "/**"}}}, testAPIKeyProvider{}))
+	e.Use(ACL(ACLConfig{
+		Enabled: true,
+		Cache:   cache,
+		ACLPermissionLoadFunc: func(ctx echo.Context) ([]ACLPermission, error) {
+			userId := CurrentAuthContext(ctx).GetUserId()
+			loads[userId]++
+			if fail {
+				return nil, kerrors.ErrInternal()
+			}
+			return []ACLPermission{testActionPermission("report:*")}, nil
+		},
+	}))
+	var loadErr error
+	Require(e.GET("/acl-cache/reports", Wrap(func(ctx echo.Context) error {
+		_, loadErr = CurrentACLContext(ctx).(ACLPermissionLoader).LoadPermissions()
+		return nil
+	})), "report:read")
+	call := func(apiKey string) {
+		req := httptest.NewRequest(http.MethodGet, "/acl-cache/reports", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	call("a")
+	call("a")
+	call("b")
+	assert.Equal(t, 1, loads["app-a"])
+	assert.Equal(t, 1, loads["app-b"])
+	assert.NoError(t, loadErr)
+
+	cache.Invalidate("app-a")
+	call("a")
+	call("b")
+	assert.Equal(t, 2, loads["app-a"])
+	assert.Equal(t, 1, loads["app-b"])
+
+	time.Sleep(time.Millisecond * 80)
+	call("b")
+	assert.Equal(t, 2, loads["app-b"])
+
+	// failed loads are not cached
+	cache.InvalidateAll()
+	fail = true
+	call("a")
+	fail = false
+	call("a")
+	assert.Equal(t, 4, loads["app-a"])
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestRequire(t *testing.T) {
+	newServer := func() *echo.Echo {
+		e := echo.New()
+		e.HTTPErrorHandler = errorHandle
+		e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+		e.Use(AuthWithConfig(AuthConfig{Enabled: true, WhitelistRules: []WhitelistRule{{Path: "/**"}}}, testAPIKeyProvider{}))
+		e.Use(ACL(ACLConfig{
+			Enabled: true,
+			ACLPermissionLoadFunc: func(ctx echo.Context) ([]ACLPermission, error) {
+				return []ACLPermission{testActionPermission("report:read")}, nil
+			},
+		}))
+		return e
+	}
+	handler := Wrap(func() error { return nil })
+	admin, public := newServer(), newServer()
+	// the same route declared differently by two servers and a host
+	Require(admin.GET("/require/reports", handler), "report:write")
+	Require(public.GET("/require/reports", handler))
+	Require(public.Host("admin.example.com").GET("/require/reports", handler), "report:write")
+	public.GET("/require/undeclared", handler)
+	call := func(e *echo.Echo, host string, path string) interface{} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		rsp := map[string]interface{}{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &rsp)
+		return rsp["code"]
+	}
+	assert.Equal(t, float64(kerrors.CodeForbidden), call(admin, "example.com", "/require/reports"))
+	assert.Equal(t, float64(kerrors.CodeOk), call(public, "example.com", "/require/reports"))
+	assert.Equal(t, float64(kerrors.CodeForbidden), call(public, "admin.example.com", "/require/reports"))
+
+	// declared later, picked up by the next request
+	Require(admin.GET("/require/reports", handler), "report:read")
+	assert.Equal(t, float64(kerrors.CodeOk), call(admin, "example.com", "/require/reports"))
+
+	assert.Len(t, UndeclaredRoutes(admin), 0)
+	undeclared := UndeclaredRoutes(public)
+	assert.Len(t, undeclared, 1)
+	assert.Equal(t, "/require/undeclared", undeclared[0].Path)
+}
+
+func TestMatchAction(t *testing.T) {
+	for _, c := range []struct {
+		granted, required string
+		match             bool
+	}{
+		{"order:write", "order:write", true},
+		{"order:write", "order:read", false},
+		{"order:*", "order:read", true},
+		{"order:*", "orders:read", false},
+		{"*", "order:read", true},
+		{"order", "order:read", false},
+	} {
+		assert.Equal(t, c.match, MatchAction(c.granted, c.required), c.granted+" "+c.required)
+	}
+}
@@ -2,10 +2,12 @@ package mid
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/guestin/log"
 	"github.com/labstack/echo/v4"
 )
 
@@ -24,22 +26,68 @@ type (
 		UserDataJson() string
 		DumpError() string
 	}
+	// AuditActionContext optional interface of AuditContext, implemented by the context of mid.Audit
+	AuditActionContext interface {
+		// SetAction overrides the audited action name, defaults to the route declared action or 'METHOD route'
+		SetAction(action string)
+		GetAction() string
+	}
+	// AuditTenantContext optional interface of AuditContext, implemented by the context of mid.Audit
+	AuditTenantContext interface {
+		// TenantId empty if mid.Tenant not installed
+		TenantId() string
+	}
+	// AuditACLContext optional interface of AuditContext, implemented by the context of mid.Audit
+	AuditACLContext interface {
+		SetACLDecision(decision *ACLDecision)
+		// ACLDecision the decision of mid.ACL, nil if ACL not enforced
+		ACLDecision() *ACLDecision
+	}
+	// FlushFunc receives the raw request context.
+	//
+	// Deprecated: use AuditConfig.Sinks, which receive a stable AuditRecord
 	FlushFunc   func(ctx echo.Context)
 	AuditConfig struct {
-		Enabled   bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
-		Skipper   Skipper
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		Skipper Skipper
+		// FlushFunc called synchronously inside the request.
+		//
+		// Deprecated: use Sinks
 		FlushFunc FlushFunc
+		// Sinks receive AuditRecord asynchronously, through a dispatcher created by Audit
+		Sinks []AuditSink
+		Async AuditAsyncConfig `toml:"async" json:"async" mapstructure:"async"`
+		// built-in sinks, appended to Sinks when configured
+		LogSink     bool                   `toml:"logSink" json:"logSink" mapstructure:"logSink"`
+		FileSink    FileAuditSinkConfig    `toml:"fileSink" json:"fileSink" mapstructure:"fileSink"`
+		WebhookSink WebhookAuditSinkConfig `toml:"webhookSink" json:"webhookSink" mapstructure:"webhookSink"`
+		// ChainSink tamper-evident HMAC chained file, see VerifyAuditChain
+		ChainSink ChainAuditSinkConfig `toml:"chainSink" json:"chainSink" mapstructure:"chainSink"`
+		// Logger used by the log sink and to report sink failures, required by LogSink; set to the module logger by web
+		Logger log.ZapLog
 	}
 )
 
+var DefaultAuditConfig = AuditConfig{
+	Enabled: false,
+	Async:   DefaultAuditAsyncConfig,
+}
+
 type _auditCtx struct {
-	userData   map[string]interface{}
-	resourceId string
-	errs       []error
-	begin      time.Time
-	userId     string
-	clientIp   string
-	clientUA   string
+	userData    map[string]interface{}
+	resourceId  string
+	action      string
+	errs        []error
+	begin       time.Time
+	userId      string
+	tenantId    string
+	anonymous   bool
+	anonPolicy  AnonymousPolicy
+	clientIp    string
+	clientUA    string
+	aclDecision *ACLDecision
+	// active audit enabled and not skipped for current request
+	active bool
 }
 
 func (this *_auditCtx) OverrideUserId(userId string) {
@@ -54,6 +102,14 @@ func (this *_auditCtx) GetResourceId() string {
 	return this.resourceId
 }
 
+func (this *_auditCtx) SetAction(action string) {
+	this.action = action
+}
+
+func (this *_auditCtx) GetAction() string {
+	return this.action
+}
+
 func (this *_auditCtx) Set(key string, value interface{}) AuditContext {
 	if value != nil {
 		this.userData[key] = value
@@ -73,6 +129,18 @@ func (this *_auditCtx) UserId() string {
 	return this.userId
 }
 
+func (this *_auditCtx) TenantId() string {
+	return this.tenantId
+}
+
+func (this *_auditCtx) IsAnonymous() bool {
+	return this.anonymous
+}
+
+func (this *_auditCtx) AnonymousPolicy() AnonymousPolicy {
+	return this.anonPolicy
+}
+
 func (this *_auditCtx) ClientIp() string {
 	return this.clientIp
 }
@@ -90,20 +158,35 @@ func (this *_auditCtx) UserDataJson() string {
 }
 
 func (this *_auditCtx) DumpError() string {
-	errSb := strings.Builder{}
+	errStrs := make([]string, 0, len(this.errs))
 	for _, err := range this.errs {
-		errSb.WriteString(err.Error())
+		errStrs = append(errStrs, err.Error())
 	}
-	return errSb.String()
+	return strings.Join(errStrs, "; ")
+}
+
+func (this *_auditCtx) SetACLDecision(decision *ACLDecision) {
+	this.aclDecision = decision
+}
+
+func (this *_auditCtx) ACLDecision() *ACLDecision {
+	return this.aclDecision
 }
 
 func (this *_auditCtx) reset() {
 	this.userData = make(map[string]interface{})
 	this.errs = make([]error, 0)
+	this.resourceId = ""
+	this.action = ""
 	this.begin = time.Now()
 	this.userId = ""
+	this.tenantId = ""
+	this.anonymous = false
+	this.anonPolicy = ""
 	this.clientIp = ""
 	this.clientUA = ""
+	this.aclDecision = nil
+	this.active = false
 }
 
 func CurrentAuditContext(ctx echo.Context) AuditContext {
@@ -114,6 +197,11 @@ func Audit(config AuditConfig) echo.MiddlewareFunc {
 	if config.Skipper == nil {
 		config.Skipper = DefaultSkipper
 	}
+	var dispatcher *AuditDispatcher
+	// sinks are only opened when enabled, a disabled Audit holds no shared file sink
+	if config.Enabled {
+		dispatcher = newAuditDispatcher(config)
+	}
 	ctxPool := &sync.Pool{
 		New: func() interface{} { return new(_auditCtx) },
 	}
@@ -121,7 +209,13 @@ func Audit(config AuditConfig) echo.MiddlewareFunc {
 		return func(ctx echo.Context) error {
 			auditCtx := ctxPool.Get().(*_auditCtx)
 			auditCtx.reset()
-			auditCtx.userId = CurrentAuthContext(ctx).GetUserId()
+			authCtx := callerAuthContext(ctx)
+			auditCtx.userId = authCtx.GetUserId()
+			auditCtx.anonymous = authCtx.IsAnonymous()
+			if identity, ok := authCtx.(AnonymousIdentity); ok {
+				auditCtx.anonPolicy = identity.AnonymousPolicy()
+			}
+			auditCtx.tenantId = currentTenantId(ctx)
 			auditCtx.clientUA = ctx.Request().UserAgent()
 			auditCtx.clientIp = ctx.RealIP()
 			defer func() {
@@ -135,6 +229,7 @@ func Audit(config AuditConfig) echo.MiddlewareFunc {
 			if config.Skipper(ctx) {
 				return next(ctx)
 			}
+			auditCtx.active = true
 			err := next(ctx)
 			if err != nil {
 				auditCtx.WithError(err)
@@ -142,7 +237,52 @@ func Audit(config AuditConfig) echo.MiddlewareFunc {
 			if config.FlushFunc != nil {
 				config.FlushFunc(ctx)
 			}
+			if dispatcher != nil {
+				dispatcher.Dispatch(newAuditRecord(ctx, auditCtx))
+			}
 			return err
 		}
 	}
 }
+
+// newAuditDispatcher opens the configured sinks, nil if there is none
+func newAuditDispatcher(config AuditConfig) *AuditDispatcher {
+	sinks := append([]AuditSink{}, config.Sinks...)
+	if config.LogSink {
+		if config.Logger == nil {
+			panic("audit log sink requires AuditConfig.Logger")
+		}
+		sinks = append(sinks, LogAuditSink(config.Logger))
+	}
+	if config.FileSink.Path != "" {
+		fileSink, err := openSharedAuditSink(config.FileSink.Path, config.FileSink, func() (AuditSink, error) {
+			return NewFileAuditSink(config.FileSink)
+		})
+		if err != nil {
+			panic(fmt.Sprintf("open audit file sink failed: %v", err))
+		}
+		sinks = append(sinks, fileSink)
+	}
+	if config.ChainSink.Path != "" {
+		chainSink, err := openSharedAuditSink(config.ChainSink.Path, config.ChainSink, func() (AuditSink, error) {
+			chainConfig := config.ChainSink
+			if chainConfig.Logger == nil {
+				chainConfig.Logger = config.Logger
+			}
+			return NewChainAuditSink(chainConfig)
+		})
+		if err != nil {
+			panic(fmt.Sprintf("open audit chain sink failed: %v", err))
+		}
+		sinks = append(sinks, chainSink)
+	}
+	if config.WebhookSink.URL != "" {
+		sinks = append(sinks, NewWebhookAuditSink(config.WebhookSink))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	dispatcher := NewAuditDispatcher(config.Async, config.Logger, sinks...)
+	registerAuditDispatcher(dispatcher)
+	return dispatcher
+}
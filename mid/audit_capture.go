@@ -0,0 +1,158 @@
+package mid
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// AuditCapture declares the audit action of a route and the fields recorded from
+	// the bound request and the response data, see AuditAction
+	AuditCapture struct {
+		Action string
+		// Request / Response map audit field name to a dotted path, e.g. 'items.0.sku'. empty path means the whole value
+		Request  map[string]string
+		Response map[string]string
+		// Before loads the state the request is about to change, e.g. the stored order, recorded as field 'before'.
+		// called with the validated request before the handler, an error fails the request so no change goes unaudited
+		Before func(ctx echo.Context, req interface{}) (interface{}, error)
+		// Redact keys masked wherever they appear in captured values, added to DefaultAuditRedactKeys.
+		// matched ignoring case, '_' and '-', and inside longer keys, e.g. 'token' masks 'api_token' and 'tokenHash'
+		Redact []string
+	}
+)
+
+// AuditBeforeField the field recording the value loaded by AuditCapture.Before
+const AuditBeforeField = "before"
+
+// DefaultAuditRedactKeys keys always masked in captured values, a copy of DefaultRedactKeys changed independently
+var DefaultAuditRedactKeys = append([]string{}, DefaultRedactKeys...)
+
+// AuditAction declares the audit action of the route, fields are captured by mid.Wrap into the AuditContext:
+//
+//	mid.Wrap(UpdateOrder, mid.AuditAction(mid.AuditCapture{
+//		Action:   "order.update",
+//		Request:  map[string]string{"orderId": "id", "changes": ""},
+//		Response: map[string]string{"after": ""},
+//		Before: func(ctx echo.Context, req interface{}) (interface{}, error) {
+//			return repo.GetOrder(mid.UnwrapContext(ctx), ctx.Param("id"))
+//		},
+//	}))
+func AuditAction(capture AuditCapture) WrapOption {
+	redactor := NewRedactor(RedactConfig{Keys: append(append([]string{}, DefaultAuditRedactKeys...), capture.Redact...)})
+	return wrapOptionFunc(func(cfg *wrapCtx) {
+		cfg.SetReq2Ctx = true
+		cfg.audit = &_auditCapture{AuditCapture: capture, redactor: redactor}
+	})
+}
+
+type _auditCapture struct {
+	AuditCapture
+	redactor *Redactor
+}
+
+// captureRequest req is the validated request, nil if the handler has none
+// begin names the audit action before bind, so records of rejected requests carry it too
+func (this *_auditCapture) begin(ctx echo.Context) {
+	auditCtx := activeAuditContext(ctx)
+	if auditCtx == nil || this.Action == "" {
+		return
+	}
+	auditCtx.SetAction(this.Action)
+}
+
+func (this *_auditCapture) captureRequest(ctx echo.Context, req interface{}) error {
+	auditCtx := activeAuditContext(ctx)
+	if auditCtx == nil {
+		return nil
+	}
+	this.capture(auditCtx, this.Request, req)
+	if this.Before != nil {
+		before, err := this.Before(ctx, req)
+		if err != nil {
+			return err
+		}
+		this.capture(auditCtx, map[string]string{AuditBeforeField: ""}, before)
+	}
+	return nil
+}
+
+func (this *_auditCapture) captureResponse(ctx echo.Context, rsp interface{}) {
+	auditCtx := activeAuditContext(ctx)
+	if auditCtx == nil {
+		return
+	}
+	this.capture(auditCtx, this.Response, rsp)
+}
+
+func (this *_auditCapture) capture(auditCtx AuditContext, fields map[string]string, value interface{}) {
+	if len(fields) == 0 || value == nil {
+		return
+	}
+	// normalize through json, so paths follow the json field names
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	var doc interface{}
+	if err = json.Unmarshal(raw, &doc); err != nil {
+		return
+	}
+	for name, path := range fields {
+		v, ok := lookupPath(doc, path)
+		if !ok {
+			continue
+		}
+		if path != "" && this.redactor.hideKey(lastPathSegment(path)) {
+			v = maskValue(v)
+		} else {
+			// doc is a fresh copy, redacted in place
+			v = this.redactor.redactValue(v, nil)
+		}
+		auditCtx.Set(name, v)
+	}
+}
+
+func lookupPath(doc interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return doc, true
+	}
+	cur := doc
+	for _, seg := range strings.Split(path, ".") {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			cur = node[idx]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func lastPathSegment(path string) string {
+	if idx := strings.LastIndex(path, "."); idx != -1 {
+		return path[idx+1:]
+	}
+	return path
+}
+
+// activeAuditContext returns nil if audit is not installed, disabled or skipped for the request
+func activeAuditContext(ctx echo.Context) *_auditCtx {
+	if auditCtx, ok := ctx.Get(CtxAuditKey).(*_auditCtx); ok && auditCtx != nil && auditCtx.active {
+		return auditCtx
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type testOrderValidator struct{}
+
+func (testOrderValidator) Validate(req interface{}) error {
+	if order, ok := req.(*testAuditOrder); ok && order.Item == "" {
+		return kerrors.ErrBadRequestf("item required")
+	}
+	return nil
+}
+
+type testAuditOrder struct {
+	Id      string                 `json:"id"`
+	Item    string                 `json:"item"`
+	Payment map[string]interface{} `json:"payment"`
+}
+
+func TestAuditAction(t *testing.T) {
+	sink := &memAuditSink{}
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Validator = testOrderValidator{}
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(Audit(AuditConfig{Enabled: true, Sinks: []AuditSink{sink}}))
+	loaded := 0
+	e.PUT("/audit-capture/orders/:id", Wrap(func(req *testAuditOrder) (*testAuditOrder, error) {
+		return req, nil
+	}, AuditAction(AuditCapture{
+		Action:   "order.update",
+		Request:  map[string]string{"orderId": "id", "payment": "payment", "cardNumber": "payment.cardNumber"},
+		Response: map[string]string{"after": ""},
+		Before: func(ctx echo.Context, req interface{}) (interface{}, error) {
+			loaded++
+			return map[string]interface{}{"item": "old", "api_token": "t0ken"}, nil
+		},
+		Redact: []string{"card_number"},
+	})))
+	call := func(body string) {
+		req := httptest.NewRequest(http.MethodPut, "/audit-capture/orders/1", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	call(`{"id":"1","item":"new","payment":{"cardNumber":"4111111111111111","userPassword":"p","amount":1}}`)
+	// rejected by validation, nothing captured
+	call(`{"id":"1","payment":{"cardNumber":"4111111111111111"}}`)
+	assert.NoError(t, CloseAuditDispatchers(context.Background()))
+
+	records := make([]*AuditRecord, 0)
+	for _, batch := range sink.batches {
+		records = append(records, batch...)
+	}
+	assert.Len(t, records, 2)
+	assert.Equal(t, 1, loaded)
+
+	fields := records[0].Fields
+	assert.Equal(t, "order.update", records[0].Action)
+	assert.Equal(t, "1", fields["orderId"])
+	assert.NotEqual(t, "4111111111111111", fields["cardNumber"])
+	payment := fields["payment"].(map[string]interface{})
+	// keys matched ignoring case and separators, also inside longer keys
+	assert.NotEqual(t, "4111111111111111", payment["cardNumber"])
+	assert.NotEqual(t, "p", payment["userPassword"])
+	assert.Equal(t, float64(1), payment["amount"])
+	before := fields["before"].(map[string]interface{})
+	assert.Equal(t, "old", before["item"])
+	assert.NotEqual(t, "t0ken", before["api_token"])
+	after := fields["after"].(map[string]interface{})
+	assert.Equal(t, "new", after["item"])
+
+	// rejected by validation, named but nothing captured
+	assert.Equal(t, "order.update", records[1].Action)
+	assert.Equal(t, kerrors.CodeBadRequest, records[1].Code)
+	assert.Len(t, records[1].Fields, 0)
+}
@@ -0,0 +1,322 @@
+package mid
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/guestin/log"
+	"go.uber.org/zap"
+)
+
+type (
+	ChainAuditSinkConfig struct {
+		// Path of the append-only JSON-lines file, empty disables the sink.
+		// the file is never rotated, only the tail of a failed batch is cut off; archive it together with the key id
+		Path string `toml:"path" json:"path" mapstructure:"path"`
+		// Key HMAC key chaining the records, required
+		Key string `toml:"key" json:"key" mapstructure:"key"`
+		// Logger warns about a torn last entry cut off on resume, mid.Audit sets AuditConfig.Logger
+		Logger log.ZapLog
+	}
+	// AuditChainEntry one line of the chain file, Hash = HMAC(key, seq, Prev, Record)
+	AuditChainEntry struct {
+		Seq    uint64          `json:"seq"`
+		Prev   string          `json:"prev"`
+		Hash   string          `json:"hash"`
+		Record json.RawMessage `json:"record"`
+	}
+	// AuditChainReport result of VerifyAuditChain, Broken is nil if the whole chain is intact
+	AuditChainReport struct {
+		Records int              `json:"records"`
+		Broken  *AuditChainBreak `json:"broken,omitempty"`
+	}
+	// AuditChainBreak the first broken link, Line is 1-based
+	AuditChainBreak struct {
+		Line   int    `json:"line"`
+		Seq    uint64 `json:"seq"`
+		Reason string `json:"reason"`
+	}
+	// AuditChainAnchor the last persisted link, kept next to the chain file in '<path>.anchor',
+	// so cutting entries off the tail is detected by VerifyAuditChain
+	AuditChainAnchor struct {
+		Seq  uint64 `json:"seq"`
+		Hash string `json:"hash"`
+	}
+)
+
+const auditChainAnchorSuffix = ".anchor"
+
+// auditChainFile the part of *os.File used by ChainAuditSink
+type auditChainFile interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// ChainAuditSink appends records to a tamper-evident file, each entry carrying the HMAC of the
+// previous one, so any modified, removed or reordered entry breaks the chain, see VerifyAuditChain
+type ChainAuditSink struct {
+	config ChainAuditSinkConfig
+	key    []byte
+	mu     sync.Mutex
+	file   auditChainFile
+	seq    uint64
+	prev   string
+	// broken set when a failed batch could not be removed, the file tail is unknown then
+	broken error
+}
+
+func NewChainAuditSink(config ChainAuditSinkConfig) (*ChainAuditSink, error) {
+	if config.Key == "" {
+		return nil, errors.New("audit chain key must not be empty")
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger
+	}
+	out := &ChainAuditSink{config: config, key: []byte(config.Key)}
+	// resume the chain from the last entry
+	last, size, torn, err := lastAuditChainEntry(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if torn {
+		// a crash in the middle of a write, the entry was never acknowledged
+		config.Logger.Warn("audit chain ends with an incomplete entry, cut it off",
+			zap.String("path", config.Path), zap.Int64("offset", size))
+		if err = os.Truncate(config.Path, size); err != nil {
+			return nil, fmt.Errorf("resume audit chain %s: %w", config.Path, err)
+		}
+	}
+	if last != nil {
+		out.seq = last.Seq
+		out.prev = last.Hash
+	}
+	anchor, err := readAuditChainAnchor(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if anchor != nil && anchor.Seq > out.seq {
+		return nil, fmt.Errorf("resume audit chain %s: it ends at seq %d, but seq %d was persisted, the tail was removed",
+			config.Path, out.seq, anchor.Seq)
+	}
+	file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	out.file = file
+	return out, nil
+}
+
+func (this *ChainAuditSink) Write(_ context.Context, records []*AuditRecord) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.broken != nil {
+		return fmt.Errorf("audit chain %s needs to be repaired: %w", this.config.Path, this.broken)
+	}
+	buf := new(bytes.Buffer)
+	seq, prev := this.seq, this.prev
+	for _, record := range records {
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		seq++
+		entry := AuditChainEntry{
+			Seq:    seq,
+			Prev:   prev,
+			Hash:   auditChainHash(this.key, seq, prev, raw),
+			Record: raw,
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		prev = entry.Hash
+	}
+	offset, err := this.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = this.file.Write(buf.Bytes())
+	if err == nil {
+		err = this.file.Sync()
+	}
+	if err != nil {
+		// a retried batch is chained again from the same link, drop what may have reached the file
+		if truncErr := this.file.Truncate(offset); truncErr != nil {
+			this.broken = truncErr
+			return errors.Join(err, truncErr)
+		}
+		return err
+	}
+	// advance only once the batch is persisted
+	this.seq, this.prev = seq, prev
+	if err = writeAuditChainAnchor(this.config.Path, AuditChainAnchor{Seq: seq, Hash: prev}); err != nil {
+		// the batch is in the chain, a stale anchor only weakens the tail check until the next batch
+		this.config.Logger.Warn("write audit chain anchor failed", zap.String("path", this.config.Path), zap.Error(err))
+	}
+	return nil
+}
+
+func (this *ChainAuditSink) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.file.Close()
+}
+
+// VerifyAuditChain replays the chain file written by ChainAuditSink and reports the first broken link,
+// including entries removed from the tail when the '<path>.anchor' file is present.
+// the error is only about reading the files
+func VerifyAuditChain(path string, key string) (AuditChainReport, error) {
+	report := AuditChainReport{}
+	anchor, err := readAuditChainAnchor(path)
+	if err != nil {
+		return report, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer func() { _ = file.Close() }()
+	reader := bufio.NewReader(file)
+	var seq uint64
+	prev := ""
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			if anchor != nil && anchor.Seq > seq {
+				report.Broken = &AuditChainBreak{Line: lineNo, Seq: seq + 1,
+					Reason: fmt.Sprintf("chain ends before the anchored seq %d", anchor.Seq)}
+			}
+			return report, nil
+		}
+		if err != nil && err != io.EOF {
+			return report, err
+		}
+		broken := func(reason string) (AuditChainReport, error) {
+			report.Broken = &AuditChainBreak{Line: lineNo, Seq: seq + 1, Reason: reason}
+			return report, nil
+		}
+		if err == io.EOF {
+			return broken("truncated entry")
+		}
+		entry := AuditChainEntry{}
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return broken(fmt.Sprintf("malformed entry: %v", err))
+		}
+		if entry.Seq != seq+1 {
+			return broken(fmt.Sprintf("expect seq %d, got %d", seq+1, entry.Seq))
+		}
+		if entry.Prev != prev {
+			return broken("previous hash mismatch")
+		}
+		if !hmac.Equal([]byte(entry.Hash), []byte(auditChainHash([]byte(key), entry.Seq, entry.Prev, entry.Record))) {
+			return broken("hash mismatch")
+		}
+		if anchor != nil && entry.Seq == anchor.Seq && entry.Hash != anchor.Hash {
+			return broken("anchor hash mismatch")
+		}
+		seq, prev = entry.Seq, entry.Hash
+		report.Records++
+	}
+}
+
+func auditChainHash(key []byte, seq uint64, prev string, record []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatUint(seq, 10)))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(prev))
+	mac.Write([]byte{'\n'})
+	mac.Write(record)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// lastAuditChainEntry returns the last complete entry and the file size up to its end,
+// torn reports bytes after it without a line end, which are left by an interrupted write
+func lastAuditChainEntry(path string) (last *AuditChainEntry, size int64, torn bool, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer func() { _ = file.Close() }()
+	reader := bufio.NewReader(file)
+	var lastLine []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			torn = len(line) > 0
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		size += int64(len(line))
+		if len(bytes.TrimSpace(line)) > 0 {
+			lastLine = line
+		}
+	}
+	if lastLine == nil {
+		return nil, size, torn, nil
+	}
+	last = &AuditChainEntry{}
+	if err = json.Unmarshal(lastLine, last); err != nil {
+		return nil, 0, false, fmt.Errorf("resume audit chain %s: %w", path, err)
+	}
+	return last, size, torn, nil
+}
+
+func readAuditChainAnchor(path string) (*AuditChainAnchor, error) {
+	raw, err := os.ReadFile(path + auditChainAnchorSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	anchor := &AuditChainAnchor{}
+	if err = json.Unmarshal(raw, anchor); err != nil {
+		return nil, fmt.Errorf("audit chain anchor %s: %w", path+auditChainAnchorSuffix, err)
+	}
+	return anchor, nil
+}
+
+// writeAuditChainAnchor replaces the anchor atomically, a crash leaves the previous one
+func writeAuditChainAnchor(path string, anchor AuditChainAnchor) error {
+	raw, err := json.Marshal(anchor)
+	if err != nil {
+		return err
+	}
+	tmp := path + auditChainAnchorSuffix + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(raw)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+auditChainAnchorSuffix)
+}
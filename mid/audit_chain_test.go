@@ -0,0 +1,124 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/guestin/log"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestChainAuditSink_Verify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.chain.jsonl")
+	sink, err := NewChainAuditSink(ChainAuditSinkConfig{Path: path, Key: "k"})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "a"}, {UserId: "b"}}))
+	assert.NoError(t, sink.Close())
+	// reopened sink resumes the chain
+	sink, err = NewChainAuditSink(ChainAuditSinkConfig{Path: path, Key: "k"})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "c"}}))
+	assert.NoError(t, sink.Close())
+
+	report, err := VerifyAuditChain(path, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Records)
+	assert.Nil(t, report.Broken)
+
+	report, err = VerifyAuditChain(path, "other")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Broken.Line)
+
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, bytes.Replace(raw, []byte(`"userId":"b"`), []byte(`"userId":"x"`), 1), 0o600))
+	report, err = VerifyAuditChain(path, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Records)
+	assert.Equal(t, 2, report.Broken.Line)
+	assert.Equal(t, "hash mismatch", report.Broken.Reason)
+
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	assert.NoError(t, os.WriteFile(path, append(append([]byte{}, lines[0]...), lines[2]...), 0o600))
+	report, err = VerifyAuditChain(path, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Broken.Line)
+	assert.Equal(t, "expect seq 2, got 3", report.Broken.Reason)
+}
+
+// failingChainFile writes half of the first batch, then fails
+type failingChainFile struct {
+	*os.File
+	failures int
+}
+
+func (this *failingChainFile) Write(p []byte) (int, error) {
+	if this.failures > 0 {
+		this.failures--
+		n, _ := this.File.Write(p[:len(p)/2])
+		return n, errors.New("disk full")
+	}
+	return this.File.Write(p)
+}
+
+func TestChainAuditSink_FailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.chain.jsonl")
+	sink, err := NewChainAuditSink(ChainAuditSinkConfig{Path: path, Key: "k"})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "a"}}))
+	sink.file = &failingChainFile{File: sink.file.(*os.File), failures: 1}
+	batch := []*AuditRecord{{UserId: "b"}, {UserId: "c"}}
+	assert.Error(t, sink.Write(context.Background(), batch))
+	// the retry does not duplicate seq numbers after the partial write
+	assert.NoError(t, sink.Write(context.Background(), batch))
+	assert.NoError(t, sink.Close())
+
+	report, err := VerifyAuditChain(path, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Records)
+	assert.Nil(t, report.Broken)
+}
+
+func TestChainAuditSink_Resume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.chain.jsonl")
+	sink, err := NewChainAuditSink(ChainAuditSinkConfig{Path: path, Key: "k"})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "a"}, {UserId: "b"}}))
+	assert.NoError(t, sink.Close())
+
+	// interrupted in the middle of an entry
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"seq":3,"prev":"`)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	core, logs := observer.New(zap.DebugLevel)
+	sink, err = NewChainAuditSink(ChainAuditSinkConfig{Path: path, Key: "k", Logger: log.NewTaggedZapLogger(zap.New(core), "audit")})
+	assert.NoError(t, err)
+	assert.Len(t, logs.FilterMessageSnippet("incomplete entry").All(), 1)
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "c"}}))
+	assert.NoError(t, sink.Close())
+	report, err := VerifyAuditChain(path, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Records)
+	assert.Nil(t, report.Broken)
+
+	// whole entries cut off the tail keep a valid chain, the anchor tells
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	assert.NoError(t, os.WriteFile(path, bytes.Join(lines[:2], nil), 0o600))
+	report, err = VerifyAuditChain(path, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Records)
+	assert.Equal(t, 3, report.Broken.Line)
+	assert.Equal(t, "chain ends before the anchored seq 3", report.Broken.Reason)
+	_, err = NewChainAuditSink(ChainAuditSinkConfig{Path: path, Key: "k"})
+	assert.Error(t, err)
+}
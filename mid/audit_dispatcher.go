@@ -0,0 +1,334 @@
+package mid
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guestin/log"
+	"go.uber.org/zap"
+)
+
+type (
+	// AuditFullPolicy what to do when the dispatcher queue is full
+	AuditFullPolicy string
+
+	AuditAsyncConfig struct {
+		QueueSize     int             `toml:"queueSize" json:"queueSize" mapstructure:"queueSize"`
+		BatchSize     int             `toml:"batchSize" json:"batchSize" mapstructure:"batchSize"`
+		FlushInterval time.Duration   `toml:"flushInterval" json:"flushInterval" mapstructure:"flushInterval"`
+		FullPolicy    AuditFullPolicy `toml:"fullPolicy" json:"fullPolicy" mapstructure:"fullPolicy"`
+		// BlockTimeout with AuditBlock policy, the record is dropped after waiting so long
+		BlockTimeout time.Duration `toml:"blockTimeout" json:"blockTimeout" mapstructure:"blockTimeout"`
+		MaxRetries   int           `toml:"maxRetries" json:"maxRetries" mapstructure:"maxRetries"`
+		RetryBackoff time.Duration `toml:"retryBackoff" json:"retryBackoff" mapstructure:"retryBackoff"`
+		// WriteTimeout bounds every sink write
+		WriteTimeout time.Duration `toml:"writeTimeout" json:"writeTimeout" mapstructure:"writeTimeout"`
+	}
+	// AuditDispatcherStats Written and Failed count record deliveries, one per sink
+	AuditDispatcherStats struct {
+		Queued  int    `json:"queued"`
+		Written uint64 `json:"written"`
+		Dropped uint64 `json:"dropped"`
+		Failed  uint64 `json:"failed"`
+	}
+)
+
+const (
+	// AuditDrop drops the record immediately
+	AuditDrop AuditFullPolicy = "drop"
+	// AuditBlock blocks the request until there is room or BlockTimeout elapsed
+	AuditBlock AuditFullPolicy = "block"
+)
+
+var DefaultAuditAsyncConfig = AuditAsyncConfig{
+	QueueSize:     4096,
+	BatchSize:     100,
+	FlushInterval: time.Second,
+	FullPolicy:    AuditDrop,
+	BlockTimeout:  time.Millisecond * 100,
+	MaxRetries:    3,
+	RetryBackoff:  time.Millisecond * 200,
+	WriteTimeout:  time.Second * 5,
+}
+
+// AuditDispatcher delivers audit records to sinks in batches, every sink is written by its own
+// goroutine so a sink retrying a failed batch does not hold back the others
+type AuditDispatcher struct {
+	config  AuditAsyncConfig
+	sinks   []AuditSink
+	workers []chan auditSinkJob
+	logger  log.ZapLog
+	queue   chan *AuditRecord
+	flushCh chan chan struct{}
+	// closeMu guards closed, Dispatch holds it shared so no record is queued after the final drain
+	closeMu sync.RWMutex
+	closed  bool
+	closeCh chan struct{}
+	doneCh  chan struct{}
+	once    sync.Once
+	written uint64
+	dropped uint64
+	failed  uint64
+}
+
+// auditSinkJob a batch for one sink, or a flush marker closing done once the batches before it are written
+type auditSinkJob struct {
+	batch []*AuditRecord
+	done  chan struct{}
+}
+
+func NewAuditDispatcher(config AuditAsyncConfig, logger log.ZapLog, sinks ...AuditSink) *AuditDispatcher {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultAuditAsyncConfig.QueueSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultAuditAsyncConfig.BatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DefaultAuditAsyncConfig.FlushInterval
+	}
+	if config.FullPolicy == "" {
+		config.FullPolicy = DefaultAuditAsyncConfig.FullPolicy
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = DefaultAuditAsyncConfig.BlockTimeout
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = DefaultAuditAsyncConfig.RetryBackoff
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultAuditAsyncConfig.WriteTimeout
+	}
+	if logger == nil {
+		logger = nopLogger
+	}
+	out := &AuditDispatcher{
+		config:  config,
+		sinks:   sinks,
+		logger:  logger,
+		queue:   make(chan *AuditRecord, config.QueueSize),
+		flushCh: make(chan chan struct{}),
+		closeCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	// a sink may fall behind by about one queue of records before it holds back the dispatcher
+	backlog := config.QueueSize / config.BatchSize
+	if backlog < 1 {
+		backlog = 1
+	}
+	workers := &sync.WaitGroup{}
+	for _, sink := range sinks {
+		jobs := make(chan auditSinkJob, backlog)
+		out.workers = append(out.workers, jobs)
+		workers.Add(1)
+		go out.sinkLoop(sink, jobs, workers)
+	}
+	go out.loop(workers)
+	return out
+}
+
+// Dispatch enqueues record, returns false if it was dropped
+func (this *AuditDispatcher) Dispatch(record *AuditRecord) bool {
+	this.closeMu.RLock()
+	defer this.closeMu.RUnlock()
+	if this.closed {
+		atomic.AddUint64(&this.dropped, 1)
+		return false
+	}
+	select {
+	case this.queue <- record:
+		return true
+	default:
+	}
+	if this.config.FullPolicy == AuditBlock {
+		timer := time.NewTimer(this.config.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case this.queue <- record:
+			return true
+		case <-timer.C:
+		}
+	}
+	atomic.AddUint64(&this.dropped, 1)
+	this.logger.Warn("audit queue full, record dropped",
+		zap.String("traceId", record.TraceId),
+		zap.String("path", record.Path))
+	return false
+}
+
+// Flush blocks until all queued records have been written by the sinks, or ctx done
+func (this *AuditDispatcher) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case this.flushCh <- done:
+	case <-this.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close drains the queue, then closes the sinks implementing io.Closer
+func (this *AuditDispatcher) Close(ctx context.Context) error {
+	this.once.Do(func() {
+		// waits for running Dispatch calls, records queued by them are drained below
+		this.closeMu.Lock()
+		this.closed = true
+		close(this.closeCh)
+		this.closeMu.Unlock()
+	})
+	select {
+	case <-this.doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, sink := range this.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				this.logger.Error("close audit sink failed", zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+func (this *AuditDispatcher) Stats() AuditDispatcherStats {
+	return AuditDispatcherStats{
+		Queued:  len(this.queue),
+		Written: atomic.LoadUint64(&this.written),
+		Dropped: atomic.LoadUint64(&this.dropped),
+		Failed:  atomic.LoadUint64(&this.failed),
+	}
+}
+
+func (this *AuditDispatcher) loop(workers *sync.WaitGroup) {
+	defer close(this.doneCh)
+	ticker := time.NewTicker(this.config.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*AuditRecord, 0, this.config.BatchSize)
+	drain := func() {
+		for {
+			select {
+			case record := <-this.queue:
+				batch = append(batch, record)
+				if len(batch) >= this.config.BatchSize {
+					batch = this.write(batch)
+				}
+			default:
+				batch = this.write(batch)
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case record := <-this.queue:
+			batch = append(batch, record)
+			if len(batch) >= this.config.BatchSize {
+				batch = this.write(batch)
+			}
+		case <-ticker.C:
+			batch = this.write(batch)
+		case done := <-this.flushCh:
+			drain()
+			sinksDone := make([]chan struct{}, 0, len(this.workers))
+			for _, jobs := range this.workers {
+				sinkDone := make(chan struct{})
+				jobs <- auditSinkJob{done: sinkDone}
+				sinksDone = append(sinksDone, sinkDone)
+			}
+			go func() {
+				for _, sinkDone := range sinksDone {
+					<-sinkDone
+				}
+				close(done)
+			}()
+		case <-this.closeCh:
+			drain()
+			for _, jobs := range this.workers {
+				close(jobs)
+			}
+			workers.Wait()
+			return
+		}
+	}
+}
+
+// write hands batch to every sink, returns a new batch since the sinks keep it until written
+func (this *AuditDispatcher) write(batch []*AuditRecord) []*AuditRecord {
+	if len(batch) == 0 {
+		return batch
+	}
+	for _, jobs := range this.workers {
+		// blocks only when the sink is a whole backlog behind
+		jobs <- auditSinkJob{batch: batch}
+	}
+	return make([]*AuditRecord, 0, this.config.BatchSize)
+}
+
+// sinkLoop writes the batches of one sink with retries, until jobs is closed
+func (this *AuditDispatcher) sinkLoop(sink AuditSink, jobs <-chan auditSinkJob, workers *sync.WaitGroup) {
+	defer workers.Done()
+	for job := range jobs {
+		if job.done != nil {
+			close(job.done)
+			continue
+		}
+		var err error
+		for attempt := 0; attempt <= this.config.MaxRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(this.config.RetryBackoff * time.Duration(attempt))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), this.config.WriteTimeout)
+			err = sink.Write(ctx, job.batch)
+			cancel()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			atomic.AddUint64(&this.failed, uint64(len(job.batch)))
+			this.logger.Error("audit sink write failed",
+				zap.Int("records", len(job.batch)),
+				zap.Int("retries", this.config.MaxRetries),
+				zap.Error(err))
+		} else {
+			atomic.AddUint64(&this.written, uint64(len(job.batch)))
+		}
+	}
+}
+
+var auditDispatchers = struct {
+	sync.Mutex
+	list []*AuditDispatcher
+}{}
+
+func registerAuditDispatcher(dispatcher *AuditDispatcher) {
+	auditDispatchers.Lock()
+	defer auditDispatchers.Unlock()
+	auditDispatchers.list = append(auditDispatchers.list, dispatcher)
+}
+
+// CloseAuditDispatchers drains and closes the dispatchers created by mid.Audit, called by web.Shutdown
+func CloseAuditDispatchers(ctx context.Context) error {
+	auditDispatchers.Lock()
+	list := auditDispatchers.list
+	auditDispatchers.list = nil
+	auditDispatchers.Unlock()
+	var firstErr error
+	for _, dispatcher := range list {
+		if err := dispatcher.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,114 @@
+package mid
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memAuditSink struct {
+	mu      sync.Mutex
+	batches [][]*AuditRecord
+	fails   int
+}
+
+func (this *memAuditSink) Write(_ context.Context, records []*AuditRecord) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.fails > 0 {
+		this.fails--
+		return context.DeadlineExceeded
+	}
+	this.batches = append(this.batches, append([]*AuditRecord{}, records...))
+	return nil
+}
+
+func TestAuditDispatcher_BatchAndClose(t *testing.T) {
+	sink := &memAuditSink{fails: 1}
+	dispatcher := NewAuditDispatcher(AuditAsyncConfig{
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		MaxRetries:    1,
+		RetryBackoff:  time.Millisecond,
+	}, nil, sink)
+	for i := 0; i < 5; i++ {
+		assert.True(t, dispatcher.Dispatch(&AuditRecord{UserId: "u"}))
+	}
+	assert.NoError(t, dispatcher.Close(context.Background()))
+	total := 0
+	for _, batch := range sink.batches {
+		assert.True(t, len(batch) <= 2)
+		total += len(batch)
+	}
+	assert.Equal(t, 5, total)
+	assert.Equal(t, uint64(5), dispatcher.Stats().Written)
+	assert.False(t, dispatcher.Dispatch(&AuditRecord{}), "closed dispatcher drops records")
+}
+
+func TestAuditDispatcher_DropWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	sink := AuditSinkFunc(func(context.Context, []*AuditRecord) error {
+		<-block
+		return nil
+	})
+	dispatcher := NewAuditDispatcher(AuditAsyncConfig{QueueSize: 1, BatchSize: 1}, nil, sink)
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		if !dispatcher.Dispatch(&AuditRecord{}) {
+			dropped++
+		}
+	}
+	assert.True(t, dropped > 0)
+	assert.Equal(t, uint64(dropped), dispatcher.Stats().Dropped)
+	close(block)
+	assert.NoError(t, dispatcher.Close(context.Background()))
+}
+
+func TestAuditDispatcher_SlowSink(t *testing.T) {
+	block := make(chan struct{})
+	slow := AuditSinkFunc(func(context.Context, []*AuditRecord) error {
+		<-block
+		return context.DeadlineExceeded
+	})
+	sink := &memAuditSink{}
+	dispatcher := NewAuditDispatcher(AuditAsyncConfig{BatchSize: 1, MaxRetries: 3, RetryBackoff: time.Millisecond}, nil, slow, sink)
+	for i := 0; i < 3; i++ {
+		assert.True(t, dispatcher.Dispatch(&AuditRecord{}))
+	}
+	written := func() int {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.batches)
+	}
+	for i := 0; i < 100 && written() < 3; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// delivered while the other sink is still stuck in its first write
+	assert.Equal(t, 3, written())
+	close(block)
+	assert.NoError(t, dispatcher.Close(context.Background()))
+	assert.Equal(t, uint64(3), dispatcher.Stats().Failed)
+}
+
+func TestAuditDispatcher_DispatchWhileClosing(t *testing.T) {
+	sink := &memAuditSink{}
+	dispatcher := NewAuditDispatcher(AuditAsyncConfig{BatchSize: 7}, nil, sink)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				dispatcher.Dispatch(&AuditRecord{})
+			}
+		}()
+	}
+	assert.NoError(t, dispatcher.Close(context.Background()))
+	wg.Wait()
+	// every record is either written or counted as dropped
+	stats := dispatcher.Stats()
+	assert.Equal(t, uint64(800), stats.Written+stats.Dropped)
+}
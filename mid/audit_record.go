@@ -0,0 +1,188 @@
+package mid
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/guestin/mob/merrors"
+	"github.com/guestin/mob/mvalidate"
+	"github.com/labstack/echo/v4"
+)
+
+type AuditOutcome string
+
+const (
+	AuditOutcomeSuccess AuditOutcome = "success"
+	AuditOutcomeFailure AuditOutcome = "failure"
+	// AuditOutcomeDenied rejected by auth or ACL
+	AuditOutcomeDenied AuditOutcome = "denied"
+)
+
+// AuditRecordVersion is bumped on incompatible changes of AuditRecord, see AuditRecordJSONSchema
+const AuditRecordVersion = "1.0"
+
+// AuditRecord stable snapshot of an audited request, produced by mid.Audit after the handler
+// and handed to sinks, safe to be used after the request finished
+type AuditRecord struct {
+	Version   string `json:"version"`
+	TraceId   string `json:"traceId,omitempty"`
+	UserId    string `json:"userId"`
+	TenantId  string `json:"tenantId,omitempty"`
+	Anonymous bool   `json:"anonymous,omitempty"`
+	// AnonymousPolicy the policy which produced the user id of an anonymous caller
+	AnonymousPolicy AnonymousPolicy        `json:"anonymousPolicy,omitempty"`
+	ClientIp        string                 `json:"clientIp"`
+	ClientUA        string                 `json:"clientUA"`
+	Method          string                 `json:"method"`
+	Route           string                 `json:"route"`
+	Path            string                 `json:"path"`
+	Status          int                    `json:"status"`
+	Code            int                    `json:"code"`
+	Begin           time.Time              `json:"begin"`
+	LatencyMs       int64                  `json:"latencyMs"`
+	ResourceId      string                 `json:"resourceId,omitempty"`
+	Action          string                 `json:"action"`
+	Outcome         AuditOutcome           `json:"outcome"`
+	Errors          []string               `json:"errors,omitempty"`
+	Fields          map[string]interface{} `json:"fields,omitempty"`
+	// ACLDecision present when mid.ACL enforced the request
+	ACLDecision *ACLDecision `json:"aclDecision,omitempty"`
+}
+
+// AuditRecordJSONSchema JSON schema (draft 2020-12) of AuditRecord
+const AuditRecordJSONSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "https://github.com/guestin/kboot-web-echo-starter/audit-record-1.0.json",
+  "title": "AuditRecord",
+  "type": "object",
+  "required": ["version", "userId", "clientIp", "clientUA", "method", "route", "path", "status", "code", "begin", "latencyMs", "action", "outcome"],
+  "properties": {
+    "version": {"const": "1.0"},
+    "traceId": {"type": "string"},
+    "userId": {"type": "string"},
+    "tenantId": {"type": "string"},
+    "anonymous": {"type": "boolean"},
+    "anonymousPolicy": {"enum": ["fixed", "fingerprint", "cookie"]},
+    "clientIp": {"type": "string"},
+    "clientUA": {"type": "string"},
+    "method": {"type": "string"},
+    "route": {"type": "string"},
+    "path": {"type": "string"},
+    "status": {"type": "integer"},
+    "code": {"type": "integer"},
+    "begin": {"type": "string", "format": "date-time"},
+    "latencyMs": {"type": "integer", "minimum": 0},
+    "resourceId": {"type": "string"},
+    "action": {"type": "string"},
+    "outcome": {"enum": ["success", "failure", "denied"]},
+    "errors": {"type": "array", "items": {"type": "string"}},
+    "fields": {"type": "object"},
+    "aclDecision": {
+      "type": "object",
+      "required": ["allowed", "userId", "method", "route", "reason"],
+      "properties": {
+        "allowed": {"type": "boolean"},
+        "dryRun": {"type": "boolean"},
+        "userId": {"type": "string"},
+        "tenantId": {"type": "string"},
+        "method": {"type": "string"},
+        "route": {"type": "string"},
+        "requiredActions": {"type": "array", "items": {"type": "string"}},
+        "evaluated": {"type": "array", "items": {"type": "string"}},
+        "matched": {"type": "array", "items": {"type": "string"}},
+        "policy": {"type": "object"},
+        "reason": {"type": "string"}
+      }
+    }
+  }
+}`
+
+func newAuditRecord(ctx echo.Context, auditCtx *_auditCtx) *AuditRecord {
+	record := &AuditRecord{
+		Version:         AuditRecordVersion,
+		UserId:          auditCtx.userId,
+		TenantId:        auditCtx.tenantId,
+		Anonymous:       auditCtx.anonymous,
+		AnonymousPolicy: auditCtx.anonPolicy,
+		ClientIp:        auditCtx.clientIp,
+		ClientUA:        auditCtx.clientUA,
+		Method:          ctx.Request().Method,
+		Route:           ctx.Path(),
+		Path:            ctx.Request().URL.Path,
+		Begin:           auditCtx.begin,
+		LatencyMs:       time.Since(auditCtx.begin).Milliseconds(),
+		ResourceId:      auditCtx.resourceId,
+		Action:          auditCtx.action,
+		Fields:          make(map[string]interface{}, len(auditCtx.userData)),
+		ACLDecision:     auditCtx.aclDecision,
+	}
+	if traceId, ok := ctx.Get(CtxTraceIdKey).(string); ok {
+		record.TraceId = traceId
+	}
+	if record.Action == "" {
+		if actions, ok := RouteRequirement(ctx); ok && len(actions) > 0 {
+			record.Action = actions[0]
+		} else {
+			record.Action = fmt.Sprintf("%s %s", record.Method, record.Route)
+		}
+	}
+	for k, v := range auditCtx.userData {
+		record.Fields[k] = v
+	}
+	for _, err := range auditCtx.errs {
+		record.Errors = append(record.Errors, err.Error())
+	}
+	record.Status = ctx.Response().Status
+	record.Code = kerrors.CodeOk
+	if len(auditCtx.errs) > 0 {
+		lastErr := auditCtx.errs[len(auditCtx.errs)-1]
+		record.Code = errorCode(lastErr)
+		var he *echo.HTTPError
+		if !ctx.Response().Committed && errors.As(lastErr, &he) {
+			record.Status = he.Code
+		}
+	}
+	record.Outcome = auditOutcome(record)
+	return record
+}
+
+// errorCode the kerrors code answered for err
+func errorCode(err error) int {
+	var me merrors.Error
+	if errors.As(err, &me) {
+		return me.GetCode()
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return kerrors.HttpStatus2Code(he.Code)
+	}
+	switch err.(type) {
+	case validator.ValidationErrors, mvalidate.ValidateError:
+		return kerrors.CodeBadRequest
+	}
+	return kerrors.CodeInternalServer
+}
+
+func auditOutcome(record *AuditRecord) AuditOutcome {
+	if record.ACLDecision != nil && !record.ACLDecision.Allowed && !record.ACLDecision.DryRun {
+		return AuditOutcomeDenied
+	}
+	switch record.Code {
+	case kerrors.CodeOk:
+	case kerrors.CodeUnauthorized, kerrors.CodeForbidden:
+		return AuditOutcomeDenied
+	default:
+		return AuditOutcomeFailure
+	}
+	if record.Status == http.StatusUnauthorized || record.Status == http.StatusForbidden {
+		return AuditOutcomeDenied
+	}
+	if record.Status >= http.StatusBadRequest {
+		return AuditOutcomeFailure
+	}
+	return AuditOutcomeSuccess
+}
@@ -0,0 +1,205 @@
+package mid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// schemaViolations checks value against the subset of JSON schema used by AuditRecordJSONSchema,
+// properties missing from the schema are reported too, so the schema can not fall behind the struct
+func schemaViolations(schema map[string]interface{}, value interface{}, path string) []string {
+	out := make([]string, 0)
+	if c, ok := schema["const"]; ok && c != value {
+		out = append(out, fmt.Sprintf("%s: expect %v, got %v", path, c, value))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !policyContains(enum, value) {
+		out = append(out, fmt.Sprintf("%s: %v not in %v", path, value, enum))
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(out, fmt.Sprintf("%s: expect object", path))
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				out = append(out, fmt.Sprintf("%s.%s: required", path, name))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		if properties == nil {
+			return out
+		}
+		for name, v := range obj {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				out = append(out, fmt.Sprintf("%s.%s: not in schema", path, name))
+				continue
+			}
+			out = append(out, schemaViolations(property, v, path+"."+name)...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(out, fmt.Sprintf("%s: expect array", path))
+		}
+		for i, item := range items {
+			out = append(out, schemaViolations(schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return append(out, fmt.Sprintf("%s: expect string", path))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				out = append(out, fmt.Sprintf("%s: %v", path, err))
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return append(out, fmt.Sprintf("%s: expect integer", path))
+		}
+		if minimum, ok := schema["minimum"].(float64); ok && n < minimum {
+			out = append(out, fmt.Sprintf("%s: below %v", path, minimum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			out = append(out, fmt.Sprintf("%s: expect boolean", path))
+		}
+	}
+	return out
+}
+
+func TestAuditRecord_Schema(t *testing.T) {
+	schema := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(AuditRecordJSONSchema), &schema))
+	assert.Equal(t, AuditRecordVersion, schema["properties"].(map[string]interface{})["version"].(map[string]interface{})["const"])
+
+	// every field set, so the omitted ones are checked too
+	record := &AuditRecord{
+		Version:         AuditRecordVersion,
+		TraceId:         "4bf92f3577b34da6a3ce929d0e0e4736",
+		UserId:          "u1",
+		TenantId:        "t1",
+		Anonymous:       true,
+		AnonymousPolicy: AnonymousCookie,
+		ClientIp:        "10.0.0.1",
+		ClientUA:        "curl",
+		Method:          http.MethodPut,
+		Route:           "/orders/:id",
+		Path:            "/orders/1",
+		Status:          http.StatusOK,
+		Code:            kerrors.CodeForbidden,
+		Begin:           time.Now(),
+		LatencyMs:       3,
+		ResourceId:      "1",
+		Action:          "order:write",
+		Outcome:         AuditOutcomeDenied,
+		Errors:          []string{"forbidden"},
+		Fields:          map[string]interface{}{"before": map[string]interface{}{"item": "a"}},
+		ACLDecision: &ACLDecision{
+			DryRun:          true,
+			UserId:          "u1",
+			TenantId:        "t1",
+			Method:          http.MethodPut,
+			Route:           "/orders/:id",
+			RequiredActions: []string{"order:write"},
+			Evaluated:       []string{"order:read"},
+			Matched:         []string{"order:read"},
+			Policy:          &PolicyDecision{},
+			Reason:          "action 'order:write' not granted",
+		},
+	}
+	raw, err := json.Marshal(record)
+	assert.NoError(t, err)
+	value := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(raw, &value))
+	assert.Len(t, schemaViolations(schema, value, "$"), 0, fmt.Sprint(schemaViolations(schema, value, "$")))
+
+	// the minimal record keeps the required fields
+	raw, err = json.Marshal(&AuditRecord{Version: AuditRecordVersion, Outcome: AuditOutcomeSuccess})
+	assert.NoError(t, err)
+	value = map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(raw, &value))
+	assert.Len(t, schemaViolations(schema, value, "$"), 0)
+
+	value["outcome"] = "unknown"
+	delete(value, "userId")
+	violations := schemaViolations(schema, value, "$")
+	sort.Strings(violations)
+	assert.Equal(t, []string{"$.outcome: unknown not in [success failure denied]", "$.userId: required"}, violations)
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, kerrors.CodeNotFound, errorCode(kerrors.ErrNotExist()))
+	assert.Equal(t, kerrors.CodeNotFound, errorCode(fmt.Errorf("load order: %w", kerrors.ErrNotExist())))
+	assert.Equal(t, kerrors.HttpStatus2Code(http.StatusTooManyRequests), errorCode(echo.ErrTooManyRequests))
+	assert.Equal(t, kerrors.CodeBadRequest, errorCode(validator.ValidationErrors{}))
+	assert.Equal(t, kerrors.CodeInternalServer, errorCode(errors.New("boom")))
+}
+
+func TestAuditOutcome(t *testing.T) {
+	for _, c := range []struct {
+		record  AuditRecord
+		outcome AuditOutcome
+	}{
+		{AuditRecord{Status: http.StatusOK, Code: kerrors.CodeOk}, AuditOutcomeSuccess},
+		// business errors are answered with http.StatusOK
+		{AuditRecord{Status: http.StatusOK, Code: kerrors.CodeNotFound}, AuditOutcomeFailure},
+		{AuditRecord{Status: http.StatusOK, Code: kerrors.CodeForbidden}, AuditOutcomeDenied},
+		{AuditRecord{Status: http.StatusOK, Code: kerrors.CodeUnauthorized}, AuditOutcomeDenied},
+		{AuditRecord{Status: http.StatusForbidden, Code: kerrors.CodeOk}, AuditOutcomeDenied},
+		{AuditRecord{Status: http.StatusInternalServerError, Code: kerrors.CodeOk}, AuditOutcomeFailure},
+		{AuditRecord{Status: http.StatusOK, ACLDecision: &ACLDecision{Allowed: false}}, AuditOutcomeDenied},
+		// let through by dry run
+		{AuditRecord{Status: http.StatusOK, ACLDecision: &ACLDecision{Allowed: false, DryRun: true}}, AuditOutcomeSuccess},
+	} {
+		assert.Equal(t, c.outcome, auditOutcome(&c.record))
+	}
+}
+
+func TestAuditRecord_FromRequest(t *testing.T) {
+	sink := &memAuditSink{}
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(AuthWithConfig(DefaultAuthConfig))
+	e.Use(Audit(AuditConfig{Enabled: true, Sinks: []AuditSink{sink}}))
+	Require(e.GET("/audit-record/orders/:id", Wrap(func() error {
+		return kerrors.ErrNotExist()
+	})), "order:read")
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/audit-record/orders/1", nil))
+	assert.NoError(t, CloseAuditDispatchers(context.Background()))
+
+	assert.Len(t, sink.batches, 1)
+	record := sink.batches[0][0]
+	assert.Equal(t, http.StatusOK, record.Status)
+	assert.Equal(t, kerrors.CodeNotFound, record.Code)
+	assert.Equal(t, AuditOutcomeFailure, record.Outcome)
+	assert.Equal(t, "order:read", record.Action)
+	assert.True(t, record.Anonymous)
+	assert.Equal(t, AnonymousFixed, record.AnonymousPolicy)
+
+	schema := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(AuditRecordJSONSchema), &schema))
+	raw, err := json.Marshal(record)
+	assert.NoError(t, err)
+	value := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(raw, &value))
+	assert.Len(t, schemaViolations(schema, value, "$"), 0)
+}
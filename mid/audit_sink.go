@@ -0,0 +1,256 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/guestin/log"
+	"go.uber.org/zap"
+)
+
+type (
+	// AuditSink persists audit records, called by the dispatcher goroutine with a batch of records.
+	// Sinks implementing io.Closer are closed when the dispatcher shuts down.
+	AuditSink interface {
+		Write(ctx context.Context, records []*AuditRecord) error
+	}
+	AuditSinkFunc func(ctx context.Context, records []*AuditRecord) error
+
+	FileAuditSinkConfig struct {
+		// Path of the JSON-lines file, empty disables the sink
+		Path string `toml:"path" json:"path" mapstructure:"path"`
+		// MaxSize rotate when the file exceeds MaxSize bytes, <= 0 disables rotation
+		MaxSize int64 `toml:"maxSize" json:"maxSize" mapstructure:"maxSize"`
+		// MaxBackups the number of rotated files kept, as 'path.1' ... 'path.N'
+		MaxBackups int `toml:"maxBackups" json:"maxBackups" mapstructure:"maxBackups"`
+	}
+	WebhookAuditSinkConfig struct {
+		// URL records are POSTed as a JSON array, empty disables the sink
+		URL     string            `toml:"url" json:"url" mapstructure:"url"`
+		Timeout time.Duration     `toml:"timeout" json:"timeout" mapstructure:"timeout"`
+		Headers map[string]string `toml:"headers" json:"headers" mapstructure:"headers"`
+		Client  *http.Client
+	}
+)
+
+func (f AuditSinkFunc) Write(ctx context.Context, records []*AuditRecord) error {
+	return f(ctx, records)
+}
+
+// LogAuditSink writes one structured log entry per record
+func LogAuditSink(logger log.ZapLog) AuditSink {
+	if logger == nil {
+		panic("Logger must not be nil")
+	}
+	return AuditSinkFunc(func(_ context.Context, records []*AuditRecord) error {
+		for _, record := range records {
+			logger.Info("audit", zap.Any("record", record))
+		}
+		return nil
+	})
+}
+
+// FileAuditSink appends records as JSON lines, rotated by size
+type FileAuditSink struct {
+	config FileAuditSinkConfig
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+func NewFileAuditSink(config FileAuditSinkConfig) (*FileAuditSink, error) {
+	out := &FileAuditSink{config: config}
+	if err := out.open(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (this *FileAuditSink) open() error {
+	file, err := os.OpenFile(this.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	this.file = file
+	this.size = info.Size()
+	return nil
+}
+
+func (this *FileAuditSink) rotate() error {
+	err := this.file.Close()
+	this.file = nil
+	if err != nil {
+		return err
+	}
+	if this.config.MaxBackups > 0 {
+		for i := this.config.MaxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", this.config.Path, i), fmt.Sprintf("%s.%d", this.config.Path, i+1))
+		}
+		err = os.Rename(this.config.Path, this.config.Path+".1")
+	} else {
+		err = os.Truncate(this.config.Path, 0)
+	}
+	// reopen even if not rotated, see Write
+	if openErr := this.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+func (this *FileAuditSink) Write(_ context.Context, records []*AuditRecord) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	if this.file == nil {
+		// a failed rotation could not reopen the file
+		if err := this.open(); err != nil {
+			return err
+		}
+	}
+	if this.config.MaxSize > 0 && this.size > 0 && this.size+int64(buf.Len()) > this.config.MaxSize {
+		// if the file could not be rotated but is open again, keep the records rather than the size limit,
+		// the next write retries the rotation
+		if err := this.rotate(); err != nil && this.file == nil {
+			return err
+		}
+	}
+	n, err := this.file.Write(buf.Bytes())
+	this.size += int64(n)
+	return err
+}
+
+func (this *FileAuditSink) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	return this.file.Close()
+}
+
+// WebhookAuditSink posts records to an http endpoint
+type WebhookAuditSink struct {
+	config WebhookAuditSinkConfig
+}
+
+func NewWebhookAuditSink(config WebhookAuditSinkConfig) *WebhookAuditSink {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 5
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: config.Timeout}
+	}
+	return &WebhookAuditSink{config: config}
+}
+
+func (this *WebhookAuditSink) Write(ctx context.Context, records []*AuditRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderContentType, MIMEApplicationJSONCharsetUTF8)
+	for k, v := range this.config.Headers {
+		req.Header.Set(k, v)
+	}
+	rsp, err := this.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, rsp.Body)
+		_ = rsp.Body.Close()
+	}()
+	if rsp.StatusCode < http.StatusOK || rsp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("audit webhook responded %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// auditFileSinks the file and chain sinks opened by mid.Audit, by path. Audit middlewares configured with
+// the same path share one sink, so their records neither interleave half written nor fork a chain
+var auditFileSinks = struct {
+	sync.Mutex
+	m map[string]*sharedAuditSink
+}{m: make(map[string]*sharedAuditSink)}
+
+type sharedAuditSink struct {
+	sink   AuditSink
+	config interface{}
+	refs   int
+}
+
+// auditSinkRef one reference to a shared sink, the sink is closed with the last reference
+type auditSinkRef struct {
+	path   string
+	shared *sharedAuditSink
+	once   sync.Once
+}
+
+func (this *auditSinkRef) Write(ctx context.Context, records []*AuditRecord) error {
+	return this.shared.sink.Write(ctx, records)
+}
+
+func (this *auditSinkRef) Close() (err error) {
+	this.once.Do(func() {
+		auditFileSinks.Lock()
+		defer auditFileSinks.Unlock()
+		this.shared.refs--
+		if this.shared.refs > 0 {
+			return
+		}
+		delete(auditFileSinks.m, this.path)
+		if closer, ok := this.shared.sink.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return
+}
+
+// openSharedAuditSink the sink of path, opened by open unless already open with an equal config
+func openSharedAuditSink(path string, config interface{}, open func() (AuditSink, error)) (AuditSink, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	auditFileSinks.Lock()
+	defer auditFileSinks.Unlock()
+	shared, ok := auditFileSinks.m[abs]
+	if ok {
+		if shared.config != config {
+			return nil, fmt.Errorf("audit sink %s is already open with a different config", path)
+		}
+	} else {
+		sink, err := open()
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedAuditSink{sink: sink, config: config}
+		auditFileSinks.m[abs] = shared
+	}
+	shared.refs++
+	return &auditSinkRef{path: abs, shared: shared}, nil
+}
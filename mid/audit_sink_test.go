@@ -0,0 +1,72 @@
+package mid
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAuditSink_RotateFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// a non-empty directory in the way of the backup makes the rename fail
+	assert.NoError(t, os.MkdirAll(path+".1/keep", 0o755))
+	sink, err := NewFileAuditSink(FileAuditSinkConfig{Path: path, MaxSize: 10, MaxBackups: 1})
+	assert.NoError(t, err)
+	defer func() { _ = sink.Close() }()
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "a"}}))
+	// not rotated, the file is still open and keeps the records
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "b"}}))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, sink.Write(context.Background(), []*AuditRecord{{UserId: "c"}}))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+}
+
+func TestOpenSharedAuditSink(t *testing.T) {
+	config := FileAuditSinkConfig{Path: filepath.Join(t.TempDir(), "audit.jsonl")}
+	opened := 0
+	open := func() (AuditSink, error) {
+		opened++
+		return NewFileAuditSink(config)
+	}
+	first, err := openSharedAuditSink(config.Path, config, open)
+	assert.NoError(t, err)
+	second, err := openSharedAuditSink(config.Path, config, open)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, opened)
+	_, err = openSharedAuditSink(config.Path, FileAuditSinkConfig{Path: config.Path, MaxSize: 1}, open)
+	assert.Error(t, err)
+
+	assert.NoError(t, first.(*auditSinkRef).Close())
+	// still open for the second reference
+	assert.NoError(t, second.Write(context.Background(), []*AuditRecord{{UserId: "a"}}))
+	assert.NoError(t, second.(*auditSinkRef).Close())
+	third, err := openSharedAuditSink(config.Path, config, open)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, opened)
+	assert.NoError(t, third.(*auditSinkRef).Close())
+}
+
+func TestAudit_DisabledOpensNoSink(t *testing.T) {
+	dir := t.TempDir()
+	Audit(AuditConfig{
+		FileSink:  FileAuditSinkConfig{Path: filepath.Join(dir, "audit.jsonl")},
+		ChainSink: ChainAuditSinkConfig{Path: filepath.Join(dir, "audit.chain.jsonl"), Key: "k"},
+	})
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+	auditFileSinks.Lock()
+	_, ok := auditFileSinks.m[filepath.Join(dir, "audit.jsonl")]
+	auditFileSinks.Unlock()
+	assert.False(t, ok)
+}
@@ -3,12 +3,15 @@ package mid
 import (
 	"fmt"
 	"regexp"
+	"strings"
 	"sync"
-	"time"
 
+	"github.com/guestin/kboot-web-echo-starter/internal"
 	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/guestin/log"
 	"github.com/guestin/mob"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 )
 
 type (
@@ -29,44 +32,106 @@ type (
 		ClientUA() string
 		SessionInfo() AuthSessionInfo
 	}
+	// WhitelistRule matches a request by method and route path pattern.
+	// Path accepts glob or echo route template syntax, e.g. '/users/:id', '/static/*', '/public/**'
+	WhitelistRule struct {
+		Method string `toml:"method" json:"method" mapstructure:"method"` // empty or '*' means any method
+		Path   string `toml:"path" json:"path" mapstructure:"path"`
+	}
 	AuthConfig struct {
-		Enabled   bool     `toml:"enabled" json:"enabled" mapstructure:"enabled"` //是否启用，启用后将解析session info
-		Whitelist []string `toml:"whitelist" json:"whitelist" mapstructure:"whitelist"`
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"` //是否启用，启用后将解析session info
+		// Whitelist regexes, matched against the matched route template, or the cleaned request path
+		// (query string excluded) when no route matched and the path has no dot segments
+		Whitelist      []string        `toml:"whitelist" json:"whitelist" mapstructure:"whitelist"`
+		WhitelistRules []WhitelistRule `toml:"whitelistRules" json:"whitelistRules" mapstructure:"whitelistRules"`
+		// Anonymous identity policy for unauthenticated requests
+		Anonymous AnonymousConfig `toml:"anonymous" json:"anonymous" mapstructure:"anonymous"`
 		Skipper   Skipper
+		// Logger reports suspicious whitelist config at startup, set to the module logger by web
+		Logger log.ZapLog
 	}
 )
 
 var DefaultAuthConfig = AuthConfig{
-	Enabled:   false,
-	Whitelist: []string{},
+	Enabled:        false,
+	Whitelist:      []string{},
+	WhitelistRules: []WhitelistRule{},
+	Anonymous:      DefaultAnonymousConfig,
+}
+
+type _whitelistMatcher struct {
+	method  string
+	pattern *internal.PathPattern
+}
+
+func (this *_whitelistMatcher) match(ctx echo.Context) bool {
+	if this.method != "" && this.method != ctx.Request().Method {
+		return false
+	}
+	return this.pattern.Match(ctx.Path(), ctx.Request().URL.Path)
+}
+
+// compileRouteRules panics on invalid patterns, kind names the rules in the message
+func compileRouteRules(kind string, rules []WhitelistRule) []*_whitelistMatcher {
+	out := make([]*_whitelistMatcher, 0, len(rules))
+	for _, rule := range rules {
+		pattern, err := internal.CompilePathPattern(rule.Path)
+		if err != nil {
+			panic(fmt.Sprintf("%s rule %s %s is not valid: %v", kind, rule.Method, rule.Path, err))
+		}
+		method := strings.ToUpper(strings.TrimSpace(rule.Method))
+		if method == "*" {
+			method = ""
+		}
+		out = append(out, &_whitelistMatcher{method: method, pattern: pattern})
+	}
+	return out
+}
+
+func matchRouteRules(ctx echo.Context, matchers []*_whitelistMatcher) bool {
+	for _, matcher := range matchers {
+		if matcher.match(ctx) {
+			return true
+		}
+	}
+	return false
 }
 
 type _authCtx struct {
-	isAnonymous bool
-	userId      string
-	sessionId   string
-	expireAt    int64
-	clientIp    string
-	clientUA    string
-	sessionInfo AuthSessionInfo
+	isAnonymous     bool
+	anonymousPolicy AnonymousPolicy
+	userId          string
+	sessionId       string
+	expireAt        int64
+	clientIp        string
+	clientUA        string
+	sessionInfo     AuthSessionInfo
 }
 
 type _anonymousSession struct {
-	userId string
+	userId   string
+	expireAt int64
 }
 
 func (this *_anonymousSession) UserId() string {
-	return ""
+	return this.userId
 }
 
 func (this *_anonymousSession) ExpireAt() int64 {
-	return 0
+	return this.expireAt
 }
 
 func (this *_authCtx) IsAnonymous() bool {
 	return this.isAnonymous
 }
 
+func (this *_authCtx) AnonymousPolicy() AnonymousPolicy {
+	if !this.isAnonymous {
+		return ""
+	}
+	return this.anonymousPolicy
+}
+
 func (this *_authCtx) GetUserId() string {
 	return this.userId
 }
@@ -91,22 +156,45 @@ func (this *_authCtx) SessionInfo() AuthSessionInfo {
 	return this.sessionInfo
 }
 
+// snapshot an immutable copy, not returned to the pool
+func (this *_authCtx) snapshot() *_authCtx {
+	out := *this
+	return &out
+}
+
 func (this *_authCtx) reset(realIp string, ua string) {
-	now := time.Now()
-	randomId := fmt.Sprintf("ANONYMOUS_%s", now.Format("060102150405.000000"))
 	this.isAnonymous = true
+	this.anonymousPolicy = ""
 	this.sessionId = ""
-	this.userId = randomId
-	this.sessionInfo = &_anonymousSession{userId: randomId}
-	this.expireAt = time.Now().Add(time.Hour * 24).Unix()
+	this.userId = ""
+	this.sessionInfo = nil
+	this.expireAt = 0
 	this.clientIp = realIp
 	this.clientUA = ua
 }
 
+func (this *_authCtx) setAnonymous(policy AnonymousPolicy, userId string, expireAt int64) {
+	this.isAnonymous = true
+	this.anonymousPolicy = policy
+	this.userId = userId
+	this.expireAt = expireAt
+	this.sessionInfo = &_anonymousSession{userId: userId, expireAt: expireAt}
+}
+
 func CurrentAuthContext(ctx echo.Context) AuthContext {
 	return ctx.Get(CtxCallerInfoKey).(AuthContext)
 }
 
+// callerAuthContext same as CurrentAuthContext, but an anonymous caller without user id if mid.Auth is not installed
+func callerAuthContext(ctx echo.Context) AuthContext {
+	if authCtx, ok := ctx.Get(CtxCallerInfoKey).(AuthContext); ok && authCtx != nil {
+		return authCtx
+	}
+	authCtx := &_authCtx{}
+	authCtx.reset(clientIp(ctx), ctx.Request().UserAgent())
+	return authCtx
+}
+
 func Auth(providers ...AuthProvider) echo.MiddlewareFunc {
 	return AuthWithConfig(DefaultAuthConfig, providers...)
 }
@@ -121,9 +209,18 @@ func AuthWithConfig(config AuthConfig, providers ...AuthProvider) echo.Middlewar
 			if err != nil {
 				panic(fmt.Sprintf("whitelist path %s is not a valid reg path", p))
 			}
+			if !strings.HasPrefix(p, "^") || !strings.HasSuffix(p, "$") {
+				if config.Logger == nil {
+					config.Logger = nopLogger
+				}
+				config.Logger.Warn("auth whitelist regex is not anchored, it may match unexpected paths",
+					zap.String("regex", p))
+			}
 			excludeRegList = append(excludeRegList, reg)
 		}
 	}
+	excludeRuleList := compileRouteRules("whitelist", config.WhitelistRules)
+	anonymous := newAnonymousIdentifier(config.Anonymous)
 	authCtxPool := &sync.Pool{
 		New: func() interface{} { return new(_authCtx) },
 	}
@@ -136,15 +233,17 @@ func AuthWithConfig(config AuthConfig, providers ...AuthProvider) echo.Middlewar
 				ctx.Set(CtxCallerInfoKey, nil)
 			}()
 			ctx.Set(CtxCallerInfoKey, authCtx)
-			reqPath := ctx.Request().URL.String()
+			span := StartSpan(ctx, "auth")
+			endStage := startStage(ctx, "auth")
 			ignore := false
 			if !config.Enabled {
 				ignore = true
 			} else {
-				for i := range excludeRegList {
+				ignore = matchRouteRules(ctx, excludeRuleList)
+				reqPath, ok := whitelistRegexPath(ctx)
+				for i := 0; ok && !ignore && i < len(excludeRegList); i++ {
 					if excludeRegList[i].MatchString(reqPath) {
 						ignore = true
-						break
 					}
 				}
 			}
@@ -163,10 +262,37 @@ func AuthWithConfig(config AuthConfig, providers ...AuthProvider) echo.Middlewar
 				}
 			}
 			// no provider auth success, if in ignore list, will pass with anonymous auth info, otherwise return unauthorized error
-			if authCtx.isAnonymous && !ignore {
-				return kerrors.ErrUnauthorized()
+			if authCtx.isAnonymous {
+				if !ignore {
+					countAuthFailure(ctx)
+					err := kerrors.ErrUnauthorized()
+					span.RecordError(err)
+					span.End()
+					endStage()
+					return err
+				}
+				userId, expireAt := anonymous.identify(ctx)
+				authCtx.setAnonymous(anonymous.config.Policy, userId, expireAt)
 			}
+			span.SetAttribute("auth.anonymous", authCtx.isAnonymous)
+			span.End()
+			endStage()
+			// kept after the auth context is released, for outer middlewares like the access log
+			ctx.Set(CtxUserIdKey, authCtx.userId)
 			return next(ctx)
 		}
 	}
 }
+
+// whitelistRegexPath returns the path whitelist regexes run against, the route template when a route matched,
+// otherwise the request path, unless it contains dot segments
+func whitelistRegexPath(ctx echo.Context) (string, bool) {
+	if routePath := ctx.Path(); routePath != "" {
+		return routePath, true
+	}
+	reqPath := ctx.Request().URL.Path
+	if internal.HasDotSegment(reqPath) {
+		return "", false
+	}
+	return internal.CleanPath(reqPath), true
+}
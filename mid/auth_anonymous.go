@@ -0,0 +1,163 @@
+package mid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guestin/mob"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// AnonymousPolicy decides how the identity of an unauthenticated request is derived
+	AnonymousPolicy string
+
+	AnonymousConfig struct {
+		Policy AnonymousPolicy `toml:"policy" json:"policy" mapstructure:"policy"`
+		// FixedId the user id of anonymous requests with AnonymousFixed policy, also the id prefix of other policies
+		FixedId string `toml:"fixedId" json:"fixedId" mapstructure:"fixedId"`
+		// TTL the lifetime of anonymous identity
+		TTL time.Duration `toml:"ttl" json:"ttl" mapstructure:"ttl"`
+		// CookieName / CookieSecret used by AnonymousCookie policy, the secret is required
+		CookieName   string `toml:"cookieName" json:"cookieName" mapstructure:"cookieName"`
+		CookieSecret string `toml:"cookieSecret" json:"cookieSecret" mapstructure:"cookieSecret"`
+		// PreviousCookieSecrets still accepted after rotating CookieSecret, such cookies are signed again
+		PreviousCookieSecrets []string `toml:"previousCookieSecrets" json:"previousCookieSecrets" mapstructure:"previousCookieSecrets"`
+	}
+	// AnonymousIdentity optional interface of AuthContext and AuditContext, implemented by the contexts of
+	// mid.Auth and mid.Audit
+	AnonymousIdentity interface {
+		IsAnonymous() bool
+		// AnonymousPolicy the policy which produced the anonymous user id, empty if authenticated
+		AnonymousPolicy() AnonymousPolicy
+	}
+)
+
+const (
+	// AnonymousFixed all anonymous requests share the same user id
+	AnonymousFixed AnonymousPolicy = "fixed"
+	// AnonymousFingerprint user id is a hash of client ip and user agent, the ip is the connection
+	// address unless an echo.IPExtractor is configured
+	AnonymousFingerprint AnonymousPolicy = "fingerprint"
+	// AnonymousCookie user id is random, kept stable by a signed cookie
+	AnonymousCookie AnonymousPolicy = "cookie"
+)
+
+var DefaultAnonymousConfig = AnonymousConfig{
+	Policy:     AnonymousFixed,
+	FixedId:    "ANONYMOUS",
+	TTL:        time.Hour * 24,
+	CookieName: "kboot_anonymous",
+}
+
+type _anonymousIdentifier struct {
+	config AnonymousConfig
+}
+
+func newAnonymousIdentifier(config AnonymousConfig) *_anonymousIdentifier {
+	if config.Policy == "" {
+		config.Policy = DefaultAnonymousConfig.Policy
+	}
+	if config.FixedId == "" {
+		config.FixedId = DefaultAnonymousConfig.FixedId
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultAnonymousConfig.TTL
+	}
+	if config.CookieName == "" {
+		config.CookieName = DefaultAnonymousConfig.CookieName
+	}
+	switch config.Policy {
+	case AnonymousFixed, AnonymousFingerprint:
+	case AnonymousCookie:
+		if config.CookieSecret == "" {
+			panic("anonymous cookie policy requires a cookie secret")
+		}
+	default:
+		panic(fmt.Sprintf("unknown anonymous policy '%s'", config.Policy))
+	}
+	return &_anonymousIdentifier{config: config}
+}
+
+// identify returns the anonymous user id and its expire time (unix seconds)
+func (this *_anonymousIdentifier) identify(ctx echo.Context) (string, int64) {
+	expireAt := time.Now().Add(this.config.TTL).Unix()
+	switch this.config.Policy {
+	case AnonymousFingerprint:
+		sum := sha256.Sum256([]byte(clientIp(ctx) + "\x00" + ctx.Request().UserAgent()))
+		return fmt.Sprintf("%s_%s", this.config.FixedId, hex.EncodeToString(sum[:8])), expireAt
+	case AnonymousCookie:
+		if cookie, err := ctx.Cookie(this.config.CookieName); err == nil {
+			if userId, cookieExpireAt, current, ok := this.verify(cookie.Value); ok {
+				if !current {
+					this.setCookie(ctx, userId, cookieExpireAt)
+				}
+				return userId, cookieExpireAt
+			}
+		}
+		userId := fmt.Sprintf("%s_%s", this.config.FixedId, strings.ReplaceAll(mob.GenRandomUUID(), "-", ""))
+		this.setCookie(ctx, userId, expireAt)
+		return userId, expireAt
+	default:
+		return this.config.FixedId, expireAt
+	}
+}
+
+func (this *_anonymousIdentifier) setCookie(ctx echo.Context, userId string, expireAt int64) {
+	ctx.SetCookie(&http.Cookie{
+		Name:     this.config.CookieName,
+		Value:    this.sign(userId, expireAt),
+		Path:     "/",
+		Expires:  time.Unix(expireAt, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func anonymousCookieMac(secret string, payload string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// sign cookie value format: <userId>.<expireAt>.<signature>
+func (this *_anonymousIdentifier) sign(userId string, expireAt int64) string {
+	payload := fmt.Sprintf("%s.%d", userId, expireAt)
+	return payload + "." + anonymousCookieMac(this.config.CookieSecret, payload)
+}
+
+// verify current reports whether value is signed by the current secret rather than a previous one
+func (this *_anonymousIdentifier) verify(value string) (userId string, expireAt int64, current bool, ok bool) {
+	idx := strings.LastIndex(value, ".")
+	if idx == -1 {
+		return "", 0, false, false
+	}
+	payload, signature := value[:idx], value[idx+1:]
+	current = hmac.Equal([]byte(signature), []byte(anonymousCookieMac(this.config.CookieSecret, payload)))
+	signed := current
+	for _, secret := range this.config.PreviousCookieSecrets {
+		if signed {
+			break
+		}
+		signed = hmac.Equal([]byte(signature), []byte(anonymousCookieMac(secret, payload)))
+	}
+	if !signed {
+		return "", 0, false, false
+	}
+	idx = strings.LastIndex(payload, ".")
+	if idx == -1 {
+		return "", 0, false, false
+	}
+	expireAt, err := strconv.ParseInt(payload[idx+1:], 10, 64)
+	if err != nil || expireAt <= time.Now().Unix() {
+		return "", 0, false, false
+	}
+	return payload[:idx], expireAt, current, true
+}
@@ -0,0 +1,104 @@
+package mid
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymousCookie(t *testing.T) {
+	identifier := newAnonymousIdentifier(AnonymousConfig{Policy: AnonymousCookie, CookieSecret: "s1"})
+	e := echo.New()
+	identify := func(cookie string) (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: DefaultAnonymousConfig.CookieName, Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		userId, _ := identifier.identify(e.NewContext(req, rec))
+		cookies := rec.Result().Cookies()
+		if len(cookies) == 0 {
+			return userId, nil
+		}
+		return userId, cookies[0]
+	}
+	userId, issued := identify("")
+	assert.NotNil(t, issued)
+	assert.True(t, strings.HasPrefix(userId, "ANONYMOUS_"))
+
+	// kept, not issued again
+	again, cookie := identify(issued.Value)
+	assert.Equal(t, userId, again)
+	assert.Nil(t, cookie)
+
+	// tampered user id or signature
+	tampered := strings.Replace(issued.Value, userId, "ANONYMOUS_admin", 1)
+	other, cookie := identify(tampered)
+	assert.NotEqual(t, "ANONYMOUS_admin", other)
+	// rejected cookies are replaced by a new identity
+	assert.NotNil(t, cookie)
+	_, cookie = identify(issued.Value[:len(issued.Value)-1] + "x")
+	assert.NotNil(t, cookie)
+
+	// expired
+	expired := identifier.sign(userId, time.Now().Add(-time.Minute).Unix())
+	_, cookie = identify(expired)
+	assert.NotNil(t, cookie)
+
+	// a forged expiry invalidates the signature
+	idx := strings.LastIndex(expired, ".")
+	payload := fmt.Sprintf("%s.%d", userId, time.Now().Add(time.Hour).Unix())
+	_, cookie = identify(payload + expired[idx:])
+	assert.NotNil(t, cookie)
+}
+
+func TestAnonymousCookie_SecretRotation(t *testing.T) {
+	old := newAnonymousIdentifier(AnonymousConfig{Policy: AnonymousCookie, CookieSecret: "s1"})
+	rotated := newAnonymousIdentifier(AnonymousConfig{
+		Policy:                AnonymousCookie,
+		CookieSecret:          "s2",
+		PreviousCookieSecrets: []string{"s1"},
+	})
+	expireAt := time.Now().Add(time.Hour).Unix()
+	value := old.sign("ANONYMOUS_1", expireAt)
+
+	userId, _, current, ok := rotated.verify(value)
+	assert.True(t, ok)
+	assert.False(t, current)
+	assert.Equal(t, "ANONYMOUS_1", userId)
+
+	// the cookie is signed again with the current secret
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultAnonymousConfig.CookieName, Value: value})
+	rec := httptest.NewRecorder()
+	userId, _ = rotated.identify(echo.New().NewContext(req, rec))
+	assert.Equal(t, "ANONYMOUS_1", userId)
+	cookies := rec.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, rotated.sign("ANONYMOUS_1", expireAt), cookies[0].Value)
+
+	// dropped secrets are no longer accepted
+	retired := newAnonymousIdentifier(AnonymousConfig{Policy: AnonymousCookie, CookieSecret: "s2"})
+	_, _, _, ok = retired.verify(value)
+	assert.False(t, ok)
+}
+
+func TestAnonymousFingerprint(t *testing.T) {
+	identifier := newAnonymousIdentifier(AnonymousConfig{Policy: AnonymousFingerprint})
+	e := echo.New()
+	identify := func(forwardedFor string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		userId, _ := identifier.identify(e.NewContext(req, httptest.NewRecorder()))
+		return userId
+	}
+	// a spoofed X-Forwarded-For does not change the identity
+	assert.Equal(t, identify("1.1.1.1"), identify("2.2.2.2"))
+}
@@ -0,0 +1,56 @@
+package mid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthWhitelistAnchor(t *testing.T) {
+	panicOf := func(config AuthConfig) (msg string) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg = fmt.Sprint(r)
+			}
+		}()
+		AuthWithConfig(config, testAPIKeyProvider{})
+		return ""
+	}
+	assert.Equal(t, "", panicOf(AuthConfig{Whitelist: []string{"^/health$"}}))
+	// unanchored regexes are only warned about, with or without a logger
+	assert.Equal(t, "", panicOf(AuthConfig{Whitelist: []string{"/health"}}))
+	assert.Equal(t, "", panicOf(AuthConfig{Whitelist: []string{"/health"}, Logger: nopLogger}))
+}
+
+func TestAuthWhitelist_DotSegments(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(AuthWithConfig(AuthConfig{
+		Enabled:        true,
+		Whitelist:      []string{"^/open/.*$"},
+		WhitelistRules: []WhitelistRule{{Path: "/public/**"}},
+	}, testAPIKeyProvider{}))
+	e.GET("/admin", Wrap(func() error { return nil }))
+	code := func(path string) float64 {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		rsp := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+		return rsp["code"].(float64)
+	}
+	// whitelisted, nothing routed there
+	assert.Equal(t, float64(kerrors.CodeNotFound), code("/public/x"))
+	assert.Equal(t, float64(kerrors.CodeNotFound), code("/open/x"))
+	// not whitelisted
+	assert.Equal(t, float64(kerrors.CodeUnauthorized), code("/admin"))
+	assert.Equal(t, float64(kerrors.CodeUnauthorized), code("/public/../admin"))
+	assert.Equal(t, float64(kerrors.CodeUnauthorized), code("/open/../admin"))
+	assert.Equal(t, float64(kerrors.CodeUnauthorized), code("/public/./x"))
+}
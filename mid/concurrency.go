@@ -0,0 +1,270 @@
+package mid
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// ConcurrencyGroup static in-flight cap shared by the routes it matches
+	ConcurrencyGroup struct {
+		Name        string          `toml:"name" json:"name" mapstructure:"name"`
+		Routes      []WhitelistRule `toml:"routes" json:"routes" mapstructure:"routes"`
+		MaxInFlight int             `toml:"maxInFlight" json:"maxInFlight" mapstructure:"maxInFlight"`
+	}
+	// AdaptiveConcurrencyConfig AIMD limit: grows by one per window of successful requests,
+	// shrinks by Backoff when latency exceeds Tolerance times the minimum observed latency
+	AdaptiveConcurrencyConfig struct {
+		Enabled      bool    `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		InitialLimit int     `toml:"initialLimit" json:"initialLimit" mapstructure:"initialLimit"`
+		MinLimit     int     `toml:"minLimit" json:"minLimit" mapstructure:"minLimit"`
+		MaxLimit     int     `toml:"maxLimit" json:"maxLimit" mapstructure:"maxLimit"`
+		Tolerance    float64 `toml:"tolerance" json:"tolerance" mapstructure:"tolerance"`
+		Backoff      float64 `toml:"backoff" json:"backoff" mapstructure:"backoff"`
+		// ProbeInterval the minimum latency is measured again after it, to follow lasting changes
+		ProbeInterval time.Duration `toml:"probeInterval" json:"probeInterval" mapstructure:"probeInterval"`
+	}
+	// ConcurrencyConfig defines the config for Concurrency middleware
+	ConcurrencyConfig struct {
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		// MaxInFlight static cap of the server, <= 0 means none
+		MaxInFlight int `toml:"maxInFlight" json:"maxInFlight" mapstructure:"maxInFlight"`
+		// Groups a request counts against the first group matching it
+		Groups   []ConcurrencyGroup        `toml:"groups" json:"groups" mapstructure:"groups"`
+		Adaptive AdaptiveConcurrencyConfig `toml:"adaptive" json:"adaptive" mapstructure:"adaptive"`
+		// Critical routes never shed nor counted, e.g. health checks and admin calls
+		Critical []WhitelistRule `toml:"critical" json:"critical" mapstructure:"critical"`
+		// Low routes shed first, they may only use LowShare of the server limit
+		Low      []WhitelistRule `toml:"low" json:"low" mapstructure:"low"`
+		LowShare float64         `toml:"lowShare" json:"lowShare" mapstructure:"lowShare"`
+		// Name labels the gauges of this limiter, unique per Registry
+		Name string `toml:"name" json:"name" mapstructure:"name"`
+		// Registry optional, the gauges are exposed by the mid.Metrics using it, see web.GetConfig().Metrics.Registry
+		Registry *MetricsRegistry
+		Skipper  Skipper
+	}
+	// ConcurrencyStats gauges of a limiter group, Limit 0 means unlimited
+	ConcurrencyStats struct {
+		Limiter  string
+		Group    string
+		InFlight int
+		Limit    int
+		Shed     uint64
+	}
+)
+
+const (
+	// ConcurrencyGroupServer stats group of the server wide limit
+	ConcurrencyGroupServer = "server"
+	// ConcurrencyGroupCritical stats group of critical routes, never shed
+	ConcurrencyGroupCritical = "critical"
+)
+
+var DefaultConcurrencyConfig = ConcurrencyConfig{
+	Enabled:     false,
+	MaxInFlight: 0,
+	Adaptive: AdaptiveConcurrencyConfig{
+		Enabled:       false,
+		InitialLimit:  50,
+		MinLimit:      5,
+		MaxLimit:      1000,
+		Tolerance:     2,
+		Backoff:       0.9,
+		ProbeInterval: time.Second * 30,
+	},
+	LowShare: 0.8,
+	Name:     "default",
+}
+
+type concurrencyGroup struct {
+	name     string
+	matchers []*_whitelistMatcher
+	max      int
+	inFlight int
+	shed     uint64
+}
+
+type adaptiveLimit struct {
+	config       AdaptiveConcurrencyConfig
+	limit        float64
+	minRTT       time.Duration
+	probeAt      time.Time
+	lastDecrease time.Time
+}
+
+func (this *adaptiveLimit) update(latency time.Duration, dropped bool, inFlight int, now time.Time) {
+	if now.After(this.probeAt) {
+		this.minRTT = 0
+		this.probeAt = now.Add(this.config.ProbeInterval)
+	}
+	if !dropped && (this.minRTT == 0 || latency < this.minRTT) {
+		this.minRTT = latency
+	}
+	if dropped || latency > time.Duration(float64(this.minRTT)*this.config.Tolerance) {
+		// once per round trip, requests which were in flight together report the same congestion
+		if now.Sub(this.lastDecrease) >= latency {
+			this.limit = math.Max(float64(this.config.MinLimit), this.limit*this.config.Backoff)
+			this.lastDecrease = now
+		}
+		return
+	}
+	// only grow when the limit is actually used
+	if float64(inFlight)*2 >= this.limit {
+		this.limit = math.Min(float64(this.config.MaxLimit), this.limit+1/this.limit)
+	}
+}
+
+type concurrencyLimiter struct {
+	config   ConcurrencyConfig
+	critical []*_whitelistMatcher
+	low      []*_whitelistMatcher
+	groups   []*concurrencyGroup
+	adaptive *adaptiveLimit
+	mu       sync.Mutex
+	server   concurrencyGroup
+	// criticalInFlight not counted against any limit
+	criticalInFlight int
+}
+
+// limit of the server, 0 means unlimited. called with the lock held
+func (this *concurrencyLimiter) limit() int {
+	limit := this.config.MaxInFlight
+	if this.adaptive != nil {
+		if adaptive := int(this.adaptive.limit); limit <= 0 || adaptive < limit {
+			limit = adaptive
+		}
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// acquire returns the release func, nil if the request is shed
+func (this *concurrencyLimiter) acquire(ctx echo.Context) func() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if matchRouteRules(ctx, this.critical) {
+		this.criticalInFlight++
+		return func() {
+			this.mu.Lock()
+			this.criticalInFlight--
+			this.mu.Unlock()
+		}
+	}
+	var group *concurrencyGroup
+	for _, g := range this.groups {
+		if matchRouteRules(ctx, g.matchers) {
+			group = g
+			break
+		}
+	}
+	if group != nil && group.max > 0 && group.inFlight >= group.max {
+		group.shed++
+		return nil
+	}
+	if limit := this.limit(); limit > 0 {
+		if matchRouteRules(ctx, this.low) {
+			limit = int(math.Max(1, float64(limit)*this.config.LowShare))
+		}
+		if this.server.inFlight >= limit {
+			this.server.shed++
+			return nil
+		}
+	}
+	this.server.inFlight++
+	if group != nil {
+		group.inFlight++
+	}
+	begin := time.Now()
+	return func() {
+		now := time.Now()
+		dropped := ctx.Request().Context().Err() == context.DeadlineExceeded
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		if this.adaptive != nil {
+			this.adaptive.update(now.Sub(begin), dropped, this.server.inFlight, now)
+		}
+		this.server.inFlight--
+		if group != nil {
+			group.inFlight--
+		}
+	}
+}
+
+func (this *concurrencyLimiter) stats() []ConcurrencyStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	name := this.config.Name
+	out := []ConcurrencyStats{
+		{Limiter: name, Group: ConcurrencyGroupServer, InFlight: this.server.inFlight, Limit: this.limit(), Shed: this.server.shed},
+		{Limiter: name, Group: ConcurrencyGroupCritical, InFlight: this.criticalInFlight},
+	}
+	for _, g := range this.groups {
+		out = append(out, ConcurrencyStats{Limiter: name, Group: g.name, InFlight: g.inFlight, Limit: g.max, Shed: g.shed})
+	}
+	return out
+}
+
+// Concurrency sheds requests over the in-flight limits with http.StatusServiceUnavailable,
+// i.e. kerrors.CodeServiceUnavailable, without queuing them
+func Concurrency(config ConcurrencyConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	if config.LowShare <= 0 || config.LowShare > 1 {
+		config.LowShare = DefaultConcurrencyConfig.LowShare
+	}
+	if config.Name == "" {
+		config.Name = DefaultConcurrencyConfig.Name
+	}
+	limiter := &concurrencyLimiter{
+		config:   config,
+		critical: compileRouteRules("concurrency critical", config.Critical),
+		low:      compileRouteRules("concurrency low", config.Low),
+		server:   concurrencyGroup{name: ConcurrencyGroupServer},
+	}
+	for _, group := range config.Groups {
+		if group.Name == "" || group.Name == ConcurrencyGroupServer || group.Name == ConcurrencyGroupCritical {
+			panic(fmt.Sprintf("concurrency group name '%s' is empty or reserved", group.Name))
+		}
+		limiter.groups = append(limiter.groups, &concurrencyGroup{
+			name:     group.Name,
+			matchers: compileRouteRules("concurrency group "+group.Name, group.Routes),
+			max:      group.MaxInFlight,
+		})
+	}
+	if adaptive := config.Adaptive; adaptive.Enabled {
+		if adaptive.MinLimit <= 0 || adaptive.MaxLimit < adaptive.MinLimit ||
+			adaptive.InitialLimit < adaptive.MinLimit || adaptive.InitialLimit > adaptive.MaxLimit {
+			panic("adaptive concurrency limits must satisfy 0 < minLimit <= initialLimit <= maxLimit")
+		}
+		if adaptive.Tolerance <= 1 || adaptive.Backoff <= 0 || adaptive.Backoff >= 1 {
+			panic("adaptive concurrency requires tolerance > 1 and 0 < backoff < 1")
+		}
+		limiter.adaptive = &adaptiveLimit{config: adaptive, limit: float64(adaptive.InitialLimit)}
+	}
+	if config.Enabled && config.Registry != nil {
+		config.Registry.registerLimiter(limiter)
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.Enabled || config.Skipper(ctx) {
+				return next(ctx)
+			}
+			release := limiter.acquire(ctx)
+			if release == nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, kerrors.CodeText(kerrors.CodeServiceUnavailable))
+			}
+			defer release()
+			return next(ctx)
+		}
+	}
+}
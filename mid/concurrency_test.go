@@ -0,0 +1,103 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConcurrency(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Use(TraceWithConfig(TraceConfig{Logger: log.NewTaggedZapLogger(zap.New(core), "trace")}))
+	e.Use(Concurrency(ConcurrencyConfig{
+		Enabled:     true,
+		MaxInFlight: 1,
+		Critical:    []WhitelistRule{{Path: "/health"}},
+	}))
+	block := make(chan struct{})
+	entered := make(chan struct{})
+	e.GET("/slow", Wrap(func() error {
+		entered <- struct{}{}
+		<-block
+		return nil
+	}))
+	e.GET("/fast", Wrap(func() error { return nil }))
+	e.GET("/health", Wrap(func() error { return nil }))
+	e.GET("/files/*", Wrap(func() error { return nil }))
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-entered
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	// shedding is expected under overload, not a server error
+	assert.False(t, strings.Contains(rec.Body.String(), "请联系系统管理员处理"))
+	assert.Len(t, logs.FilterLevelExact(zap.ErrorLevel).All(), 0)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// routed to /files/*, not critical though it cleans to /health
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/../health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	close(block)
+	wg.Wait()
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	limit := &adaptiveLimit{
+		config: AdaptiveConcurrencyConfig{MinLimit: 2, MaxLimit: 10, Tolerance: 2, Backoff: 0.5, ProbeInterval: time.Minute},
+		limit:  8,
+	}
+	now := time.Now()
+	limit.update(time.Millisecond*10, false, 4, now)
+	assert.InDelta(t, 8.125, limit.limit, 0.001)
+	// congestion lowers the limit once per round trip
+	now = now.Add(time.Second)
+	limit.update(time.Millisecond*50, false, 4, now)
+	limit.update(time.Millisecond*50, false, 4, now.Add(time.Millisecond))
+	assert.InDelta(t, 4.0625, limit.limit, 0.001)
+	limit.update(time.Millisecond*50, true, 4, now.Add(time.Second))
+	limit.update(time.Millisecond*50, true, 4, now.Add(time.Second*2))
+	assert.Equal(t, float64(2), limit.limit)
+}
+
+func TestConcurrencyRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+	e := echo.New()
+	e.Use(Metrics(MetricsConfig{Enabled: true, Registry: registry}))
+	e.Use(Concurrency(ConcurrencyConfig{Enabled: true, MaxInFlight: 3, Name: "api", Registry: registry}))
+	e.Use(Concurrency(ConcurrencyConfig{Enabled: true, MaxInFlight: 5, Name: "edge", Registry: registry}))
+	assert.Len(t, registry.ConcurrencyStats(), 4)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `http_concurrency_limit{limiter="api",group="server"} 3`+"\n")
+	assert.Contains(t, body, `http_concurrency_limit{limiter="edge",group="server"} 5`+"\n")
+
+	defer func() {
+		assert.NotNil(t, recover())
+	}()
+	Concurrency(ConcurrencyConfig{Enabled: true, Name: "api", Registry: registry})
+}
@@ -2,13 +2,21 @@ package mid
 
 //goland:noinspection ALL
 const (
-	CtxContextKey    = "CTX-CUSTOM-CONTEXT"
-	CtxTraceIdKey    = "CTX-TRACE-ID"
-	CtxZapLoggerKey  = "CTX-ZAP-LOGGER"
-	CtxCallerInfoKey = "CTX-CALLER-INFO"
-	CtxAclKey        = "CTX-ACL-INFO"
-	CtxAuditKey      = "CTX-AUDIT-INFO"
-	CtxReqCacheKey   = "CTX-REQ-CACHE"
+	CtxContextKey      = "CTX-CUSTOM-CONTEXT"
+	CtxTraceIdKey      = "CTX-TRACE-ID"
+	CtxTraceContextKey = "CTX-TRACE-CONTEXT"
+	CtxSpanKey         = "CTX-SPAN"
+	CtxZapLoggerKey    = "CTX-ZAP-LOGGER"
+	CtxCallerInfoKey   = "CTX-CALLER-INFO"
+	CtxAclKey          = "CTX-ACL-INFO"
+	CtxAuditKey        = "CTX-AUDIT-INFO"
+	CtxReqCacheKey     = "CTX-REQ-CACHE"
+	CtxTenantKey       = "CTX-TENANT-INFO"
+	CtxTimeoutKey      = "CTX-TIMEOUT"
+	CtxUserIdKey       = "CTX-USER-ID"
+	CtxErrorCodeKey    = "CTX-ERROR-CODE"
+	CtxTimingKey       = "CTX-TIMING"
+	CtxMetricsKey      = "CTX-METRICS"
 )
 
 //goland:noinspection ALL
@@ -4,26 +4,38 @@ import (
 	"context"
 	"time"
 
+	"github.com/guestin/log"
 	"github.com/labstack/echo/v4"
 )
 
+// WithContext binds the unit context to requests: the request context is replaced by one cancelled
+// when either the client goes away or ctx is done, see UnwrapContext
 func WithContext(ctx context.Context) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			reqCtx, cancel := mergeContext(c.Request().Context(), ctx)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(reqCtx))
 			c.Set(CtxContextKey, ctx)
 			return next(c)
 		}
 	}
 }
 
+// GetContext the long-lived unit context set by WithContext, not cancelled with the request
+//
 //goland:noinspection ALL
 func GetContext(eCtx echo.Context) context.Context {
 	return eCtx.Get(CtxContextKey).(context.Context)
 }
 
+// UnwrapContext the request scoped context: cancelled when the client goes away, the unit context is done
+// or the request deadline exceeded, carrying trace id, auth context, tenant, logger and span,
+// see TraceIdFromContext, AuthFromContext, TenantFromContext, LoggerFromContext and SpanFromContext.
+// Values are captured at call time, the auth context is a copy which stays valid after the request
 func UnwrapContext(e echo.Context) context.Context {
-	if ctx, ok := e.Get(CtxContextKey).(context.Context); ok {
-		return ctx
+	if _, ok := e.Get(CtxContextKey).(context.Context); ok {
+		return newRequestContext(e)
 	}
 	panic("no context available")
 }
@@ -32,3 +44,112 @@ func UnwrapContext(e echo.Context) context.Context {
 func UnwrapTimeoutContext(e echo.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(UnwrapContext(e), timeout)
 }
+
+func TraceIdFromContext(ctx context.Context) string {
+	traceId, _ := ctx.Value(traceIdCtxKey{}).(string)
+	return traceId
+}
+
+// AuthFromContext nil if mid.Auth not installed
+func AuthFromContext(ctx context.Context) AuthContext {
+	authCtx, _ := ctx.Value(authCtxKey{}).(AuthContext)
+	return authCtx
+}
+
+// TenantFromContext empty if mid.Tenant not installed
+func TenantFromContext(ctx context.Context) string {
+	tenantId, _ := ctx.Value(tenantCtxKey{}).(string)
+	return tenantId
+}
+
+// LoggerFromContext the trace logger, a nop logger if mid.Trace not installed
+func LoggerFromContext(ctx context.Context) log.ZapLog {
+	if logger, ok := ctx.Value(loggerCtxKey{}).(log.ZapLog); ok && logger != nil {
+		return logger
+	}
+	return nopLogger
+}
+
+type (
+	traceIdCtxKey struct{}
+	authCtxKey    struct{}
+	tenantCtxKey  struct{}
+	loggerCtxKey  struct{}
+)
+
+// requestContext typed request values on top of the request context
+type requestContext struct {
+	context.Context
+	traceId  string
+	authCtx  AuthContext
+	tenantId string
+	logger   log.ZapLog
+	span     *Span
+}
+
+func newRequestContext(e echo.Context) context.Context {
+	out := &requestContext{
+		Context:  e.Request().Context(),
+		tenantId: currentTenantId(e),
+		span:     CurrentSpan(e),
+	}
+	out.traceId, _ = e.Get(CtxTraceIdKey).(string)
+	switch authCtx := e.Get(CtxCallerInfoKey).(type) {
+	case *_authCtx:
+		// the one of mid.Auth is pooled and reused by later requests
+		if authCtx != nil {
+			out.authCtx = authCtx.snapshot()
+		}
+	case AuthContext:
+		out.authCtx = authCtx
+	}
+	out.logger, _ = e.Get(CtxZapLoggerKey).(log.ZapLog)
+	return out
+}
+
+func (this *requestContext) Value(key interface{}) interface{} {
+	switch key.(type) {
+	case traceIdCtxKey:
+		return this.traceId
+	case authCtxKey:
+		return this.authCtx
+	case tenantCtxKey:
+		return this.tenantId
+	case loggerCtxKey:
+		return this.logger
+	case spanCtxKey:
+		if this.span != nil {
+			return this.span
+		}
+	}
+	return this.Context.Value(key)
+}
+
+// mergedContext cancelled with either context, values looked up in the request context first
+type mergedContext struct {
+	context.Context
+	unit context.Context
+}
+
+func (this *mergedContext) Value(key interface{}) interface{} {
+	if v := this.Context.Value(key); v != nil {
+		return v
+	}
+	return this.unit.Value(key)
+}
+
+func mergeContext(reqCtx, unit context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(reqCtx)
+	cancelDeadline := context.CancelFunc(func() {})
+	if deadline, ok := unit.Deadline(); ok {
+		ctx, cancelDeadline = context.WithDeadline(ctx, deadline)
+	}
+	stop := context.AfterFunc(unit, func() {
+		cancel(context.Cause(unit))
+	})
+	return &mergedContext{Context: ctx, unit: unit}, func() {
+		stop()
+		cancelDeadline()
+		cancel(context.Canceled)
+	}
+}
@@ -0,0 +1,72 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type unitValueKey struct{}
+
+func TestUnwrapContext(t *testing.T) {
+	unit, stopUnit := context.WithCancel(context.WithValue(context.Background(), unitValueKey{}, "unit"))
+	defer stopUnit()
+	e := echo.New()
+	e.Use(WithContext(unit), TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	var reqCtx context.Context
+	e.GET("/", func(ctx echo.Context) error {
+		reqCtx = UnwrapContext(ctx)
+		assert.Equal(t, GetTraceId(ctx), TraceIdFromContext(reqCtx))
+		assert.NotNil(t, LoggerFromContext(reqCtx))
+		assert.Nil(t, AuthFromContext(reqCtx))
+		assert.Equal(t, "unit", reqCtx.Value(unitValueKey{}))
+		assert.NoError(t, reqCtx.Err())
+		stopUnit()
+		<-reqCtx.Done()
+		return ctx.NoContent(http.StatusOK)
+	})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, context.Canceled, reqCtx.Err())
+}
+
+func TestUnwrapContext_ClientGone(t *testing.T) {
+	e := echo.New()
+	e.Use(WithContext(context.Background()))
+	clientCtx, disconnect := context.WithCancel(context.Background())
+	e.GET("/", func(ctx echo.Context) error {
+		reqCtx := UnwrapContext(ctx)
+		disconnect()
+		<-reqCtx.Done()
+		return reqCtx.Err()
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(clientCtx))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestAuthFromContext_Copy(t *testing.T) {
+	e := echo.New()
+	e.Use(WithContext(context.Background()), AuthWithConfig(AuthConfig{Enabled: true}, testAPIKeyProvider{}))
+	var reqCtx context.Context
+	e.GET("/", func(ctx echo.Context) error {
+		reqCtx = UnwrapContext(ctx)
+		return ctx.NoContent(http.StatusOK)
+	})
+	get := func(apiKey string) context.Context {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		return reqCtx
+	}
+	first := get("a")
+	userId := AuthFromContext(first).GetUserId()
+	assert.NotEqual(t, "", userId)
+	// the pooled auth context is reused by the next request, the copy is not
+	get("b")
+	assert.Equal(t, userId, AuthFromContext(first).GetUserId())
+	assert.NotEqual(t, userId, AuthFromContext(reqCtx).GetUserId())
+}
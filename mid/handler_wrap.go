@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/guestin/kboot-web-echo-starter/kerrors"
@@ -21,6 +22,8 @@ type (
 	wrapCtx struct {
 		SkipFormat bool
 		SetReq2Ctx bool
+		Timeout    time.Duration
+		audit      *_auditCapture
 	}
 	WrapOption interface {
 		apply(cfg *wrapCtx)
@@ -75,11 +78,23 @@ func Wrap(handler interface{}, option ...WrapOption) echo.HandlerFunc {
 		}
 	}
 	return func(ctx echo.Context) (err error) {
+		var handlerSpan *Span
+		releaseTimeout := func() {}
+		if cfg.Timeout > 0 {
+			releaseTimeout = applyRouteTimeout(ctx, cfg.Timeout)
+		}
 		defer func() {
 			pe := recover()
 			if pe != nil {
+				countPanic(ctx)
 				err = errors.Errorf("panic recovery: %v", pe)
 			}
+			// checked before the deadline is released
+			err = timeoutErr(ctx, err)
+			releaseTimeout()
+			// ended here to record the returned or recovered error
+			handlerSpan.RecordError(err)
+			handlerSpan.End()
 			errorHandle(err, ctx)
 			err = nil
 		}()
@@ -87,6 +102,10 @@ func Wrap(handler interface{}, option ...WrapOption) echo.HandlerFunc {
 		if inFlags&handlerHasCtx != 0 {
 			inParams = append(inParams, reflect.ValueOf(ctx))
 		}
+		if cfg.audit != nil {
+			cfg.audit.begin(ctx)
+		}
+		var reqData interface{}
 		//has req data
 		if inFlags&handlerHasReqData != 0 {
 			var req interface{}
@@ -95,8 +114,13 @@ func Wrap(handler interface{}, option ...WrapOption) echo.HandlerFunc {
 			} else {
 				req = reflect.New(inType).Interface()
 			}
+			span := StartSpan(ctx, "bind")
 			// bind
+			endBind := startStage(ctx, "bind")
 			err = ctx.Bind(req)
+			endBind()
+			span.RecordError(err)
+			span.End()
 			if err != nil {
 				return err
 			}
@@ -107,14 +131,30 @@ func Wrap(handler interface{}, option ...WrapOption) echo.HandlerFunc {
 				ctx.Set(CtxReqCacheKey, req)
 			}
 			//validate
+			span = StartSpan(ctx, "validate")
+			endValidate := startStage(ctx, "validate")
 			err = ctx.Validate(req)
+			endValidate()
+			span.RecordError(err)
+			span.End()
 			if err != nil {
 				return err
 			}
 			inParams = append(inParams, reflect.ValueOf(req))
+			reqData = req
+		}
+		// only requests which passed validation reach the handler and are captured
+		if cfg.audit != nil {
+			if err = cfg.audit.captureRequest(ctx, reqData); err != nil {
+				return err
+			}
 		}
 		//invoke
+		handlerSpan = StartSpan(ctx, fName)
+		handlerSpan.SetAttribute("code.function", fName)
+		endHandler := startStage(ctx, "handler")
 		outs := handlerValue.Call(inParams)
+		endHandler()
 		rspErrIdx := -1
 		rspDataIdx := -1
 		//has rsp data
@@ -142,6 +182,11 @@ func Wrap(handler interface{}, option ...WrapOption) echo.HandlerFunc {
 				respData = outs[rspDataIdx].Interface()
 			}
 		}
+		if cfg.audit != nil {
+			cfg.audit.captureResponse(ctx, respData)
+		}
+		endEncode := startStage(ctx, "encode")
+		defer endEncode()
 		// if skip format, return raw data
 		if cfg.SkipFormat && !ctx.Response().Committed {
 			if respData != nil {
@@ -168,6 +213,10 @@ func errorHandle(err error, ctx echo.Context) {
 	if err == nil {
 		return
 	}
+	// errors handled here never reach mid.Audit, record them for the audit record
+	if auditCtx, ok := ctx.Get(CtxAuditKey).(AuditContext); ok && auditCtx != nil {
+		auditCtx.WithError(err)
+	}
 	errCategory := uint8(0) // means default
 	var rsp merrors.Error
 	status := http.StatusOK
@@ -194,8 +243,9 @@ func errorHandle(err error, ctx echo.Context) {
 	if !ctx.Response().Committed {
 		_ = ctx.JSON(status, kerrors.WrapSensitiveErr(rsp))
 	}
-	if rsp.GetCode() < kerrors.CodeInternalServer {
-		// excepted business error
+	ctx.Set(CtxErrorCodeKey, rsp.GetCode())
+	if kerrors.IsExpectedCode(rsp.GetCode()) {
+		// excepted business error, or shed under overload
 		return
 	}
 	GetTraceLogger(ctx).Error("handler error",
@@ -0,0 +1,326 @@
+package mid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/internal"
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed set on responses replayed from the store
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+	idempotencyKeyMaxLength  = 255
+)
+
+type (
+	// IdempotencyConfig defines the config for Idempotency middleware
+	IdempotencyConfig struct {
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		// Methods honoring the Idempotency-Key header
+		Methods []string `toml:"methods" json:"methods" mapstructure:"methods"`
+		// Required rejects requests of Methods without the header
+		Required bool `toml:"required" json:"required" mapstructure:"required"`
+		// TTL how long completed responses are replayed
+		TTL time.Duration `toml:"ttl" json:"ttl" mapstructure:"ttl"`
+		// LockTTL how long a request in flight holds its key, should exceed the request timeout
+		LockTTL time.Duration `toml:"lockTTL" json:"lockTTL" mapstructure:"lockTTL"`
+		// MaxBodySize larger responses are not stored, retries run the handler again;
+		// larger request bodies are rejected with http.StatusRequestEntityTooLarge, they are hashed in memory
+		MaxBodySize int64 `toml:"maxBodySize" json:"maxBodySize" mapstructure:"maxBodySize"`
+		// ReplayHeaders response headers stored and replayed, others, e.g. Set-Cookie or tracing headers,
+		// belong to the first request only
+		ReplayHeaders []string `toml:"replayHeaders" json:"replayHeaders" mapstructure:"replayHeaders"`
+		// Store defaults to an in-memory store, set a shared one when running several instances
+		Store   IdempotencyStore
+		Skipper Skipper
+		// Logger optional, defaults to the trace logger of request
+		Logger log.ZapLog
+	}
+	// IdempotencyRecord the first request of a key, Completed once its response is stored
+	IdempotencyRecord struct {
+		Fingerprint string      `json:"fingerprint"`
+		Completed   bool        `json:"completed"`
+		Status      int         `json:"status,omitempty"`
+		Header      http.Header `json:"header,omitempty"`
+		Body        []byte      `json:"body,omitempty"`
+	}
+	// IdempotencyStore implementations must be safe for concurrent use, Begin must be atomic
+	IdempotencyStore interface {
+		// Begin reserves key for lockTTL, or returns the record already holding it
+		Begin(ctx context.Context, key string, fingerprint string, lockTTL time.Duration) (*IdempotencyRecord, error)
+		// Complete stores the response of the reserved key for ttl
+		Complete(ctx context.Context, key string, record IdempotencyRecord, ttl time.Duration) error
+		// Release drops the reservation, the next request with key runs again
+		Release(ctx context.Context, key string) error
+	}
+)
+
+var DefaultIdempotencyConfig = IdempotencyConfig{
+	Enabled:     false,
+	Methods:     []string{http.MethodPost, http.MethodPatch},
+	TTL:         time.Hour * 24,
+	LockTTL:     time.Minute,
+	MaxBodySize: 1 << 20,
+	ReplayHeaders: []string{
+		echo.HeaderContentType,
+		echo.HeaderLocation,
+		"Content-Language",
+		"ETag",
+		echo.HeaderLastModified,
+		"Cache-Control",
+	},
+}
+
+// Idempotency replays the stored response of a completed request to retries with the same Idempotency-Key.
+// Retries of a request in flight get http.StatusConflict, a key reused with another request
+// http.StatusUnprocessableEntity. Server errors are not stored, so they can be retried.
+// Keys are scoped by route and caller: the authenticated user, or the client ip for other callers. Install after mid.Auth
+func Idempotency(config IdempotencyConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryIdempotencyStore()
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = DefaultIdempotencyConfig.Methods
+	}
+	if config.TTL <= 0 || config.LockTTL <= 0 {
+		panic("idempotency ttl and lockTTL must be positive")
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultIdempotencyConfig.MaxBodySize
+	}
+	if len(config.ReplayHeaders) == 0 {
+		config.ReplayHeaders = DefaultIdempotencyConfig.ReplayHeaders
+	}
+	methods := make(map[string]struct{}, len(config.Methods))
+	for _, method := range config.Methods {
+		methods[strings.ToUpper(method)] = struct{}{}
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.Enabled || config.Skipper(ctx) {
+				return next(ctx)
+			}
+			req := ctx.Request()
+			if _, ok := methods[req.Method]; !ok {
+				return next(ctx)
+			}
+			idemKey := req.Header.Get(HeaderIdempotencyKey)
+			if idemKey == "" {
+				if config.Required {
+					return kerrors.ErrBadRequestf("%s header is required", HeaderIdempotencyKey)
+				}
+				return next(ctx)
+			}
+			if len(idemKey) > idempotencyKeyMaxLength {
+				return kerrors.ErrBadRequestf("%s header is longer than %d", HeaderIdempotencyKey, idempotencyKeyMaxLength)
+			}
+			fingerprint, err := idempotencyFingerprint(ctx, config.MaxBodySize)
+			if err != nil {
+				return err
+			}
+			key := routeKey(req.Method, ctx.Path()) + "|" + idempotencySubject(ctx) + "|" + idemKey
+			logger := idempotencyLogger(ctx, config)
+			record, err := config.Store.Begin(req.Context(), key, fingerprint, config.LockTTL)
+			if err != nil {
+				logger.Warn("idempotency store failed, request not deduplicated", zap.Error(err))
+				return next(ctx)
+			}
+			if record != nil {
+				switch {
+				case record.Fingerprint != fingerprint:
+					return echo.NewHTTPError(http.StatusUnprocessableEntity,
+						HeaderIdempotencyKey+" was used with another request")
+				case !record.Completed:
+					return echo.NewHTTPError(http.StatusConflict,
+						"a request with the same "+HeaderIdempotencyKey+" is in progress")
+				}
+				return replayIdempotent(ctx, record, config.ReplayHeaders)
+			}
+			capture := internal.NewBodyCapture(config.MaxBodySize)
+			writer := ctx.Response().Writer
+			ctx.Response().Writer = &bodyHijackWriter{
+				Writer:         io.MultiWriter(writer, capture),
+				ResponseWriter: writer,
+			}
+			completed := false
+			defer func() {
+				ctx.Response().Writer = writer
+				if completed {
+					return
+				}
+				// the handler failed or panicked, let the retry run again
+				if releaseErr := config.Store.Release(context.WithoutCancel(req.Context()), key); releaseErr != nil {
+					logger.Warn("idempotency key release failed", zap.Error(releaseErr))
+				}
+			}()
+			if err = next(ctx); err != nil {
+				// answered here, so the response can be stored
+				ctx.Error(err)
+			}
+			rsp := ctx.Response()
+			code, _ := ctx.Get(CtxErrorCodeKey).(int)
+			if !rsp.Committed || rsp.Status >= http.StatusInternalServerError ||
+				code >= kerrors.CodeInternalServer || capture.Truncated() {
+				return nil
+			}
+			err = config.Store.Complete(context.WithoutCancel(req.Context()), key, IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				Status:      rsp.Status,
+				Header:      replayHeader(rsp.Header(), config.ReplayHeaders),
+				Body:        append([]byte{}, capture.Bytes()...),
+			}, config.TTL)
+			if err != nil {
+				logger.Warn("idempotency response store failed", zap.Error(err))
+				return nil
+			}
+			completed = true
+			return nil
+		}
+	}
+}
+
+// idempotencyFingerprint hashes the route and body, the body is kept readable through the replay buffer
+func idempotencyFingerprint(ctx echo.Context, maxBodySize int64) (string, error) {
+	req := ctx.Request()
+	hash := sha256.New()
+	_, _ = io.WriteString(hash, routeKey(req.Method, ctx.Path())+"\n")
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > maxBodySize {
+			return "", echo.ErrStatusRequestEntityTooLarge
+		}
+		body, ok := req.Body.(io.ReadSeekCloser)
+		if !ok {
+			body = internal.NewReplayBuffer(req.Body)
+			req.Body = body
+		}
+		n, err := io.Copy(hash, io.LimitReader(body, maxBodySize+1))
+		if err != nil {
+			return "", kerrors.ErrBadRequestf("read request body failed: %v", err)
+		}
+		if n > maxBodySize {
+			return "", echo.ErrStatusRequestEntityTooLarge
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// idempotencySubject keys of different callers never collide. Only identities chosen by the server are used,
+// callers which are not authenticated are told apart by their ip, not by ids they could present themselves
+func idempotencySubject(ctx echo.Context) string {
+	subject := "ip:" + clientIp(ctx)
+	if authCtx, ok := ctx.Get(CtxCallerInfoKey).(AuthContext); ok && authCtx != nil &&
+		!authCtx.IsAnonymous() && authCtx.GetUserId() != "" {
+		subject = "user:" + authCtx.GetUserId()
+	}
+	if tenantId := currentTenantId(ctx); tenantId != "" {
+		return "tenant:" + tenantId + "|" + subject
+	}
+	return subject
+}
+
+// replayHeader the allowed headers of h
+func replayHeader(h http.Header, allowed []string) http.Header {
+	out := make(http.Header)
+	for _, name := range allowed {
+		if values := h.Values(name); len(values) > 0 {
+			out[http.CanonicalHeaderKey(name)] = append([]string{}, values...)
+		}
+	}
+	return out
+}
+
+func replayIdempotent(ctx echo.Context, record *IdempotencyRecord, allowed []string) error {
+	header := ctx.Response().Header()
+	// records of a shared store may have been written with another allowlist
+	for k, v := range replayHeader(record.Header, allowed) {
+		header[k] = v
+	}
+	header.Set(HeaderIdempotentReplayed, "true")
+	ctx.Response().WriteHeader(record.Status)
+	_, err := ctx.Response().Write(record.Body)
+	return err
+}
+
+func idempotencyLogger(ctx echo.Context, config IdempotencyConfig) log.ZapLog {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	if logger, ok := ctx.Get(CtxZapLoggerKey).(log.ZapLog); ok {
+		return logger
+	}
+	return nopLogger
+}
+
+type idempotencyEntry struct {
+	record   IdempotencyRecord
+	expireAt time.Time
+}
+
+// MemoryIdempotencyStore in process IdempotencyStore, expired keys are swept periodically
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+const idempotencySweepInterval = time.Minute
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]*idempotencyEntry)}
+}
+
+func (this *MemoryIdempotencyStore) Begin(_ context.Context, key string, fingerprint string, lockTTL time.Duration) (*IdempotencyRecord, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := time.Now()
+	if now.Sub(this.lastSweep) >= idempotencySweepInterval {
+		this.lastSweep = now
+		for k, entry := range this.entries {
+			if !now.Before(entry.expireAt) {
+				delete(this.entries, k)
+			}
+		}
+	}
+	if entry, ok := this.entries[key]; ok && now.Before(entry.expireAt) {
+		record := entry.record
+		return &record, nil
+	}
+	this.entries[key] = &idempotencyEntry{
+		record:   IdempotencyRecord{Fingerprint: fingerprint},
+		expireAt: now.Add(lockTTL),
+	}
+	return nil, nil
+}
+
+func (this *MemoryIdempotencyStore) Complete(_ context.Context, key string, record IdempotencyRecord, ttl time.Duration) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.entries[key] = &idempotencyEntry{record: record, expireAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (this *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.entries, key)
+	return nil
+}
@@ -0,0 +1,96 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotency(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Validator = nopValidator{}
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(Idempotency(DefaultIdempotencyConfig.withEnabled()))
+	type order struct {
+		Item string `json:"item"`
+	}
+	created := 0
+	block := make(chan struct{})
+	entered := make(chan struct{})
+	e.POST("/orders", Wrap(func(ctx echo.Context, req *order) (int, error) {
+		if req.Item == "slow" {
+			entered <- struct{}{}
+			<-block
+		}
+		created++
+		ctx.Response().Header().Set("Set-Cookie", "session=first")
+		ctx.Response().Header().Set(echo.HeaderLocation, "/orders/1")
+		return created, nil
+	}))
+	postFrom := func(remoteAddr, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(HeaderIdempotencyKey, key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	post := func(key, body string) *httptest.ResponseRecorder {
+		return postFrom("192.0.2.1:1234", key, body)
+	}
+	first := post("k1", `{"item":"book"}`)
+	assert.Equal(t, http.StatusOK, first.Code)
+	retry := post("k1", `{"item":"book"}`)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, "/orders/1", retry.Header().Get(echo.HeaderLocation))
+	assert.Equal(t, "", retry.Header().Get("Set-Cookie"))
+	assert.Equal(t, 1, created)
+
+	// unauthenticated callers of other ips do not share keys
+	other := postFrom("192.0.2.2:1234", "k1", `{"item":"pen"}`)
+	assert.Equal(t, http.StatusOK, other.Code)
+	assert.Equal(t, "", other.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, 2, created)
+
+	// bodies are hashed in memory, up to MaxBodySize
+	assert.Equal(t, http.StatusRequestEntityTooLarge,
+		post("k3", `{"item":"`+strings.Repeat("x", int(DefaultIdempotencyConfig.MaxBodySize))+`"}`).Code)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, post("k1", `{"item":"pen"}`).Code)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		post("k2", `{"item":"slow"}`)
+	}()
+	select {
+	case <-entered:
+	case <-time.After(time.Second * 5):
+		t.Fatal("first request did not reach the handler")
+	}
+	assert.Equal(t, http.StatusConflict, post("k2", `{"item":"slow"}`).Code)
+	close(block)
+	wg.Wait()
+	assert.Equal(t, 3, created)
+}
+
+type nopValidator struct{}
+
+func (nopValidator) Validate(interface{}) error {
+	return nil
+}
+
+func (this IdempotencyConfig) withEnabled() IdempotencyConfig {
+	this.Enabled = true
+	return this
+}
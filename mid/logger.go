@@ -6,12 +6,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	mapset "github.com/deckarep/golang-set"
+	"github.com/guestin/kboot-web-echo-starter/internal"
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
 	"github.com/guestin/log"
 	"github.com/guestin/mob"
 	"github.com/labstack/echo/v4"
@@ -47,8 +50,12 @@ const (
 
 type (
 	LogBodyOption uint64
+	// LogFormat output of the Logger middleware
+	LogFormat string
 
 	LoggerConfig struct {
+		// Format LogFormatText by default
+		Format            LogFormat `toml:"format" json:"format" mapstructure:"format"`
 		Skipper           Skipper
 		Logger            log.ZapLog
 		LogReqHeader      *bool
@@ -58,7 +65,31 @@ type (
 		LogRespHeader     *bool
 		LogRespBody       *bool
 		LogRespBodyOption LogBodyOption
+		// Redact applied to logged bodies and query strings, defaults to DefaultRedactKeys
+		Redact RedactConfig `toml:"redact" json:"redact" mapstructure:"redact"`
+		// RouteRedact merged with Redact per 'METHOD /route/template', keys are case insensitive
+		RouteRedact map[string]RedactConfig `toml:"routeRedact" json:"routeRedact" mapstructure:"routeRedact"`
+		// MaxBodySize bytes of each body kept for logging while it streams through, the rest is only counted
+		MaxBodySize int64 `toml:"maxBodySize" json:"maxBodySize" mapstructure:"maxBodySize"`
+		// BodySample which requests get their bodies logged, all by default
+		BodySample *BodySampleConfig `toml:"bodySample" json:"bodySample" mapstructure:"bodySample"`
 	}
+	// BodySampleConfig bodies are logged if any condition holds
+	BodySampleConfig struct {
+		// Rate fraction of requests, 0 ~ 1
+		Rate float64 `toml:"rate" json:"rate" mapstructure:"rate"`
+		// OnError requests answered with status >= 400 or an error code
+		OnError bool `toml:"onError" json:"onError" mapstructure:"onError"`
+		// Slow requests taking at least Slow, 0 disables
+		Slow time.Duration `toml:"slow" json:"slow" mapstructure:"slow"`
+	}
+)
+
+const (
+	// LogFormatText free text lines, headers and bodies line by line at debug level
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON one structured entry per request, headers and bodies as nested fields
+	LogFormatJSON LogFormat = "json"
 )
 
 const (
@@ -78,6 +109,7 @@ func teaBool(v bool) *bool {
 
 var (
 	DefaultLoggerConfig = LoggerConfig{
+		Format:            LogFormatText,
 		Skipper:           DefaultSkipper,
 		Logger:            nil,
 		LogReqHeader:      teaBool(true),
@@ -87,6 +119,9 @@ var (
 		LogRespHeader:     teaBool(true),
 		LogRespBody:       teaBool(true),
 		LogRespBodyOption: LogBodyForm | LogBodyXml | LogBodyJson,
+		Redact:            RedactConfig{Keys: DefaultRedactKeys},
+		MaxBodySize:       64 * 1024,
+		BodySample:        &BodySampleConfig{Rate: 1},
 	}
 )
 
@@ -103,6 +138,15 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 	if config.Skipper == nil {
 		config.Skipper = DefaultSkipper
 	}
+	if config.Format == "" {
+		config.Format = DefaultLoggerConfig.Format
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultLoggerConfig.MaxBodySize
+	}
+	if config.BodySample == nil {
+		config.BodySample = DefaultLoggerConfig.BodySample
+	}
 	if config.LogReqBody == nil {
 		config.LogReqBody = DefaultLoggerConfig.LogReqBody
 	}
@@ -121,6 +165,10 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 	if config.LogRespHeader == nil {
 		config.LogRespHeader = DefaultLoggerConfig.LogRespHeader
 	}
+	if len(config.Redact.Keys)+len(config.Redact.Paths)+len(config.Redact.Patterns)+len(config.Redact.Builtin) == 0 {
+		config.Redact = DefaultLoggerConfig.Redact
+	}
+	redactors := newLoggerRedactors(config)
 	hideHeader := mob.NewSet()
 	for _, h := range config.HideHeader {
 		hideHeader.Add(strings.ToLower(h))
@@ -131,7 +179,11 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 			if config.Skipper(ctx) {
 				return next(ctx)
 			}
+			if config.Format == LogFormatJSON {
+				return structuredLog(ctx, next, config, hideHeader, redactors.forRoute(ctx))
+			}
 			begin := time.Now()
+			redactor := redactors.forRoute(ctx)
 			traceId := GetTraceId(ctx)
 			logger := config.Logger
 			if traceId != "" {
@@ -142,19 +194,26 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 			method := ctx.Request().Method
 			rawQuery := ctx.Request().URL.RawQuery
 			if rawQuery != "" {
-				relUrl = relUrl + "?" + rawQuery
+				relUrl = relUrl + "?" + redactor.RedactForm(rawQuery)
 			}
 			clientIp := ctx.RealIP()
 			logger.Info(fmt.Sprintf("<<<<<<<<<< %s | %s %s", clientIp, method, relUrl))
 			if *config.LogReqHeader {
 				loggerHeader(ctx.Request().Header, logger, hideHeader)
 			}
-			reqCt := ctx.Request().Header.Get(echo.HeaderContentType)
-			if *config.LogReqBody && ctx.Request().ContentLength > 0 && shouldLogBody(config.LogReqBodyOption, reqCt) {
-				reqBody := make([]byte, 0)
-				reqBody, _ = io.ReadAll(ctx.Request().Body)
-				ctx.Request().Body = io.NopCloser(bytes.NewBuffer(reqBody)) // reset
-				if strings.Contains(reqCt, MIMEApplicationJSON) {
+			bodies := captureBodies(ctx, config)
+			err := next(ctx)
+			code, _ := ctx.Get(CtxErrorCodeKey).(int)
+			if err != nil {
+				code = errorCode(err)
+				ctx.Error(err)
+			}
+			latency := time.Now().Sub(begin)
+			statusCode := ctx.Response().Status
+			logBodies := config.BodySample.sample(statusCode, code, latency)
+			if logBodies && bodies.logReq {
+				reqBody := []byte(bodies.render(redactor, bodies.reqCt, bodies.req))
+				if strings.Contains(bodies.reqCt, MIMEApplicationJSON) && !bodies.req.Truncated() {
 					buf := new(bytes.Buffer)
 					if ce := json.Compact(buf, reqBody); ce == nil {
 						reqBody = buf.Bytes()
@@ -166,19 +225,6 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 					logger.Debug(line)
 				}
 			}
-			resBody := new(bytes.Buffer)
-			if *config.LogRespBody {
-				mw := io.MultiWriter(ctx.Response().Writer, resBody)
-				writer := &loggerBodyHijackWriter{Writer: mw, ResponseWriter: ctx.Response().Writer}
-				ctx.Response().Writer = writer
-			}
-			err := next(ctx)
-			if err != nil {
-				ctx.Error(err)
-			}
-			latency := time.Now().Sub(begin)
-			statusCode := ctx.Response().Status
-			bodySize := ctx.Response().Size
 			output := logger.Info
 			if statusCode >= http.StatusOK && statusCode <= http.StatusMultipleChoices {
 			} else {
@@ -195,8 +241,8 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 				loggerHeader(ctx.Response().Header(), logger, hideHeader)
 			}
 			resCt := ctx.Response().Header().Get(echo.HeaderContentType)
-			if *config.LogRespBody && bodySize > 0 && shouldLogBody(config.LogRespBodyOption, resCt) {
-				bodyLines := strings.Split(resBody.String(), "\n")
+			if logBodies && bodies.logRsp(config, resCt) {
+				bodyLines := strings.Split(bodies.render(redactor, resCt, bodies.rsp), "\n")
 				logger.Debug("Body:")
 				for _, line := range bodyLines {
 					logger.Debug(line)
@@ -207,6 +253,77 @@ func LoggerWithConfig(config LoggerConfig) echo.MiddlewareFunc {
 	}
 }
 
+// loggerBodies bounded captures of the bodies, filled while they stream through
+type loggerBodies struct {
+	reqCt  string
+	logReq bool
+	req    *internal.BodyCapture
+	rsp    *internal.BodyCapture
+}
+
+func captureBodies(ctx echo.Context, config LoggerConfig) *loggerBodies {
+	req := ctx.Request()
+	out := &loggerBodies{reqCt: req.Header.Get(echo.HeaderContentType)}
+	out.logReq = *config.LogReqBody && req.ContentLength != 0 && shouldLogBody(config.LogReqBodyOption, out.reqCt)
+	// always counted, only captured if logged
+	limit := int64(0)
+	if out.logReq {
+		limit = config.MaxBodySize
+	}
+	out.req = internal.NewBodyCapture(limit)
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = internal.NewCaptureReader(req.Body, out.req)
+	}
+	if *config.LogRespBody {
+		out.rsp = internal.NewBodyCapture(config.MaxBodySize)
+		mw := io.MultiWriter(ctx.Response().Writer, out.rsp)
+		ctx.Response().Writer = &bodyHijackWriter{Writer: mw, ResponseWriter: ctx.Response().Writer}
+	}
+	return out
+}
+
+func (this *loggerBodies) logRsp(config LoggerConfig, contentType string) bool {
+	return this.rsp != nil && this.rsp.Total() > 0 && shouldLogBody(config.LogRespBodyOption, contentType)
+}
+
+// render redacted body, with a truncation marker if it was cut
+func (this *loggerBodies) render(redactor *Redactor, contentType string, capture *internal.BodyCapture) string {
+	return string(redactor.RedactBody(contentType, capture.Bytes())) + capture.TruncationMarker()
+}
+
+func (this *BodySampleConfig) sample(status int, code int, latency time.Duration) bool {
+	if this.Rate >= 1 || this.Rate > 0 && rand.Float64() < this.Rate {
+		return true
+	}
+	if this.OnError && (status >= http.StatusBadRequest || code != kerrors.CodeOk) {
+		return true
+	}
+	return this.Slow > 0 && latency >= this.Slow
+}
+
+type loggerRedactors struct {
+	global *Redactor
+	routes map[string]*Redactor
+}
+
+func newLoggerRedactors(config LoggerConfig) *loggerRedactors {
+	out := &loggerRedactors{
+		global: NewRedactor(config.Redact),
+		routes: make(map[string]*Redactor, len(config.RouteRedact)),
+	}
+	for route, redact := range routeOverrides("logger redact", config.RouteRedact) {
+		out.routes[route] = NewRedactor(config.Redact.Merge(redact))
+	}
+	return out
+}
+
+func (this *loggerRedactors) forRoute(ctx echo.Context) *Redactor {
+	if redactor, ok := lookupRouteOverride(this.routes, ctx.Request().Method, ctx.Path()); ok {
+		return redactor
+	}
+	return this.global
+}
+
 func shouldLogBody(option LogBodyOption, contentType string) bool {
 	return (option&LogBodyAll != 0 ||
 		option&LogBodyForm != 0 && strings.Contains(contentType, MIMEApplicationForm)) ||
@@ -250,23 +367,23 @@ func loggerHeader(header http.Header, logger log.ZapLog, hide mapset.Set) {
 	}
 }
 
-type loggerBodyHijackWriter struct {
+type bodyHijackWriter struct {
 	io.Writer
 	http.ResponseWriter
 }
 
-func (w *loggerBodyHijackWriter) WriteHeader(code int) {
+func (w *bodyHijackWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func (w *loggerBodyHijackWriter) Write(b []byte) (int, error) {
+func (w *bodyHijackWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
-func (w *loggerBodyHijackWriter) Flush() {
+func (w *bodyHijackWriter) Flush() {
 	w.ResponseWriter.(http.Flusher).Flush()
 }
 
-func (w *loggerBodyHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+func (w *bodyHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
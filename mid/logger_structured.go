@@ -0,0 +1,107 @@
+package mid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/guestin/kboot-web-echo-starter/internal"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// structuredLog LogFormatJSON, one entry per request after the handler
+func structuredLog(ctx echo.Context, next echo.HandlerFunc, config LoggerConfig, hideHeader mapset.Set, redactor *Redactor) error {
+	begin := time.Now()
+	req := ctx.Request()
+	fields := make([]zap.Field, 0, 20)
+	if *config.LogReqHeader {
+		fields = append(fields, zap.Any("reqHeaders", headerFields(req.Header, hideHeader)))
+	}
+	bodies := captureBodies(ctx, config)
+	err := next(ctx)
+	code, _ := ctx.Get(CtxErrorCodeKey).(int)
+	if err != nil {
+		code = errorCode(err)
+		ctx.Error(err)
+	}
+	status := ctx.Response().Status
+	latency := time.Since(begin)
+	// bodies are counted as consumed, unread bodies by their declared length
+	bytesIn := bodies.req.Total()
+	if req.ContentLength > bytesIn {
+		bytesIn = req.ContentLength
+	}
+	userId, _ := ctx.Get(CtxUserIdKey).(string)
+	traceId, _ := ctx.Get(CtxTraceIdKey).(string)
+	fields = append(fields,
+		zap.String("traceId", traceId),
+		zap.String("method", req.Method),
+		zap.String("route", ctx.Path()),
+		zap.String("path", req.URL.Path),
+		zap.String("query", redactor.RedactForm(req.URL.RawQuery)),
+		zap.Int("status", status),
+		zap.Int("code", code),
+		zap.Int64("latencyMs", latency.Milliseconds()),
+		zap.Int64("bytesIn", bytesIn),
+		zap.Int64("bytesOut", ctx.Response().Size),
+		zap.String("clientIp", ctx.RealIP()),
+		zap.String("ua", req.UserAgent()),
+		zap.String("userId", userId),
+	)
+	if timings := CurrentTimings(ctx); timings != nil {
+		fields = append(fields, timings.logField())
+	}
+	if *config.LogRespHeader {
+		fields = append(fields, zap.Any("rspHeaders", headerFields(ctx.Response().Header(), hideHeader)))
+	}
+	if config.BodySample.sample(status, code, latency) {
+		if bodies.logReq {
+			fields = append(fields, bodyField("reqBody", bodies.reqCt, redactor, bodies.req))
+		}
+		resCt := ctx.Response().Header().Get(echo.HeaderContentType)
+		if bodies.logRsp(config, resCt) {
+			fields = append(fields, bodyField("rspBody", resCt, redactor, bodies.rsp))
+		}
+	}
+	output := config.Logger.Info
+	if status < http.StatusOK || status > http.StatusMultipleChoices {
+		output = config.Logger.Warn
+	}
+	output("request", fields...)
+	return nil
+}
+
+// headerFields hidden headers are masked, or left out if too short to be masked
+func headerFields(header http.Header, hide mapset.Set) map[string]string {
+	out := make(map[string]string, len(header))
+	for k, v := range header {
+		vv := strings.Join(v, " ")
+		if hide.Contains(strings.ToLower(k)) {
+			if len(vv) > 8 {
+				out[k] = hideString(vv)
+			}
+			continue
+		}
+		out[k] = vv
+	}
+	return out
+}
+
+// bodyField nests valid json bodies, other or truncated bodies are logged as string
+func bodyField(key string, contentType string, redactor *Redactor, capture *internal.BodyCapture) zap.Field {
+	body := redactor.RedactBody(contentType, capture.Bytes())
+	if capture.Truncated() {
+		return zap.String(key, string(body)+capture.TruncationMarker())
+	}
+	if strings.Contains(contentType, MIMEApplicationJSON) && json.Valid(body) {
+		buf := new(bytes.Buffer)
+		if err := json.Compact(buf, body); err == nil {
+			return zap.Any(key, json.RawMessage(buf.Bytes()))
+		}
+	}
+	return zap.String(key, string(body))
+}
@@ -0,0 +1,75 @@
+package mid
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLoggerWithConfig_JSON(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	e := echo.New()
+	e.Use(LoggerWithConfig(LoggerConfig{
+		Format:     LogFormatJSON,
+		Logger:     log.NewTaggedZapLogger(zap.New(core), "access"),
+		HideHeader: []string{HeaderAuthorization},
+	}))
+	e.POST("/orders/:id", func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusCreated, map[string]string{"id": ctx.Param("id")})
+	})
+	req := httptest.NewRequest(http.MethodPost, "/orders/1?dry=1", strings.NewReader(`{"sku": "a"}`))
+	req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+	req.Header.Set(HeaderAuthorization, "Bearer 0123456789")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := logs.AllUntimed()
+	assert.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "/orders/:id", fields["route"])
+	assert.Equal(t, "dry=1", fields["query"])
+	assert.Equal(t, int64(http.StatusCreated), fields["status"])
+	assert.Equal(t, int64(12), fields["bytesIn"])
+	assert.True(t, fields["bytesOut"].(int64) > 0)
+	headers := fields["reqHeaders"].(map[string]string)
+	assert.Equal(t, "Bear*********6789", headers[HeaderAuthorization])
+}
+
+func TestLoggerWithConfig_RouteRedact(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	logBody := true
+	e := echo.New()
+	e.Use(LoggerWithConfig(LoggerConfig{
+		Format:           LogFormatJSON,
+		Logger:           log.NewTaggedZapLogger(zap.New(core), "access"),
+		LogReqBody:       &logBody,
+		LogReqBodyOption: LogBodyJson,
+		// keys may come lowercased from the config loader
+		RouteRedact: map[string]RedactConfig{"post /orders/:id": {Keys: []string{"sku"}}},
+	}))
+	// bodies are captured while the handler reads them
+	handler := func(ctx echo.Context) error {
+		_, err := io.ReadAll(ctx.Request().Body)
+		return err
+	}
+	e.POST("/orders/:id", handler)
+	e.POST("/items", handler)
+	reqBody := func(path string) string {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"sku":"abxxcd"}`))
+		req.Header.Set(HeaderContentType, MIMEApplicationJSON)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		entries := logs.TakeAll()
+		assert.Len(t, entries, 1)
+		return fmt.Sprintf("%s", entries[0].ContextMap()["reqBody"])
+	}
+	assert.Equal(t, `{"sku":"a****d"}`, reqBody("/orders/1"))
+	assert.Equal(t, `{"sku":"abxxcd"}`, reqBody("/items"))
+}
@@ -0,0 +1,380 @@
+package mid
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEPrometheusText = "text/plain; version=0.0.4; charset=utf-8"
+
+type (
+	// MetricsConfig defines the config for Metrics middleware
+	MetricsConfig struct {
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		// Path serves the metrics in Prometheus text format, not counted itself
+		Path string `toml:"path" json:"path" mapstructure:"path"`
+		// Namespace optional prefix of metric names, e.g. 'app' gives 'app_http_requests_total'
+		Namespace string `toml:"namespace" json:"namespace" mapstructure:"namespace"`
+		// LatencyBuckets upper bounds in seconds
+		LatencyBuckets []float64 `toml:"latencyBuckets" json:"latencyBuckets" mapstructure:"latencyBuckets"`
+		// SizeBuckets upper bounds in bytes, for request and response sizes
+		SizeBuckets []float64 `toml:"sizeBuckets" json:"sizeBuckets" mapstructure:"sizeBuckets"`
+		// Registry counts auth failures, ACL denials and panics of the requests served, created when nil;
+		// set it to read the counts elsewhere, see web.GetConfig().Metrics.Registry
+		Registry *MetricsRegistry
+		Skipper  Skipper
+	}
+)
+
+var DefaultMetricsConfig = MetricsConfig{
+	Enabled:        false,
+	Path:           "/metrics",
+	LatencyBuckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	SizeBuckets:    []float64{100, 1000, 10000, 100000, 1000000, 10000000},
+}
+
+// routeCounter counts events per 'METHOD route'
+type routeCounter struct {
+	counters sync.Map
+}
+
+func (this *routeCounter) inc(method, route string) {
+	counter, _ := this.counters.LoadOrStore(routeKey(method, route), new(uint64))
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+func (this *routeCounter) counts() map[string]uint64 {
+	out := make(map[string]uint64)
+	this.counters.Range(func(key, value interface{}) bool {
+		out[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return out
+}
+
+// MetricsRegistry counters of the requests served by a mid.Metrics, the other middlewares
+// find it in the request context, so requests not passing through mid.Metrics are not counted
+type MetricsRegistry struct {
+	authFailures routeCounter
+	aclDenials   routeCounter
+	panics       routeCounter
+	mu           sync.Mutex
+	limiters     []*concurrencyLimiter
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+// registerLimiter panics on a duplicate name, the gauges of both would share their labels
+func (this *MetricsRegistry) registerLimiter(limiter *concurrencyLimiter) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, registered := range this.limiters {
+		if registered.config.Name == limiter.config.Name {
+			panic(fmt.Sprintf("concurrency limiter '%s' is already registered, give each mid.Concurrency its own name", limiter.config.Name))
+		}
+	}
+	this.limiters = append(this.limiters, limiter)
+}
+
+// ConcurrencyStats gauges of the mid.Concurrency limiters registered
+func (this *MetricsRegistry) ConcurrencyStats() []ConcurrencyStats {
+	this.mu.Lock()
+	limiters := append([]*concurrencyLimiter{}, this.limiters...)
+	this.mu.Unlock()
+	out := make([]ConcurrencyStats, 0)
+	for _, limiter := range limiters {
+		out = append(out, limiter.stats()...)
+	}
+	return out
+}
+
+// AuthFailureCounts returns the number of rejected unauthenticated requests per 'METHOD route'
+func (this *MetricsRegistry) AuthFailureCounts() map[string]uint64 {
+	return this.authFailures.counts()
+}
+
+// ACLDenialCounts returns the number of ACL denials per 'METHOD route', dry-run denials included
+func (this *MetricsRegistry) ACLDenialCounts() map[string]uint64 {
+	return this.aclDenials.counts()
+}
+
+// PanicCounts returns the number of panics recovered by mid.Recovery and mid.Wrap per 'METHOD route'
+func (this *MetricsRegistry) PanicCounts() map[string]uint64 {
+	return this.panics.counts()
+}
+
+// countRoute increments the counter picked by pick of the registry of the request, if any
+func countRoute(ctx echo.Context, pick func(*MetricsRegistry) *routeCounter) {
+	if registry, ok := ctx.Get(CtxMetricsKey).(*MetricsRegistry); ok && registry != nil {
+		pick(registry).inc(ctx.Request().Method, ctx.Path())
+	}
+}
+
+func countAuthFailure(ctx echo.Context) {
+	countRoute(ctx, func(r *MetricsRegistry) *routeCounter { return &r.authFailures })
+}
+
+func countACLDenial(ctx echo.Context) {
+	countRoute(ctx, func(r *MetricsRegistry) *routeCounter { return &r.aclDenials })
+}
+
+func countPanic(ctx echo.Context) {
+	countRoute(ctx, func(r *MetricsRegistry) *routeCounter { return &r.panics })
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (this *histogram) observe(v float64) {
+	for i, bound := range this.buckets {
+		if v <= bound {
+			this.counts[i]++
+		}
+	}
+	this.sum += v
+	this.count++
+}
+
+type requestLabels struct {
+	method string
+	route  string
+	status int
+	code   int
+}
+
+func (this requestLabels) String() string {
+	return fmt.Sprintf(`method="%s",route="%s",status="%d",code="%d"`,
+		escapeLabel(this.method), escapeLabel(this.route), this.status, this.code)
+}
+
+type requestSeries struct {
+	count   uint64
+	latency *histogram
+	reqSize *histogram
+	rspSize *histogram
+}
+
+type requestMetrics struct {
+	config   MetricsConfig
+	registry *MetricsRegistry
+	inFlight int64
+	mu       sync.Mutex
+	series   map[requestLabels]*requestSeries
+}
+
+func (this *requestMetrics) observe(labels requestLabels, latency time.Duration, reqSize, rspSize int64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	series, ok := this.series[labels]
+	if !ok {
+		series = &requestSeries{
+			latency: newHistogram(this.config.LatencyBuckets),
+			reqSize: newHistogram(this.config.SizeBuckets),
+			rspSize: newHistogram(this.config.SizeBuckets),
+		}
+		this.series[labels] = series
+	}
+	series.count++
+	series.latency.observe(latency.Seconds())
+	series.reqSize.observe(float64(reqSize))
+	series.rspSize.observe(float64(rspSize))
+}
+
+// Metrics counts requests by method, route template, status and kerrors code, and serves
+// them with the auth failure, ACL denial and panic counters on config.Path
+func Metrics(config MetricsConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	if config.Path == "" {
+		config.Path = DefaultMetricsConfig.Path
+	}
+	if len(config.LatencyBuckets) == 0 {
+		config.LatencyBuckets = DefaultMetricsConfig.LatencyBuckets
+	}
+	if len(config.SizeBuckets) == 0 {
+		config.SizeBuckets = DefaultMetricsConfig.SizeBuckets
+	}
+	for _, buckets := range [][]float64{config.LatencyBuckets, config.SizeBuckets} {
+		if !sort.Float64sAreSorted(buckets) {
+			panic("metrics buckets must be sorted in increasing order")
+		}
+	}
+	if config.Registry == nil {
+		config.Registry = NewMetricsRegistry()
+	}
+	metrics := &requestMetrics{config: config, registry: config.Registry, series: make(map[requestLabels]*requestSeries)}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.Enabled {
+				return next(ctx)
+			}
+			ctx.Set(CtxMetricsKey, metrics.registry)
+			req := ctx.Request()
+			if req.URL.Path == config.Path && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+				ctx.Response().Header().Set(echo.HeaderContentType, MIMEPrometheusText)
+				ctx.Response().WriteHeader(http.StatusOK)
+				metrics.write(ctx.Response())
+				return nil
+			}
+			if config.Skipper(ctx) {
+				return next(ctx)
+			}
+			begin := time.Now()
+			atomic.AddInt64(&metrics.inFlight, 1)
+			defer atomic.AddInt64(&metrics.inFlight, -1)
+			err := next(ctx)
+			code, _ := ctx.Get(CtxErrorCodeKey).(int)
+			if err != nil {
+				code = errorCode(err)
+				ctx.Error(err)
+			}
+			reqSize := req.ContentLength
+			if reqSize < 0 {
+				reqSize = 0
+			}
+			metrics.observe(requestLabels{
+				method: req.Method,
+				route:  ctx.Path(),
+				status: ctx.Response().Status,
+				code:   code,
+			}, time.Since(begin), reqSize, ctx.Response().Size)
+			return nil
+		}
+	}
+}
+
+// write renders all metrics in Prometheus text exposition format, series sorted by labels
+func (this *requestMetrics) write(w io.Writer) {
+	prefix := ""
+	if this.config.Namespace != "" {
+		prefix = this.config.Namespace + "_"
+	}
+	this.mu.Lock()
+	labels := make([]requestLabels, 0, len(this.series))
+	for l := range this.series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].String() < labels[j].String()
+	})
+	series := make([]requestSeries, 0, len(labels))
+	for _, l := range labels {
+		s := this.series[l]
+		series = append(series, requestSeries{
+			count:   s.count,
+			latency: s.latency.snapshot(),
+			reqSize: s.reqSize.snapshot(),
+			rspSize: s.rspSize.snapshot(),
+		})
+	}
+	this.mu.Unlock()
+
+	name := prefix + "http_requests_total"
+	writeMetricHeader(w, name, "counter", "Number of HTTP requests.")
+	for i, l := range labels {
+		_, _ = fmt.Fprintf(w, "%s{%s} %d\n", name, l, series[i].count)
+	}
+	for _, h := range []struct {
+		name, help string
+		get        func(requestSeries) *histogram
+	}{
+		{"http_request_duration_seconds", "HTTP request latency in seconds.", func(s requestSeries) *histogram { return s.latency }},
+		{"http_request_size_bytes", "HTTP request body size in bytes.", func(s requestSeries) *histogram { return s.reqSize }},
+		{"http_response_size_bytes", "HTTP response body size in bytes.", func(s requestSeries) *histogram { return s.rspSize }},
+	} {
+		name = prefix + h.name
+		writeMetricHeader(w, name, "histogram", h.help)
+		for i, l := range labels {
+			h.get(series[i]).write(w, name, l.String())
+		}
+	}
+	name = prefix + "http_requests_in_flight"
+	writeMetricHeader(w, name, "gauge", "Number of HTTP requests being served.")
+	_, _ = fmt.Fprintf(w, "%s %d\n", name, atomic.LoadInt64(&this.inFlight))
+
+	writeRouteCounter(w, prefix+"http_auth_failures_total", "Number of requests rejected as unauthenticated.", this.registry.AuthFailureCounts())
+	writeRouteCounter(w, prefix+"http_acl_denials_total", "Number of ACL denials, dry-run denials included.", this.registry.ACLDenialCounts())
+	writeRouteCounter(w, prefix+"http_panics_total", "Number of panics recovered.", this.registry.PanicCounts())
+
+	stats := this.registry.ConcurrencyStats()
+	for _, g := range []struct {
+		name, kind, help string
+		value            func(ConcurrencyStats) string
+	}{
+		{"http_concurrency_in_flight", "gauge", "Number of requests in flight per concurrency group.",
+			func(s ConcurrencyStats) string { return strconv.Itoa(s.InFlight) }},
+		{"http_concurrency_limit", "gauge", "Current in-flight limit per concurrency group, 0 means unlimited.",
+			func(s ConcurrencyStats) string { return strconv.Itoa(s.Limit) }},
+		{"http_shed_total", "counter", "Number of requests shed per concurrency group.",
+			func(s ConcurrencyStats) string { return strconv.FormatUint(s.Shed, 10) }},
+	} {
+		name = prefix + g.name
+		writeMetricHeader(w, name, g.kind, g.help)
+		for _, s := range stats {
+			_, _ = fmt.Fprintf(w, "%s{limiter=\"%s\",group=\"%s\"} %s\n", name, escapeLabel(s.Limiter), escapeLabel(s.Group), g.value(s))
+		}
+	}
+}
+
+func (this *histogram) snapshot() *histogram {
+	return &histogram{
+		buckets: this.buckets,
+		counts:  append([]uint64{}, this.counts...),
+		sum:     this.sum,
+		count:   this.count,
+	}
+}
+
+func (this *histogram) write(w io.Writer, name string, labels string) {
+	for i, bound := range this.buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), this.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, this.count)
+	_, _ = fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(this.sum))
+	_, _ = fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, this.count)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeRouteCounter(w io.Writer, name, help string, counts map[string]uint64) {
+	writeMetricHeader(w, name, "counter", help)
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		method, route, _ := strings.Cut(k, " ")
+		_, _ = fmt.Fprintf(w, "%s{method=\"%s\",route=\"%s\"} %d\n", name, escapeLabel(method), escapeLabel(route), counts[k])
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
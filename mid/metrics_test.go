@@ -0,0 +1,62 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	e := echo.New()
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	registry := NewMetricsRegistry()
+	e.Use(Metrics(MetricsConfig{Enabled: true, Namespace: "test", LatencyBuckets: []float64{0.1, 1}, Registry: registry}))
+	e.Use(AuthWithConfig(AuthConfig{Enabled: true, WhitelistRules: []WhitelistRule{{Path: "/users/*"}, {Path: "/missing"}, {Path: "/panic"}}},
+		testAPIKeyProvider{}))
+	e.GET("/users/:id", Wrap(func(ctx echo.Context) (string, error) {
+		return ctx.Param("id"), nil
+	}))
+	e.GET("/missing", Wrap(func() error {
+		return kerrors.ErrNotExist()
+	}))
+	e.GET("/panic", Wrap(func() error {
+		panic("boom")
+	}))
+	e.GET("/private", Wrap(func() error { return nil }))
+	for _, path := range []string{"/users/1", "/users/2", "/missing", "/panic", "/private"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, MIMEPrometheusText, rec.Header().Get(echo.HeaderContentType))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE test_http_requests_total counter",
+		`test_http_requests_total{method="GET",route="/users/:id",status="200",code="0"} 2`,
+		`test_http_requests_total{method="GET",route="/missing",status="200",code="4404"} 1`,
+		`test_http_request_duration_seconds_bucket{method="GET",route="/users/:id",status="200",code="0",le="+Inf"} 2`,
+		`test_http_request_duration_seconds_count{method="GET",route="/users/:id",status="200",code="0"} 2`,
+		"# TYPE test_http_response_size_bytes histogram",
+		"test_http_requests_in_flight 0",
+		`test_http_panics_total{method="GET",route="/panic"} 1`,
+		`test_http_auth_failures_total{method="GET",route="/private"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.Equal(t, map[string]uint64{"GET /panic": 1}, registry.PanicCounts())
+
+	// counters belong to the registry, other servers start from zero
+	other := echo.New()
+	other.Use(Metrics(MetricsConfig{Enabled: true}))
+	rec = httptest.NewRecorder()
+	other.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.False(t, strings.Contains(rec.Body.String(), "http_panics_total{"))
+	// the metrics endpoint does not count itself
+	assert.False(t, strings.Contains(body, `route="/metrics"`))
+}
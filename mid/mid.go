@@ -1,6 +1,12 @@
 package mid
 
-import "github.com/labstack/echo/v4"
+import (
+	"net"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
 
 type (
 	// Skipper defines a function to skip middleware.
@@ -16,3 +22,19 @@ type BeforeFunc func(c echo.Context) error
 func DefaultSkipper(echo.Context) bool {
 	return false
 }
+
+// clientIp the caller address used to key limits and scopes. Without an echo.IPExtractor, RealIP trusts
+// the client supplied X-Forwarded-For / X-Real-IP headers, so the connection address is used instead
+func clientIp(ctx echo.Context) string {
+	if ctx.Echo() != nil && ctx.Echo().IPExtractor != nil {
+		return ctx.RealIP()
+	}
+	host, _, err := net.SplitHostPort(ctx.Request().RemoteAddr)
+	if err != nil {
+		return ctx.Request().RemoteAddr
+	}
+	return host
+}
+
+// nopLogger used when neither a configured nor a trace logger is available
+var nopLogger = log.NewTaggedZapLogger(zap.NewNop(), "nop")
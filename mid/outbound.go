@@ -0,0 +1,139 @@
+package mid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type (
+	// OutboundConfig defines the config of OutboundClient
+	OutboundConfig struct {
+		// Timeout of every outbound request, shortened to the deadline of the inbound request if any.
+		// <= 0 means only the inbound deadline applies
+		Timeout time.Duration `toml:"timeout" json:"timeout" mapstructure:"timeout"`
+		// ForwardHeaders inbound request headers copied to outbound requests, unless already set
+		ForwardHeaders []string `toml:"forwardHeaders" json:"forwardHeaders" mapstructure:"forwardHeaders"`
+		// Inject trace formats written to outbound requests, defaults to TraceConfig.Inject
+		Inject []TraceFormat `toml:"inject" json:"inject" mapstructure:"inject"`
+		// Transport defaults to http.DefaultTransport
+		Transport http.RoundTripper
+	}
+)
+
+var DefaultOutboundConfig = OutboundConfig{
+	Timeout:        time.Second * 30,
+	ForwardHeaders: []string{"Accept-Language"},
+}
+
+// OutboundClient returns a client for calling other services on behalf of the current request:
+// trace headers are injected, ForwardHeaders copied, calls logged by the trace logger and recorded as
+// client spans. The client is bound to ctx, do not keep it beyond the request
+func OutboundClient(ctx echo.Context, config OutboundConfig) *http.Client {
+	if config.Transport == nil {
+		config.Transport = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport: &outboundTransport{config: config, ctx: ctx},
+	}
+}
+
+type outboundTransport struct {
+	config OutboundConfig
+	ctx    echo.Context
+}
+
+func (this *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	inbound := this.ctx.Request()
+	reqCtx := req.Context()
+	// requests built without a context follow the inbound request cancellation
+	if reqCtx == context.Background() {
+		reqCtx = inbound.Context()
+	}
+	deadline, hasDeadline := inbound.Context().Deadline()
+	if this.config.Timeout > 0 {
+		if timeoutAt := time.Now().Add(this.config.Timeout); !hasDeadline || timeoutAt.Before(deadline) {
+			deadline, hasDeadline = timeoutAt, true
+		}
+	}
+	cancel := context.CancelFunc(func() {})
+	if hasDeadline {
+		reqCtx, cancel = context.WithDeadline(reqCtx, deadline)
+	}
+	// RoundTrip must not modify the caller's request
+	out := req.Clone(reqCtx)
+	for _, name := range this.config.ForwardHeaders {
+		if out.Header.Get(name) == "" {
+			if value := inbound.Header.Get(name); value != "" {
+				out.Header.Set(name, value)
+			}
+		}
+	}
+	parent := SpanFromContext(req.Context())
+	if parent == nil {
+		parent = CurrentSpan(this.ctx)
+	}
+	var span *Span
+	if parent != nil {
+		span = parent.child(fmt.Sprintf("HTTP %s", out.Method), SpanKindClient)
+		span.SetAttribute("http.request.method", out.Method)
+		span.SetAttribute("server.address", out.URL.Host)
+		span.SetAttribute("url.full", fmt.Sprintf("%s://%s%s", out.URL.Scheme, out.URL.Host, out.URL.Path))
+	}
+	if tc := CurrentTraceContext(this.ctx); tc != nil {
+		outTc := *tc
+		// the callee is a child of the client span, or of the request span
+		if span != nil {
+			outTc.SpanId = span.SpanId()
+		}
+		outTc.Inject(out.Header, this.config.Inject...)
+	}
+	begin := time.Now()
+	rsp, err := this.config.Transport.RoundTrip(out)
+	latency := time.Since(begin)
+	fields := []zap.Field{
+		zap.String("method", out.Method),
+		zap.String("url", fmt.Sprintf("%s://%s%s", out.URL.Scheme, out.URL.Host, out.URL.Path)),
+		zap.Duration("latency", latency),
+	}
+	if err != nil {
+		cancel()
+		span.RecordError(err)
+		span.End()
+		outboundLogger(this.ctx).Warn("outbound request failed", append(fields, zap.Error(err))...)
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", rsp.StatusCode)
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(SpanStatusError, http.StatusText(rsp.StatusCode))
+	}
+	span.End()
+	outboundLogger(this.ctx).Info("outbound request", append(fields, zap.Int("status", rsp.StatusCode))...)
+	// the deadline covers reading the body, released once the body is closed
+	rsp.Body = &cancelOnClose{ReadCloser: rsp.Body, cancel: cancel}
+	return rsp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this *cancelOnClose) Close() error {
+	err := this.ReadCloser.Close()
+	this.cancel()
+	return err
+}
+
+func outboundLogger(ctx echo.Context) log.ZapLog {
+	if logger, ok := ctx.Get(CtxZapLoggerKey).(log.ZapLog); ok {
+		return logger
+	}
+	return nopLogger
+}
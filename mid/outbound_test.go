@@ -0,0 +1,56 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundClient(t *testing.T) {
+	var got http.Header
+	var hasDeadline bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+	e := echo.New()
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.GET("/", func(ctx echo.Context) error {
+		client := OutboundClient(ctx, OutboundConfig{
+			Timeout:        time.Second,
+			ForwardHeaders: []string{"Accept-Language"},
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				_, hasDeadline = req.Context().Deadline()
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		})
+		rsp, err := client.Get(upstream.URL)
+		if err != nil {
+			return err
+		}
+		_ = rsp.Body.Close()
+		return ctx.NoContent(rsp.StatusCode)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Accept-Language", "zh-CN")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.True(t, hasDeadline)
+	assert.Equal(t, "zh-CN", got.Get("Accept-Language"))
+	// the callee joins the trace as a child of the inbound request span
+	assert.Equal(t, rec.Header().Get(HeaderTraceParent), got.Get(HeaderTraceParent))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", got.Get("Kboot-Trace-Id"))
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,297 @@
+package mid
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type (
+	PolicyEffect string
+	// PolicyAttributes flat attribute map, referenced in conditions with a namespace prefix:
+	//	subject.userId subject.tenantId subject.anonymous subject.ip subject.ua subject.<custom>
+	//	action.method action.route action.name
+	//	resource.<custom>
+	PolicyAttributes map[string]interface{}
+	// PolicyAttributeResolver supplies extra subject or resource attributes of current request
+	PolicyAttributeResolver func(ctx echo.Context) (PolicyAttributes, error)
+
+	// PolicyCondition compares Attr with a literal Value, or with another attribute when Ref is set.
+	// Op: eq, ne, in, nin, contains, exists, prefix.
+	// A missing Attr or Ref leaves the condition unknown, except for exists: deny rules take it as holding,
+	// so they fail closed, allow rules as failing
+	PolicyCondition struct {
+		Attr  string      `toml:"attr" json:"attr" mapstructure:"attr"`
+		Op    string      `toml:"op" json:"op" mapstructure:"op"`
+		Value interface{} `toml:"value" json:"value" mapstructure:"value"`
+		Ref   string      `toml:"ref" json:"ref" mapstructure:"ref"`
+	}
+	// PolicyRule applies to the request when one of Actions matches and
+	// all conditions of All and at least one of Any (if present) hold.
+	// An applied allow rule grants the request on its own, the actions declared by mid.Require
+	// are not checked against the permissions then, so scope allow rules with Actions
+	PolicyRule struct {
+		Name    string            `toml:"name" json:"name" mapstructure:"name"`
+		Effect  PolicyEffect      `toml:"effect" json:"effect" mapstructure:"effect"`
+		Actions []string          `toml:"actions" json:"actions" mapstructure:"actions"`
+		All     []PolicyCondition `toml:"all" json:"all" mapstructure:"all"`
+		Any     []PolicyCondition `toml:"any" json:"any" mapstructure:"any"`
+	}
+	PolicyConfig struct {
+		Rules            []PolicyRule `toml:"rules" json:"rules" mapstructure:"rules"`
+		SubjectResolver  PolicyAttributeResolver
+		ResourceResolver PolicyAttributeResolver
+		// Logger optional, decision explanations are written at debug level, to the request trace logger if unset
+		Logger log.ZapLog
+	}
+	// PolicyDecision result of policy evaluation, Effect is empty when no rule applied
+	PolicyDecision struct {
+		Effect PolicyEffect
+		Rule   string
+		Reason string
+	}
+)
+
+const (
+	PolicyAllow PolicyEffect = "allow"
+	PolicyDeny  PolicyEffect = "deny"
+)
+
+var DefaultPolicyConfig = PolicyConfig{}
+
+// policyResult of a condition, policyUnknown when an attribute it compares is missing
+type policyResult int
+
+const (
+	policyFails policyResult = iota
+	policyHolds
+	policyUnknown
+)
+
+const (
+	policyOpEq       = "eq"
+	policyOpNe       = "ne"
+	policyOpIn       = "in"
+	policyOpNin      = "nin"
+	policyOpContains = "contains"
+	policyOpExists   = "exists"
+	policyOpPrefix   = "prefix"
+)
+
+// PolicyEngine evaluates attribute based rules, deny takes precedence over allow
+type PolicyEngine struct {
+	config PolicyConfig
+}
+
+func NewPolicyEngine(config PolicyConfig) *PolicyEngine {
+	// the defaults below must not leak into the caller's rules
+	config.Rules = append([]PolicyRule{}, config.Rules...)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule#%d", i)
+		}
+		rule.Effect = PolicyEffect(strings.ToLower(string(rule.Effect)))
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			panic(fmt.Sprintf("policy rule '%s' effect must be allow or deny", rule.Name))
+		}
+		for _, cond := range append(append([]PolicyCondition{}, rule.All...), rule.Any...) {
+			switch cond.Op {
+			case policyOpEq, policyOpNe, policyOpIn, policyOpNin, policyOpContains, policyOpExists, policyOpPrefix:
+			default:
+				panic(fmt.Sprintf("policy rule '%s' condition on '%s' has unknown op '%s'", rule.Name, cond.Attr, cond.Op))
+			}
+		}
+	}
+	return &PolicyEngine{config: config}
+}
+
+// Attributes collects subject, action and resource attributes of the request
+func (this *PolicyEngine) Attributes(ctx echo.Context, actions []string) (PolicyAttributes, error) {
+	authCtx := callerAuthContext(ctx)
+	attrs := PolicyAttributes{
+		"subject.userId":    authCtx.GetUserId(),
+		"subject.tenantId":  currentTenantId(ctx),
+		"subject.anonymous": authCtx.IsAnonymous(),
+		"subject.ip":        authCtx.ClientIp(),
+		"subject.ua":        authCtx.ClientUA(),
+		"action.method":     ctx.Request().Method,
+		"action.route":      ctx.Path(),
+		"action.name":       actions,
+	}
+	merge := func(prefix string, resolver PolicyAttributeResolver) error {
+		if resolver == nil {
+			return nil
+		}
+		extra, err := resolver(ctx)
+		if err != nil {
+			return err
+		}
+		for k, v := range extra {
+			attrs[prefix+k] = v
+		}
+		return nil
+	}
+	if err := merge("subject.", this.config.SubjectResolver); err != nil {
+		return nil, err
+	}
+	if err := merge("resource.", this.config.ResourceResolver); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// Evaluate decides the request, actions are the route declared actions, if any
+func (this *PolicyEngine) Evaluate(ctx echo.Context, actions []string) (PolicyDecision, error) {
+	attrs, err := this.Attributes(ctx, actions)
+	if err != nil {
+		return PolicyDecision{}, err
+	}
+	requestActions := append([]string{ctx.Request().Method + " " + ctx.Path()}, actions...)
+	decision := PolicyDecision{Reason: "no rule applied"}
+	explains := make([]string, 0, len(this.config.Rules))
+	for i := range this.config.Rules {
+		rule := &this.config.Rules[i]
+		applied, reason := rule.evaluate(requestActions, attrs)
+		explains = append(explains, fmt.Sprintf("%s(%s): %s", rule.Name, rule.Effect, reason))
+		if !applied {
+			continue
+		}
+		if rule.Effect == PolicyDeny {
+			decision = PolicyDecision{Effect: PolicyDeny, Rule: rule.Name, Reason: reason}
+			break
+		}
+		if decision.Effect == "" {
+			decision = PolicyDecision{Effect: PolicyAllow, Rule: rule.Name, Reason: reason}
+		}
+	}
+	logger := this.config.Logger
+	if logger == nil {
+		logger, _ = ctx.Get(CtxZapLoggerKey).(log.ZapLog)
+	}
+	if logger != nil {
+		logger.Debug("policy decision",
+			zap.String("effect", string(decision.Effect)),
+			zap.String("rule", decision.Rule),
+			zap.String("reason", decision.Reason),
+			zap.Strings("actions", requestActions),
+			zap.Strings("explain", explains))
+	}
+	return decision, nil
+}
+
+func (this *PolicyRule) evaluate(actions []string, attrs PolicyAttributes) (bool, string) {
+	actionMatched := len(this.Actions) == 0
+	for _, pattern := range this.Actions {
+		for _, action := range actions {
+			if MatchAction(pattern, action) {
+				actionMatched = true
+			}
+		}
+	}
+	if !actionMatched {
+		return false, "action not matched"
+	}
+	unknown := make([]string, 0)
+	for _, cond := range this.All {
+		if !this.holds(cond, attrs, &unknown) {
+			return false, fmt.Sprintf("condition failed: %s", cond)
+		}
+	}
+	if len(this.Any) == 0 {
+		return true, withUnknown("all conditions hold", unknown)
+	}
+	for _, cond := range this.Any {
+		if this.holds(cond, attrs, &unknown) {
+			return true, withUnknown(fmt.Sprintf("condition hold: %s", cond), unknown)
+		}
+	}
+	return false, withUnknown("none of any conditions hold", unknown)
+}
+
+// holds unknown conditions hold for deny rules only, they are collected for the explanation
+func (this *PolicyRule) holds(cond PolicyCondition, attrs PolicyAttributes, unknown *[]string) bool {
+	switch cond.eval(attrs) {
+	case policyHolds:
+		return true
+	case policyUnknown:
+		*unknown = append(*unknown, cond.String())
+		return this.Effect == PolicyDeny
+	}
+	return false
+}
+
+func withUnknown(reason string, unknown []string) string {
+	if len(unknown) == 0 {
+		return reason
+	}
+	return fmt.Sprintf("%s, attribute missing: %s", reason, strings.Join(unknown, "; "))
+}
+
+func (this PolicyCondition) String() string {
+	if this.Ref != "" {
+		return fmt.Sprintf("%s %s %s", this.Attr, this.Op, this.Ref)
+	}
+	return fmt.Sprintf("%s %s %v", this.Attr, this.Op, this.Value)
+}
+
+func (this PolicyCondition) eval(attrs PolicyAttributes) policyResult {
+	left, exists := attrs[this.Attr]
+	if this.Op == policyOpExists {
+		return policyResultOf(exists && left != nil && left != "")
+	}
+	if !exists {
+		return policyUnknown
+	}
+	right := this.Value
+	if this.Ref != "" {
+		var ok bool
+		if right, ok = attrs[this.Ref]; !ok {
+			return policyUnknown
+		}
+	}
+	switch this.Op {
+	case policyOpEq:
+		return policyResultOf(policyEqual(left, right))
+	case policyOpNe:
+		return policyResultOf(!policyEqual(left, right))
+	case policyOpIn:
+		return policyResultOf(policyContains(right, left))
+	case policyOpNin:
+		return policyResultOf(!policyContains(right, left))
+	case policyOpContains:
+		return policyResultOf(policyContains(left, right))
+	case policyOpPrefix:
+		return policyResultOf(strings.HasPrefix(fmt.Sprint(left), fmt.Sprint(right)))
+	}
+	return policyFails
+}
+
+func policyResultOf(holds bool) policyResult {
+	if holds {
+		return policyHolds
+	}
+	return policyFails
+}
+
+// policyEqual compares scalars by their text form, so 1 (int64 from toml) equals "1" from a resolver
+func policyEqual(a, b interface{}) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func policyContains(list interface{}, v interface{}) bool {
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if policyEqual(rv.Index(i).Interface(), v) {
+			return true
+		}
+	}
+	return false
+}
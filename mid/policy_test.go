@@ -0,0 +1,144 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPolicyConditionEval(t *testing.T) {
+	attrs := PolicyAttributes{
+		"subject.userId": "u1",
+		"subject.roles":  []string{"admin", "editor"},
+		"resource.owner": "u1",
+		"resource.size":  int64(3),
+		"resource.empty": "",
+	}
+	cases := []struct {
+		name string
+		cond PolicyCondition
+		want policyResult
+	}{
+		{"eq", PolicyCondition{Attr: "subject.userId", Op: "eq", Value: "u1"}, policyHolds},
+		{"eq across types", PolicyCondition{Attr: "resource.size", Op: "eq", Value: "3"}, policyHolds},
+		{"eq ref", PolicyCondition{Attr: "resource.owner", Op: "eq", Ref: "subject.userId"}, policyHolds},
+		{"eq fails", PolicyCondition{Attr: "subject.userId", Op: "eq", Value: "u2"}, policyFails},
+		{"ne", PolicyCondition{Attr: "subject.userId", Op: "ne", Value: "u2"}, policyHolds},
+		{"ne fails", PolicyCondition{Attr: "resource.owner", Op: "ne", Ref: "subject.userId"}, policyFails},
+		{"in", PolicyCondition{Attr: "subject.userId", Op: "in", Value: []interface{}{"u0", "u1"}}, policyHolds},
+		{"in fails", PolicyCondition{Attr: "subject.userId", Op: "in", Value: []interface{}{"u0"}}, policyFails},
+		{"nin", PolicyCondition{Attr: "subject.userId", Op: "nin", Value: []interface{}{"u0"}}, policyHolds},
+		{"nin fails", PolicyCondition{Attr: "subject.userId", Op: "nin", Value: []interface{}{"u1"}}, policyFails},
+		{"contains", PolicyCondition{Attr: "subject.roles", Op: "contains", Value: "admin"}, policyHolds},
+		{"contains fails", PolicyCondition{Attr: "subject.roles", Op: "contains", Value: "root"}, policyFails},
+		{"prefix", PolicyCondition{Attr: "subject.userId", Op: "prefix", Value: "u"}, policyHolds},
+		{"prefix fails", PolicyCondition{Attr: "subject.userId", Op: "prefix", Value: "x"}, policyFails},
+		{"exists", PolicyCondition{Attr: "resource.owner", Op: "exists"}, policyHolds},
+		{"exists empty", PolicyCondition{Attr: "resource.empty", Op: "exists"}, policyFails},
+		{"exists missing", PolicyCondition{Attr: "resource.missing", Op: "exists"}, policyFails},
+		{"eq missing", PolicyCondition{Attr: "resource.missing", Op: "eq", Value: "u1"}, policyUnknown},
+		{"ne missing", PolicyCondition{Attr: "resource.missing", Op: "ne", Value: "u1"}, policyUnknown},
+		{"nin missing", PolicyCondition{Attr: "resource.missing", Op: "nin", Value: []interface{}{"u1"}}, policyUnknown},
+		{"missing ref", PolicyCondition{Attr: "subject.userId", Op: "ne", Ref: "resource.missing"}, policyUnknown},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, c.cond.eval(attrs), c.name)
+	}
+}
+
+func TestPolicyRuleMissingAttribute(t *testing.T) {
+	attrs := PolicyAttributes{"subject.userId": "u1"}
+	ownerOnly := []PolicyCondition{{Attr: "resource.ownerId", Op: "ne", Ref: "subject.userId"}}
+
+	deny := PolicyRule{Effect: PolicyDeny, All: ownerOnly}
+	applied, reason := deny.evaluate(nil, attrs)
+	assert.True(t, applied)
+	assert.Contains(t, reason, "attribute missing")
+
+	allow := PolicyRule{Effect: PolicyAllow, All: ownerOnly}
+	applied, _ = allow.evaluate(nil, attrs)
+	assert.False(t, applied)
+	allow = PolicyRule{Effect: PolicyAllow, Any: ownerOnly}
+	applied, _ = allow.evaluate(nil, attrs)
+	assert.False(t, applied)
+}
+
+func TestPolicyEngineEvaluate(t *testing.T) {
+	engine := NewPolicyEngine(PolicyConfig{
+		Rules: []PolicyRule{
+			{Name: "owner", Effect: "allow", Actions: []string{"order:write"},
+				All: []PolicyCondition{{Attr: "resource.ownerId", Op: "eq", Ref: "subject.userId"}}},
+			{Name: "locked", Effect: "deny", Actions: []string{"order:*"},
+				All: []PolicyCondition{{Attr: "resource.locked", Op: "eq", Value: true}}},
+			{Name: "reader", Effect: "allow", Actions: []string{"GET /orders/:id"}},
+		},
+		ResourceResolver: func(ctx echo.Context) (PolicyAttributes, error) {
+			attrs := PolicyAttributes{"ownerId": "app-a"}
+			if locked := ctx.QueryParam("locked"); locked != "" {
+				attrs["locked"] = locked
+			}
+			return attrs, nil
+		},
+	})
+	e := echo.New()
+	e.Use(AuthWithConfig(DefaultAuthConfig, testAPIKeyProvider{}))
+	var decision PolicyDecision
+	handler := func(ctx echo.Context) error {
+		var err error
+		decision, err = engine.Evaluate(ctx, []string{"order:write"})
+		return err
+	}
+	e.PUT("/orders/:id", handler)
+	e.GET("/orders/:id", handler)
+	evaluate := func(method, target, apiKey string) PolicyDecision {
+		decision = PolicyDecision{}
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		return decision
+	}
+
+	// the missing lock attribute makes the deny rule apply, it takes precedence over allow
+	d := evaluate(http.MethodPut, "/orders/1", "a")
+	assert.Equal(t, PolicyDeny, d.Effect)
+	assert.Equal(t, "locked", d.Rule)
+
+	d = evaluate(http.MethodPut, "/orders/1?locked=false", "a")
+	assert.Equal(t, PolicyAllow, d.Effect)
+	assert.Equal(t, "owner", d.Rule)
+
+	d = evaluate(http.MethodPut, "/orders/1?locked=true", "a")
+	assert.Equal(t, PolicyDeny, d.Effect)
+
+	// not the owner, no rule applied
+	d = evaluate(http.MethodPut, "/orders/1?locked=false", "b")
+	assert.Equal(t, PolicyEffect(""), d.Effect)
+
+	d = evaluate(http.MethodGet, "/orders/1?locked=false", "b")
+	assert.Equal(t, PolicyAllow, d.Effect)
+	assert.Equal(t, "reader", d.Rule)
+}
+
+func TestPolicyEngine_TraceLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	// built from config, no logger of its own
+	engine := NewPolicyEngine(PolicyConfig{
+		Rules: []PolicyRule{{Name: "reader", Effect: "allow", Actions: []string{"order:read"}}},
+	})
+	e := echo.New()
+	e.Use(TraceWithConfig(TraceConfig{Logger: log.NewTaggedZapLogger(zap.New(core), "trace")}))
+	e.GET("/orders/:id", func(ctx echo.Context) error {
+		_, err := engine.Evaluate(ctx, []string{"order:read"})
+		return err
+	})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+	entries := logs.FilterMessageSnippet("policy decision").All()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "reader", entries[0].ContextMap()["rule"])
+}
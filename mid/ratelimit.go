@@ -0,0 +1,326 @@
+package mid
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+type RateLimitAlgorithm string
+
+const (
+	// RateLimitTokenBucket refills Limit tokens per Window, up to Burst
+	RateLimitTokenBucket RateLimitAlgorithm = "tokenBucket"
+	// RateLimitSlidingWindow allows Limit requests in any Window, weighting the previous window
+	RateLimitSlidingWindow RateLimitAlgorithm = "slidingWindow"
+)
+
+// RateLimitKeyBy what requests are counted together. Callers without the key fall back to their IP:
+// anonymous callers for RateLimitKeyUser, callers not authenticated by an API key for RateLimitKeyAPIKey
+type RateLimitKeyBy string
+
+const (
+	RateLimitKeyIP     RateLimitKeyBy = "ip"
+	RateLimitKeyUser   RateLimitKeyBy = "user"
+	RateLimitKeyAPIKey RateLimitKeyBy = "apiKey"
+	RateLimitKeyTenant RateLimitKeyBy = "tenant"
+)
+
+type (
+	RateLimitPolicy struct {
+		Algorithm RateLimitAlgorithm `toml:"algorithm" json:"algorithm" mapstructure:"algorithm"`
+		// Limit requests allowed per Window, <= 0 disables the policy
+		Limit  int           `toml:"limit" json:"limit" mapstructure:"limit"`
+		Window time.Duration `toml:"window" json:"window" mapstructure:"window"`
+		// Burst bucket capacity of RateLimitTokenBucket, defaults to Limit
+		Burst int            `toml:"burst" json:"burst" mapstructure:"burst"`
+		KeyBy RateLimitKeyBy `toml:"keyBy" json:"keyBy" mapstructure:"keyBy"`
+	}
+	// RateLimitConfig defines the config for RateLimit middleware
+	RateLimitConfig struct {
+		Enabled bool            `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		Policy  RateLimitPolicy `toml:"policy" json:"policy" mapstructure:"policy"`
+		// Routes overrides Policy per 'METHOD /route/template', counted apart from other routes, keys are case insensitive
+		Routes map[string]RateLimitPolicy `toml:"routes" json:"routes" mapstructure:"routes"`
+		// Store defaults to an in-memory store, set a shared one when running several instances
+		Store   RateLimitStore
+		Skipper Skipper
+		// Logger optional, defaults to the trace logger of request
+		Logger log.ZapLog
+	}
+	RateLimitResult struct {
+		Allowed   bool
+		Limit     int
+		Remaining int
+		// Reset until the quota is fully restored
+		Reset time.Duration
+		// RetryAfter until the next request may be allowed, set when not allowed
+		RetryAfter time.Duration
+	}
+	// APIKeySession implemented by the AuthSessionInfo of providers authenticating API keys,
+	// RateLimitKeyAPIKey counts the requests of a key by its id
+	APIKeySession interface {
+		APIKeyId() string
+	}
+	// RateLimitStore keeps the counters, implementations must be safe for concurrent use
+	RateLimitStore interface {
+		// Take counts one request of key under policy
+		Take(ctx context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+	}
+)
+
+var DefaultRateLimitConfig = RateLimitConfig{
+	Enabled: false,
+	Policy: RateLimitPolicy{
+		Algorithm: RateLimitTokenBucket,
+		Limit:     100,
+		Window:    time.Minute,
+		KeyBy:     RateLimitKeyIP,
+	},
+}
+
+// RateLimit rejects requests over their policy with http.StatusTooManyRequests, i.e. kerrors.CodeTooManyRequests.
+// Install after mid.Auth / mid.Tenant to key by user or tenant. Store failures let requests through
+func RateLimit(config RateLimitConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryRateLimitStore()
+	}
+	checkRateLimitPolicy("default", config.Policy)
+	for route, policy := range config.Routes {
+		checkRateLimitPolicy(route, policy)
+	}
+	routes := routeOverrides("rate limit", config.Routes)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.Enabled || config.Skipper(ctx) {
+				return next(ctx)
+			}
+			route := routeKey(ctx.Request().Method, ctx.Path())
+			scope := "*"
+			policy := config.Policy
+			if routePolicy, ok := lookupRouteOverride(routes, ctx.Request().Method, ctx.Path()); ok {
+				scope, policy = route, routePolicy
+			}
+			if policy.Limit <= 0 {
+				return next(ctx)
+			}
+			key := scope + "|" + rateLimitKey(ctx, policy.KeyBy)
+			result, err := config.Store.Take(ctx.Request().Context(), key, policy, time.Now())
+			if err != nil {
+				rateLimitLogger(ctx, config).Warn("rate limit store failed, request let through",
+					zap.String("route", route), zap.Error(err))
+				return next(ctx)
+			}
+			header := ctx.Response().Header()
+			header.Set(HeaderRateLimitLimit, strconv.Itoa(result.Limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+			header.Set(HeaderRateLimitReset, strconv.FormatInt(ceilSeconds(result.Reset), 10))
+			header.Set(HeaderRateLimitPolicy, fmt.Sprintf("%d;w=%d", policy.Limit, ceilSeconds(policy.Window)))
+			if !result.Allowed {
+				header.Set(HeaderRetryAfter, strconv.FormatInt(ceilSeconds(result.RetryAfter), 10))
+				// answered with the status, the error handlers map it to kerrors.CodeTooManyRequests
+				return echo.NewHTTPError(http.StatusTooManyRequests, kerrors.CodeText(kerrors.CodeTooManyRequests))
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func checkRateLimitPolicy(name string, policy RateLimitPolicy) {
+	if policy.Limit <= 0 {
+		return
+	}
+	if policy.Window <= 0 {
+		panic(fmt.Sprintf("rate limit policy '%s': window must be positive", name))
+	}
+	switch policy.Algorithm {
+	case RateLimitTokenBucket, RateLimitSlidingWindow:
+	default:
+		panic(fmt.Sprintf("rate limit policy '%s': unknown algorithm '%s'", name, policy.Algorithm))
+	}
+	switch policy.KeyBy {
+	case RateLimitKeyIP, RateLimitKeyUser, RateLimitKeyAPIKey, RateLimitKeyTenant:
+	default:
+		panic(fmt.Sprintf("rate limit policy '%s': unknown keyBy '%s'", name, policy.KeyBy))
+	}
+}
+
+// rateLimitKey only keys chosen by the server are used, values a client can vary on each request,
+// e.g. anonymous ids or unauthenticated api keys, would give it a fresh quota each time
+func rateLimitKey(ctx echo.Context, keyBy RateLimitKeyBy) string {
+	authCtx, _ := ctx.Get(CtxCallerInfoKey).(AuthContext)
+	authenticated := authCtx != nil && !authCtx.IsAnonymous()
+	switch keyBy {
+	case RateLimitKeyUser:
+		if authenticated && authCtx.GetUserId() != "" {
+			return "user:" + authCtx.GetUserId()
+		}
+	case RateLimitKeyAPIKey:
+		if authenticated {
+			if session, ok := authCtx.SessionInfo().(APIKeySession); ok && session.APIKeyId() != "" {
+				return "apiKey:" + session.APIKeyId()
+			}
+		}
+	case RateLimitKeyTenant:
+		if tenantId := currentTenantId(ctx); tenantId != "" {
+			return "tenant:" + tenantId
+		}
+	}
+	return "ip:" + clientIp(ctx)
+}
+
+func rateLimitLogger(ctx echo.Context, config RateLimitConfig) log.ZapLog {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	if logger, ok := ctx.Get(CtxZapLoggerKey).(log.ZapLog); ok {
+		return logger
+	}
+	return nopLogger
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
+
+type rateLimitEntry struct {
+	// tokenBucket
+	tokens float64
+	last   time.Time
+	// slidingWindow
+	start    time.Time
+	current  int
+	previous int
+	// expireAt the entry is at its initial state again after it, and can be dropped
+	expireAt time.Time
+}
+
+// MemoryRateLimitStore in process RateLimitStore, idle keys are swept periodically
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{entries: make(map[string]*rateLimitEntry)}
+}
+
+func (this *MemoryRateLimitStore) Take(_ context.Context, key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.sweep(now, policy.Window)
+	entry, ok := this.entries[key]
+	if !ok {
+		entry = &rateLimitEntry{}
+		this.entries[key] = entry
+	}
+	var result RateLimitResult
+	if policy.Algorithm == RateLimitSlidingWindow {
+		result = entry.slidingWindow(policy, now)
+	} else {
+		result = entry.tokenBucket(policy, now)
+	}
+	entry.expireAt = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep drops expired entries, at most once per window
+func (this *MemoryRateLimitStore) sweep(now time.Time, window time.Duration) {
+	if now.Sub(this.lastSweep) < window {
+		return
+	}
+	this.lastSweep = now
+	for key, entry := range this.entries {
+		if !now.Before(entry.expireAt) {
+			delete(this.entries, key)
+		}
+	}
+}
+
+func (this *rateLimitEntry) tokenBucket(policy RateLimitPolicy, now time.Time) RateLimitResult {
+	capacity := float64(policy.Burst)
+	if capacity <= 0 {
+		capacity = float64(policy.Limit)
+	}
+	// tokens per second
+	rate := float64(policy.Limit) / policy.Window.Seconds()
+	if this.last.IsZero() {
+		this.tokens = capacity
+	} else {
+		this.tokens = math.Min(capacity, this.tokens+now.Sub(this.last).Seconds()*rate)
+	}
+	this.last = now
+	result := RateLimitResult{Limit: int(capacity)}
+	if this.tokens >= 1 {
+		this.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - this.tokens) / rate)
+	}
+	result.Remaining = int(this.tokens)
+	result.Reset = secondsDuration((capacity - this.tokens) / rate)
+	return result
+}
+
+func (this *rateLimitEntry) slidingWindow(policy RateLimitPolicy, now time.Time) RateLimitResult {
+	start := now.Truncate(policy.Window)
+	if !start.Equal(this.start) {
+		if start.Sub(this.start) == policy.Window {
+			this.previous = this.current
+		} else {
+			this.previous = 0
+		}
+		this.current = 0
+		this.start = start
+	}
+	untilNext := start.Add(policy.Window).Sub(now)
+	// the previous window counts for the part of it still inside the sliding window
+	weight := float64(untilNext) / float64(policy.Window)
+	used := int(math.Ceil(float64(this.previous)*weight)) + this.current
+	result := RateLimitResult{Limit: policy.Limit}
+	if used < policy.Limit {
+		this.current++
+		used++
+		result.Allowed = true
+	} else {
+		result.RetryAfter = untilNext
+	}
+	result.Remaining = policy.Limit - used
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	// the requests of this window leave the sliding window one window later
+	result.Reset = untilNext
+	if this.current > 0 {
+		result.Reset += policy.Window
+	}
+	return result
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
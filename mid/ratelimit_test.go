@@ -0,0 +1,105 @@
+package mid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAPIKeySession struct {
+	id string
+}
+
+func (this testAPIKeySession) UserId() string   { return "app-" + this.id }
+func (this testAPIKeySession) ExpireAt() int64  { return 0 }
+func (this testAPIKeySession) APIKeyId() string { return this.id }
+
+// testAPIKeyProvider accepts the keys 'a' and 'b' of X-Api-Key
+type testAPIKeyProvider struct{}
+
+func (testAPIKeyProvider) Auth(ctx echo.Context) (AuthSessionInfo, error) {
+	switch key := ctx.Request().Header.Get("X-Api-Key"); key {
+	case "a", "b":
+		return testAPIKeySession{id: key}, nil
+	}
+	return nil, kerrors.ErrUnauthorized()
+}
+
+func TestRateLimit(t *testing.T) {
+	e := echo.New()
+	// as web.globalErrorHandle
+	e.HTTPErrorHandler = errorHandle
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(AuthWithConfig(DefaultAuthConfig, testAPIKeyProvider{}))
+	e.Use(RateLimit(RateLimitConfig{
+		Enabled: true,
+		Policy:  RateLimitPolicy{Algorithm: RateLimitTokenBucket, Limit: 2, Window: time.Minute, KeyBy: RateLimitKeyAPIKey},
+		Routes: map[string]RateLimitPolicy{
+			"GET /open": {Limit: 0},
+		},
+	}))
+	e.GET("/items", Wrap(func() error { return nil }))
+	e.GET("/open", Wrap(func() error { return nil }))
+	get := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		// spoofed, no IPExtractor trusts it
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113."+apiKey)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get("/items", "a")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get(HeaderRateLimitLimit))
+	assert.Equal(t, "1", rec.Header().Get(HeaderRateLimitRemaining))
+	assert.Equal(t, "2;w=60", rec.Header().Get(HeaderRateLimitPolicy))
+	get("/items", "a")
+
+	rec = get("/items", "a")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get(HeaderRetryAfter))
+	rsp := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	assert.Equal(t, float64(kerrors.CodeTooManyRequests), rsp["code"])
+
+	// other keys and disabled routes are not limited
+	assert.Equal(t, http.StatusOK, get("/items", "b").Code)
+	assert.Equal(t, http.StatusOK, get("/open", "a").Code)
+	assert.Equal(t, "", get("/open", "a").Header().Get(HeaderRateLimitLimit))
+
+	// unknown keys and forwarded ips do not get a quota of their own, they share the one of the connection ip
+	assert.Equal(t, http.StatusOK, get("/items", "x").Code)
+	assert.Equal(t, http.StatusOK, get("/items", "y").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("/items", "z").Code)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	policy := RateLimitPolicy{Algorithm: RateLimitSlidingWindow, Limit: 4, Window: time.Minute}
+	begin := time.Now().Truncate(time.Minute)
+	for i := 0; i < 4; i++ {
+		result, err := store.Take(context.Background(), "k", policy, begin.Add(time.Second))
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3-i, result.Remaining)
+	}
+	result, _ := store.Take(context.Background(), "k", policy, begin.Add(time.Second*2))
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Second*58, result.RetryAfter)
+	// half way into the next window, half of the previous requests still count
+	result, _ = store.Take(context.Background(), "k", policy, begin.Add(time.Second*90))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Remaining)
+	result, _ = store.Take(context.Background(), "k", policy, begin.Add(time.Second*90))
+	assert.True(t, result.Allowed)
+	result, _ = store.Take(context.Background(), "k", policy, begin.Add(time.Second*90))
+	assert.False(t, result.Allowed)
+}
@@ -0,0 +1,187 @@
+package mid
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/guestin/kboot-web-echo-starter/internal"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// RBACPermission is a (method, route pattern, action) tuple.
+	// Path accepts glob or echo route template syntax, a permission without Path only grants its Action.
+	RBACPermission struct {
+		Method string `toml:"method" json:"method" mapstructure:"method"` // empty or '*' means any method
+		Path   string `toml:"path" json:"path" mapstructure:"path"`
+		Action string `toml:"action" json:"action" mapstructure:"action"`
+
+		pattern *internal.PathPattern
+	}
+	RBACRole struct {
+		Name        string           `toml:"name" json:"name" mapstructure:"name"`
+		Inherits    []string         `toml:"inherits" json:"inherits" mapstructure:"inherits"`
+		Permissions []RBACPermission `toml:"permissions" json:"permissions" mapstructure:"permissions"`
+	}
+	// RoleResolver returns the role names bound to a user
+	RoleResolver interface {
+		ResolveRoles(ctx echo.Context, userId string) ([]string, error)
+	}
+	RoleResolverFunc func(ctx echo.Context, userId string) ([]string, error)
+	// RBACConfig the resolved permissions are cached by ACLConfig.Cache, invalidate users there.
+	// ACLConfig.CacheTTL is 0 by default, then RoleResolver runs on every request mid.ACL enforces
+	RBACConfig struct {
+		Roles        []RBACRole `toml:"roles" json:"roles" mapstructure:"roles"`
+		RoleResolver RoleResolver
+		// RolesClaim used when RoleResolver is nil, a claim of the auth session listing the roles of the caller,
+		// see AuthSessionClaims. with it web builds the ACL permission loader from the config alone
+		RolesClaim string `toml:"rolesClaim" json:"rolesClaim" mapstructure:"rolesClaim"`
+	}
+)
+
+var DefaultRBACConfig = RBACConfig{}
+
+func (f RoleResolverFunc) ResolveRoles(ctx echo.Context, userId string) ([]string, error) {
+	return f(ctx, userId)
+}
+
+func (this *RBACPermission) compile() error {
+	this.Method = strings.ToUpper(strings.TrimSpace(this.Method))
+	if this.Method == "*" {
+		this.Method = ""
+	}
+	if this.Path == "" {
+		return nil
+	}
+	pattern, err := internal.CompilePathPattern(this.Path)
+	if err != nil {
+		return err
+	}
+	this.pattern = pattern
+	return nil
+}
+
+func (this *RBACPermission) Match(ctx echo.Context) bool {
+	if this.pattern == nil {
+		return false
+	}
+	if this.Method != "" && this.Method != ctx.Request().Method {
+		return false
+	}
+	return this.pattern.Match(ctx.Path(), ctx.Request().URL.Path)
+}
+
+func (this *RBACPermission) GrantAction(action string) bool {
+	return this.Action != "" && MatchAction(this.Action, action)
+}
+
+func (this *RBACPermission) String() string {
+	method := this.Method
+	if method == "" {
+		method = "*"
+	}
+	return fmt.Sprintf("%s %s %s", method, this.Path, this.Action)
+}
+
+type RBAC struct {
+	resolver RoleResolver
+	// role name -> permissions, include inherited
+	rolePermissions map[string][]ACLPermission
+}
+
+// RolesFromClaim resolves the roles of the caller from a claim of the auth session, a list or a comma separated string
+func RolesFromClaim(claim string) RoleResolver {
+	return RoleResolverFunc(func(ctx echo.Context, _ string) ([]string, error) {
+		if v, ok := sessionClaim(ctx, claim); ok {
+			return claimList(v), nil
+		}
+		return []string{}, nil
+	})
+}
+
+func NewRBAC(config RBACConfig) *RBAC {
+	if config.RoleResolver == nil && config.RolesClaim != "" {
+		config.RoleResolver = RolesFromClaim(config.RolesClaim)
+	}
+	if config.RoleResolver == nil {
+		panic("RBAC role resolver not be nil")
+	}
+	roles := make(map[string]*RBACRole, len(config.Roles))
+	for i := range config.Roles {
+		role := &config.Roles[i]
+		if _, ok := roles[role.Name]; ok {
+			panic(fmt.Sprintf("RBAC role '%s' duplicated", role.Name))
+		}
+		for j := range role.Permissions {
+			if err := role.Permissions[j].compile(); err != nil {
+				panic(fmt.Sprintf("RBAC role '%s' permission not valid: %v", role.Name, err))
+			}
+		}
+		roles[role.Name] = role
+	}
+	out := &RBAC{
+		resolver:        config.RoleResolver,
+		rolePermissions: make(map[string][]ACLPermission, len(roles)),
+	}
+	for name := range roles {
+		// a role inherited along several paths grants its permissions once
+		out.rolePermissions[name] = uniquePermissions(flattenRolePermissions(roles, name, []string{}))
+	}
+	return out
+}
+
+func uniquePermissions(permissions []ACLPermission) []ACLPermission {
+	seen := make(map[ACLPermission]struct{}, len(permissions))
+	out := make([]ACLPermission, 0, len(permissions))
+	for _, permission := range permissions {
+		if _, ok := seen[permission]; !ok {
+			seen[permission] = struct{}{}
+			out = append(out, permission)
+		}
+	}
+	return out
+}
+
+func flattenRolePermissions(roles map[string]*RBACRole, name string, path []string) []ACLPermission {
+	for _, visited := range path {
+		if visited == name {
+			panic(fmt.Sprintf("RBAC role inheritance cycle: %s -> %s", strings.Join(path, " -> "), name))
+		}
+	}
+	role, ok := roles[name]
+	if !ok {
+		panic(fmt.Sprintf("RBAC role '%s' not defined, required by '%s'", name, path[len(path)-1]))
+	}
+	out := make([]ACLPermission, 0, len(role.Permissions))
+	for i := range role.Permissions {
+		out = append(out, &role.Permissions[i])
+	}
+	for _, parent := range role.Inherits {
+		out = append(out, flattenRolePermissions(roles, parent, append(path, name))...)
+	}
+	return out
+}
+
+// RolePermissions returns the permissions of role, include the inherited ones
+func (this *RBAC) RolePermissions(role string) []ACLPermission {
+	return this.rolePermissions[role]
+}
+
+// LoadPermissions resolves the roles of the current user and returns their permissions,
+// each listed once though several roles share it
+func (this *RBAC) LoadPermissions(ctx echo.Context) ([]ACLPermission, error) {
+	roles, err := this.resolver.ResolveRoles(ctx, callerAuthContext(ctx).GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	permissions := make([]ACLPermission, 0)
+	for _, role := range roles {
+		permissions = append(permissions, this.rolePermissions[role]...)
+	}
+	return uniquePermissions(permissions), nil
+}
+
+// ACLPermissionLoadFunc returns a loader ready to be used in ACLConfig, cached by ACLConfig.Cache if set
+func (this *RBAC) ACLPermissionLoadFunc() ACLPermissionLoadFunc {
+	return this.LoadPermissions
+}
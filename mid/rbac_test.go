@@ -0,0 +1,111 @@
+package mid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRBAC(roles ...RBACRole) *RBAC {
+	return NewRBAC(RBACConfig{Roles: roles, RolesClaim: "roles"})
+}
+
+func TestRBAC_Inheritance(t *testing.T) {
+	base := RBACRole{Name: "base", Permissions: []RBACPermission{{Action: "profile:read"}}}
+	viewer := RBACRole{Name: "viewer", Inherits: []string{"base"}, Permissions: []RBACPermission{{Action: "order:read"}}}
+	auditor := RBACRole{Name: "auditor", Inherits: []string{"base"}, Permissions: []RBACPermission{{Action: "log:read"}}}
+	// diamond: admin -> viewer -> base, admin -> auditor -> base
+	admin := RBACRole{Name: "admin", Inherits: []string{"viewer", "auditor"}, Permissions: []RBACPermission{{Action: "order:*"}}}
+	rbac := newTestRBAC(base, viewer, auditor, admin)
+
+	granted := func(role string, action string) bool {
+		for _, permission := range rbac.RolePermissions(role) {
+			if permission.(*RBACPermission).GrantAction(action) {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, granted("viewer", "profile:read"))
+	assert.True(t, granted("viewer", "order:read"))
+	assert.False(t, granted("viewer", "order:write"))
+	assert.True(t, granted("admin", "log:read"))
+	assert.True(t, granted("admin", "order:write"))
+	// the permission of base is listed once
+	assert.Len(t, rbac.RolePermissions("admin"), 4)
+}
+
+func TestRBAC_LoadPermissions(t *testing.T) {
+	viewer := RBACRole{Name: "viewer", Permissions: []RBACPermission{{Action: "order:read"}}}
+	editor := RBACRole{Name: "editor", Inherits: []string{"viewer"}, Permissions: []RBACPermission{{Action: "order:write"}}}
+	rbac := newTestRBAC(viewer, editor)
+	e := echo.New()
+	e.Use(AuthWithConfig(AuthConfig{Enabled: true}, testClaimsProvider{}))
+	var permissions []ACLPermission
+	e.GET("/rbac/permissions", func(ctx echo.Context) error {
+		var err error
+		permissions, err = rbac.LoadPermissions(ctx)
+		return err
+	})
+	req := httptest.NewRequest(http.MethodGet, "/rbac/permissions", nil)
+	req.Header.Set("X-Claims", "roles=viewer, editor")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	// order:read is granted by both roles, listed once
+	assert.Len(t, permissions, 2)
+}
+
+func TestRBAC_InvalidRoles(t *testing.T) {
+	panicOf := func(roles ...RBACRole) (msg string) {
+		defer func() { msg = fmt.Sprint(recover()) }()
+		newTestRBAC(roles...)
+		return ""
+	}
+	msg := panicOf(
+		RBACRole{Name: "a", Inherits: []string{"b"}},
+		RBACRole{Name: "b", Inherits: []string{"c"}},
+		RBACRole{Name: "c", Inherits: []string{"a"}},
+	)
+	assert.Contains(t, msg, "RBAC role inheritance cycle")
+	assert.Contains(t, panicOf(RBACRole{Name: "a", Inherits: []string{"missing"}}), "'missing' not defined")
+	assert.Contains(t, panicOf(RBACRole{Name: "a"}, RBACRole{Name: "a"}), "duplicated")
+}
+
+func TestRBAC_RolesClaim(t *testing.T) {
+	rbac := newTestRBAC(
+		RBACRole{Name: "viewer", Permissions: []RBACPermission{{Method: "GET", Path: "/rbac/orders/**"}}},
+		RBACRole{Name: "editor", Inherits: []string{"viewer"}, Permissions: []RBACPermission{{Action: "order:write"}}},
+	)
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Use(AuthWithConfig(AuthConfig{Enabled: true}, testClaimsProvider{}))
+	e.Use(ACL(ACLConfig{Enabled: true, ACLPermissionLoadFunc: rbac.ACLPermissionLoadFunc()}))
+	// undeclared, checked against the routes of the permissions
+	e.GET("/rbac/orders/:id", Wrap(func() error { return nil }))
+	Require(e.PUT("/rbac/orders/:id", Wrap(func() error { return nil })), "order:write")
+	e.GET("/rbac/files/*", Wrap(func() error { return nil }))
+	callPath := func(method string, path string, claims string) interface{} {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-Claims", claims)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		rsp := map[string]interface{}{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &rsp)
+		return rsp["code"]
+	}
+	call := func(method string, claims string) interface{} {
+		return callPath(method, "/rbac/orders/1", claims)
+	}
+	// granted by the route of the permission
+	assert.Equal(t, float64(kerrors.CodeOk), call(http.MethodGet, "roles=viewer"))
+	assert.Equal(t, float64(kerrors.CodeForbidden), call(http.MethodPut, "roles=viewer"))
+	assert.Equal(t, float64(kerrors.CodeOk), call(http.MethodPut, "roles=viewer, editor"))
+	assert.Equal(t, float64(kerrors.CodeForbidden), call(http.MethodGet, "roles="))
+	// routed to /rbac/files/*, the cleaned '/rbac/orders/1' must not grant it
+	assert.Equal(t, float64(kerrors.CodeForbidden), callPath(http.MethodGet, "/rbac/files/../orders/1", "roles=viewer"))
+}
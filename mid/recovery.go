@@ -15,6 +15,7 @@ func Recovery(logger log.ZapLog) echo.MiddlewareFunc {
 	return middleware.RecoverWithConfig(middleware.RecoverConfig{
 		DisablePrintStack: true,
 		LogErrorFunc: func(ctx echo.Context, err error, stack []byte) error {
+			countPanic(ctx)
 			traceId := GetTraceId(ctx)
 			if traceId != "" {
 				logger = logger.With(log.UseSubTag(log.NewFixStyleText(traceId, log.Blue, false)))
@@ -0,0 +1,278 @@
+package mid
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type (
+	// RedactConfig field level masking of logged bodies and query strings, values are masked with hideString
+	RedactConfig struct {
+		// Keys JSON object keys and form keys masked at any depth, matched ignoring case, '_' and '-',
+		// and inside longer keys, e.g. 'token' masks 'api_token' and 'tokenHash'
+		Keys []string `toml:"keys" json:"keys" mapstructure:"keys"`
+		// Paths dotted JSON paths, '*' matches any key or array index, e.g. 'user.idCard', 'items.*.card'
+		Paths []string `toml:"paths" json:"paths" mapstructure:"paths"`
+		// Patterns regexes masked inside string values and raw text
+		Patterns []string `toml:"patterns" json:"patterns" mapstructure:"patterns"`
+		// Builtin named patterns, RedactCardNumber, RedactEmail, RedactPhone
+		Builtin []string `toml:"builtin" json:"builtin" mapstructure:"builtin"`
+	}
+)
+
+const (
+	RedactCardNumber = "cardNumber"
+	RedactEmail      = "email"
+	RedactPhone      = "phone"
+)
+
+// RedactOmittedJSON replaces json bodies which can not be parsed, e.g. truncated ones, when they can not be
+// redacted as text: Paths are configured, or a key to mask holds an object or array
+const RedactOmittedJSON = "<json body omitted, it can not be redacted>"
+
+// DefaultRedactKeys keys masked unless configured otherwise
+var DefaultRedactKeys = []string{"password", "passwd", "secret", "token", "accessToken", "refreshToken", "authorization"}
+
+var redactBuiltinPatterns = map[string]string{
+	RedactCardNumber: `\b(?:\d[ -]?){12,18}\d\b`,
+	RedactEmail:      `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	RedactPhone:      `(?:\+\d{1,3}[ -]?)?\b1[3-9]\d{9}\b`,
+}
+
+// Redactor compiled RedactConfig, safe for concurrent use
+type Redactor struct {
+	// keys normalized by normalizeRedactKey
+	keys []string
+	// keyPattern masks values of keys in json which can not be parsed, e.g. truncated bodies
+	keyPattern *regexp.Regexp
+	paths      [][]string
+	patterns   []*regexp.Regexp
+}
+
+// NewRedactor panics on invalid patterns or unknown builtin names
+func NewRedactor(config RedactConfig) *Redactor {
+	out := &Redactor{keys: make([]string, 0, len(config.Keys))}
+	quoted := make([]string, 0, len(config.Keys))
+	for _, k := range config.Keys {
+		normalized := normalizeRedactKey(k)
+		if normalized == "" {
+			continue
+		}
+		out.keys = append(out.keys, normalized)
+		// the separators a key may be written with
+		letters := make([]string, 0, len(normalized))
+		for _, r := range normalized {
+			letters = append(letters, regexp.QuoteMeta(string(r)))
+		}
+		quoted = append(quoted, strings.Join(letters, `[_-]?`))
+	}
+	if len(quoted) > 0 {
+		out.keyPattern = regexp.MustCompile(`(?i)("[^"]*(?:` + strings.Join(quoted, "|") + `)[^"]*"\s*:\s*)("(?:[^"\\]|\\.)*"?|[-+.\w]+|[\[{])`)
+	}
+	for _, p := range config.Paths {
+		out.paths = append(out.paths, strings.Split(p, "."))
+	}
+	for _, name := range config.Builtin {
+		expr, ok := redactBuiltinPatterns[name]
+		if !ok {
+			panic(fmt.Sprintf("unknown builtin redact pattern '%s'", name))
+		}
+		out.patterns = append(out.patterns, regexp.MustCompile(expr))
+	}
+	for _, expr := range config.Patterns {
+		out.patterns = append(out.patterns, regexp.MustCompile(expr))
+	}
+	return out
+}
+
+// Merge returns the union of both configs
+func (this RedactConfig) Merge(other RedactConfig) RedactConfig {
+	return RedactConfig{
+		Keys:     append(append([]string{}, this.Keys...), other.Keys...),
+		Paths:    append(append([]string{}, this.Paths...), other.Paths...),
+		Patterns: append(append([]string{}, this.Patterns...), other.Patterns...),
+		Builtin:  append(append([]string{}, this.Builtin...), other.Builtin...),
+	}
+}
+
+// RedactBody by content type, json and form bodies field by field, others as text
+func (this *Redactor) RedactBody(contentType string, body []byte) []byte {
+	switch {
+	case strings.Contains(contentType, MIMEApplicationJSON):
+		return this.RedactJSON(body)
+	case strings.Contains(contentType, MIMEApplicationForm):
+		return []byte(this.RedactForm(string(body)))
+	default:
+		return []byte(this.RedactText(string(body)))
+	}
+}
+
+// RedactJSON invalid json is redacted as text, or replaced by RedactOmittedJSON
+func (this *Redactor) RedactJSON(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return []byte(this.redactJSONText(string(body)))
+	}
+	out, err := json.Marshal(this.redactValue(doc, nil))
+	if err != nil {
+		return []byte(this.redactJSONText(string(body)))
+	}
+	return out
+}
+
+func (this *Redactor) redactJSONText(text string) string {
+	// paths can not be followed without parsing
+	if len(this.paths) > 0 {
+		return RedactOmittedJSON
+	}
+	if this.keyPattern != nil {
+		omitted := false
+		text = this.keyPattern.ReplaceAllStringFunc(text, func(match string) string {
+			groups := this.keyPattern.FindStringSubmatch(match)
+			value := groups[2]
+			switch value[0] {
+			case '[', '{':
+				omitted = true
+				return match
+			case '"':
+				inner := strings.TrimPrefix(value, `"`)
+				closing := ""
+				if len(inner) > 0 && strings.HasSuffix(inner, `"`) && !strings.HasSuffix(inner, `\"`) {
+					inner, closing = inner[:len(inner)-1], `"`
+				}
+				return groups[1] + `"` + maskString(inner) + closing
+			}
+			return groups[1] + maskString(value)
+		})
+		if omitted {
+			return RedactOmittedJSON
+		}
+	}
+	return this.RedactText(text)
+}
+
+// RedactForm url encoded form or query string
+func (this *Redactor) RedactForm(form string) string {
+	values, err := url.ParseQuery(form)
+	if err != nil {
+		return this.RedactText(form)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := new(strings.Builder)
+	for _, k := range keys {
+		hide := this.hideKey(k)
+		for _, v := range values[k] {
+			if hide {
+				v = maskString(v)
+			} else {
+				v = this.RedactText(v)
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			// masks stay readable
+			buf.WriteString(url.QueryEscape(k))
+			buf.WriteByte('=')
+			buf.WriteString(strings.ReplaceAll(url.QueryEscape(v), "%2A", "*"))
+		}
+	}
+	return buf.String()
+}
+
+func (this *Redactor) RedactText(text string) string {
+	for _, pattern := range this.patterns {
+		text = pattern.ReplaceAllStringFunc(text, hideString)
+	}
+	return text
+}
+
+func (this *Redactor) redactValue(v interface{}, path []string) interface{} {
+	if this.matchPath(path) {
+		return maskValue(v)
+	}
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, item := range vv {
+			if this.hideKey(k) {
+				vv[k] = maskValue(item)
+				continue
+			}
+			vv[k] = this.redactValue(item, append(path, k))
+		}
+		return vv
+	case []interface{}:
+		for i := range vv {
+			vv[i] = this.redactValue(vv[i], append(path, fmt.Sprint(i)))
+		}
+		return vv
+	case string:
+		return this.RedactText(vv)
+	default:
+		return v
+	}
+}
+
+func (this *Redactor) matchPath(path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	for _, p := range this.paths {
+		if len(p) != len(path) {
+			continue
+		}
+		matched := true
+		for i := range p {
+			if p[i] != "*" && p[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeRedactKey(k string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(k))
+}
+
+func (this *Redactor) hideKey(k string) bool {
+	k = normalizeRedactKey(k)
+	for _, key := range this.keys {
+		if strings.Contains(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func maskValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	s := fmt.Sprint(v)
+	if s == "" {
+		return s
+	}
+	return hideString(s)
+}
+
+func maskString(s string) string {
+	if s == "" {
+		return s
+	}
+	return hideString(s)
+}
@@ -0,0 +1,52 @@
+package mid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	redactor := NewRedactor(RedactConfig{
+		Keys:    DefaultRedactKeys,
+		Paths:   []string{"items.*.card"},
+		Builtin: []string{RedactEmail, RedactPhone},
+	})
+	body := redactor.RedactJSON([]byte(`{"Password":"p@ssw0rd","items":[{"card":"6222020200112233","n":1}],"note":"mail me at bob@example.com"}`))
+	assert.Equal(t, `{"Password":"p@s**0rd","items":[{"card":"6222********2233","n":1}],"note":"mail me at bob@*******.com"}`, string(body))
+	assert.Equal(t, "phone=1381***5678&token=abcd********mnop",
+		redactor.RedactForm("token=abcdefghijklmnop&phone=13812345678"))
+	// paths can not be applied to invalid json
+	assert.Equal(t, RedactOmittedJSON, string(redactor.RedactBody(MIMEApplicationJSON, []byte("not json 13812345678"))))
+	assert.Equal(t, "not json 1381***5678", string(redactor.RedactBody("text/plain", []byte("not json 13812345678"))))
+
+	merged := RedactConfig{Keys: []string{"a"}}.Merge(RedactConfig{Builtin: []string{RedactCardNumber}})
+	assert.Equal(t, "4111********1111", NewRedactor(merged).RedactText("4111111111111111"))
+}
+
+func TestRedactor_TruncatedJSON(t *testing.T) {
+	redactor := NewRedactor(RedactConfig{Keys: DefaultRedactKeys})
+	assert.Equal(t, `{"user":"bob","password": "p@s**0rd","token":"a**d`,
+		string(redactor.RedactJSON([]byte(`{"user":"bob","password": "p@ssw0rd","token":"abcd`))))
+	// non-string values are masked too, objects can not be
+	assert.Equal(t, `{"secret":1**4,"n":1,"token":"abcd****ijkl","user":"b`,
+		string(redactor.RedactJSON([]byte(`{"secret":1234,"n":1,"token":"abcdefghijkl","user":"b`))))
+	assert.Equal(t, RedactOmittedJSON,
+		string(redactor.RedactJSON([]byte(`{"secret":{"pin":1234},"user":"b`))))
+
+	// paths can not be followed in truncated bodies
+	redactor = NewRedactor(RedactConfig{Keys: DefaultRedactKeys, Paths: []string{"card.pin"}})
+	assert.Equal(t, RedactOmittedJSON, string(redactor.RedactJSON([]byte(`{"card":{"pin":1234},"user":"b`))))
+}
+
+func TestRedactor_KeyVariants(t *testing.T) {
+	redactor := NewRedactor(RedactConfig{Keys: []string{"token", "card_number"}})
+	assert.Equal(t, `{"API_TOKEN":"a****d","cardNumber":"4111********1111","n":1}`,
+		string(redactor.RedactJSON([]byte(`{"API_TOKEN":"abxxcd","cardNumber":"4111111111111111","n":1}`))))
+	assert.Equal(t, "access-token=a****d&n=1", redactor.RedactForm("access-token=abxxcd&n=1"))
+	assert.Equal(t, `{"n":1,"Card-Number":"4111********1111","refreshToken":"*`,
+		string(redactor.RedactJSON([]byte(`{"n":1,"Card-Number":"4111111111111111","refreshToken":"a`))))
+
+	// the audit keys are a copy, not sharing the backing array
+	assert.False(t, &DefaultAuditRedactKeys[0] == &DefaultRedactKeys[0])
+}
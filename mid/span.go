@@ -0,0 +1,242 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	SpanKind       string
+	SpanStatusCode string
+
+	// SpanConfig spans of mid.Trace, one server span per sampled request plus child spans
+	// for auth, acl, bind, validate and handler execution
+	SpanConfig struct {
+		Enabled bool `toml:"enabled" json:"enabled"`
+		// ServiceName recorded as 'service.name' on every span
+		ServiceName string `toml:"serviceName" json:"serviceName"`
+		// Exporter receives finished spans in batches, e.g. an adapter to an OpenTelemetry exporter
+		Exporter SpanExporter
+		// built-in exporters, used along with Exporter when configured
+		Stdout bool   `toml:"stdout" json:"stdout"`
+		File   string `toml:"file" json:"file"`
+		// OTLP ships spans to an OpenTelemetry collector
+		OTLP OTLPExporterConfig `toml:"otlp" json:"otlp"`
+
+		QueueSize     int           `toml:"queueSize" json:"queueSize"`
+		BatchSize     int           `toml:"batchSize" json:"batchSize"`
+		FlushInterval time.Duration `toml:"flushInterval" json:"flushInterval"`
+	}
+
+	// SpanData immutable snapshot of a finished span, attribute names follow the OpenTelemetry semantic conventions
+	SpanData struct {
+		TraceId       string                 `json:"traceId"`
+		SpanId        string                 `json:"spanId"`
+		ParentSpanId  string                 `json:"parentSpanId,omitempty"`
+		Name          string                 `json:"name"`
+		Kind          SpanKind               `json:"kind"`
+		Start         time.Time              `json:"start"`
+		End           time.Time              `json:"end"`
+		Status        SpanStatusCode         `json:"status"`
+		StatusMessage string                 `json:"statusMessage,omitempty"`
+		Attributes    map[string]interface{} `json:"attributes,omitempty"`
+	}
+)
+
+const (
+	SpanKindServer   SpanKind = "server"
+	SpanKindInternal SpanKind = "internal"
+	SpanKindClient   SpanKind = "client"
+
+	SpanStatusUnset SpanStatusCode = "unset"
+	SpanStatusOk    SpanStatusCode = "ok"
+	SpanStatusError SpanStatusCode = "error"
+)
+
+var DefaultSpanConfig = SpanConfig{
+	Enabled:       false,
+	QueueSize:     2048,
+	BatchSize:     128,
+	FlushInterval: time.Second * 5,
+}
+
+// Span a running span, all methods are safe on a nil span so callers need not check
+// whether tracing is enabled
+type Span struct {
+	mu        sync.Mutex
+	data      SpanData
+	ended     bool
+	processor *spanProcessor
+	parent    *Span
+	// echoCtx the request the span is current of, restored to parent on End
+	echoCtx echo.Context
+}
+
+type spanCtxKey struct{}
+
+// CurrentSpan the innermost running span of the request, nil if spans are not enabled or the request is not sampled
+func CurrentSpan(ctx echo.Context) *Span {
+	if span, ok := ctx.Get(CtxSpanKey).(*Span); ok {
+		return span
+	}
+	return nil
+}
+
+// StartSpan starts a child of the current span, which becomes the current span until End
+func StartSpan(ctx echo.Context, name string) *Span {
+	parent := CurrentSpan(ctx)
+	if parent == nil {
+		return nil
+	}
+	span := parent.child(name, SpanKindInternal)
+	span.echoCtx = ctx
+	ctx.Set(CtxSpanKey, span)
+	return span
+}
+
+// SpanFromContext the span carried by ctx, e.g. the context returned by mid.UnwrapContext
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpan returns a copy of ctx carrying span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanCtxKey{}, span)
+}
+
+// StartSpanFromContext starts a child of the span carried by ctx, for code without an echo.Context
+func StartSpanFromContext(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.child(name, kind)
+	return ContextWithSpan(ctx, span), span
+}
+
+func newServerSpan(processor *spanProcessor, tc *TraceContext, serviceName string) *Span {
+	span := &Span{
+		processor: processor,
+		data: SpanData{
+			TraceId:      tc.TraceId,
+			SpanId:       tc.SpanId,
+			ParentSpanId: tc.ParentSpanId,
+			Kind:         SpanKindServer,
+			Start:        time.Now(),
+			Status:       SpanStatusUnset,
+			Attributes:   make(map[string]interface{}),
+		},
+	}
+	if serviceName != "" {
+		span.data.Attributes["service.name"] = serviceName
+	}
+	return span
+}
+
+func (this *Span) child(name string, kind SpanKind) *Span {
+	return &Span{
+		processor: this.processor,
+		parent:    this,
+		data: SpanData{
+			TraceId:      this.data.TraceId,
+			SpanId:       newSpanId(),
+			ParentSpanId: this.data.SpanId,
+			Name:         name,
+			Kind:         kind,
+			Start:        time.Now(),
+			Status:       SpanStatusUnset,
+			Attributes:   make(map[string]interface{}),
+		},
+	}
+}
+
+func (this *Span) TraceId() string {
+	if this == nil {
+		return ""
+	}
+	return this.data.TraceId
+}
+
+func (this *Span) SpanId() string {
+	if this == nil {
+		return ""
+	}
+	return this.data.SpanId
+}
+
+func (this *Span) SetName(name string) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.data.Name = name
+}
+
+func (this *Span) SetAttribute(key string, value interface{}) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.data.Attributes[key] = value
+}
+
+func (this *Span) SetStatus(code SpanStatusCode, message string) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.data.Status = code
+	this.data.StatusMessage = message
+}
+
+// RecordError marks the span failed, nil err is ignored
+func (this *Span) RecordError(err error) {
+	if this == nil || err == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.data.Status = SpanStatusError
+	this.data.StatusMessage = err.Error()
+	this.data.Attributes["error.type"] = fmt.Sprintf("%T", err)
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		this.data.Attributes["error.type"] = http.StatusText(he.Code)
+	}
+}
+
+// End finishes the span and hands it to the exporter, subsequent calls are ignored
+func (this *Span) End() {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	if this.ended {
+		this.mu.Unlock()
+		return
+	}
+	this.ended = true
+	this.data.End = time.Now()
+	data := this.data
+	this.mu.Unlock()
+	if this.echoCtx != nil && CurrentSpan(this.echoCtx) == this {
+		this.echoCtx.Set(CtxSpanKey, this.parent)
+	}
+	this.processor.enqueue(&data)
+}
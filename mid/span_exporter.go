@@ -0,0 +1,241 @@
+package mid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guestin/log"
+	"go.uber.org/zap"
+)
+
+type (
+	// SpanExporter ships finished spans, called from a background goroutine.
+	// Exporters implementing io.Closer are closed on shutdown, see CloseSpanProcessors
+	SpanExporter interface {
+		ExportSpans(ctx context.Context, spans []*SpanData) error
+	}
+	SpanExporterFunc func(ctx context.Context, spans []*SpanData) error
+)
+
+func (f SpanExporterFunc) ExportSpans(ctx context.Context, spans []*SpanData) error {
+	return f(ctx, spans)
+}
+
+// WriterSpanExporter writes spans as JSON lines, e.g. to os.Stdout
+type WriterSpanExporter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterSpanExporter(writer io.Writer) *WriterSpanExporter {
+	return &WriterSpanExporter{writer: writer}
+}
+
+// NewFileSpanExporter appends spans as JSON lines to path
+func NewFileSpanExporter(path string) (*WriterSpanExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSpanExporter(file), nil
+}
+
+func (this *WriterSpanExporter) ExportSpans(_ context.Context, spans []*SpanData) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	encoder := json.NewEncoder(this.writer)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *WriterSpanExporter) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if closer, ok := this.writer.(io.Closer); ok && this.writer != os.Stdout && this.writer != os.Stderr {
+		return closer.Close()
+	}
+	return nil
+}
+
+// spanProcessor batches finished spans, spans are dropped when the queue is full
+type spanProcessor struct {
+	config    SpanConfig
+	exporters []SpanExporter
+	logger    log.ZapLog
+	queue     chan *SpanData
+	closeCh   chan struct{}
+	doneCh    chan struct{}
+	once      sync.Once
+	dropped   uint64
+}
+
+func newSpanProcessor(config SpanConfig, logger log.ZapLog, exporters ...SpanExporter) *spanProcessor {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultSpanConfig.QueueSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultSpanConfig.BatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DefaultSpanConfig.FlushInterval
+	}
+	out := &spanProcessor{
+		config:    config,
+		exporters: exporters,
+		logger:    logger,
+		queue:     make(chan *SpanData, config.QueueSize),
+		closeCh:   make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	go out.loop()
+	return out
+}
+
+func (this *spanProcessor) enqueue(span *SpanData) {
+	if this == nil {
+		return
+	}
+	select {
+	case <-this.closeCh:
+		atomic.AddUint64(&this.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case this.queue <- span:
+	default:
+		atomic.AddUint64(&this.dropped, 1)
+	}
+}
+
+func (this *spanProcessor) loop() {
+	defer close(this.doneCh)
+	ticker := time.NewTicker(this.config.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*SpanData, 0, this.config.BatchSize)
+	for {
+		select {
+		case span := <-this.queue:
+			batch = append(batch, span)
+			if len(batch) >= this.config.BatchSize {
+				batch = this.export(batch)
+			}
+		case <-ticker.C:
+			batch = this.export(batch)
+		case <-this.closeCh:
+			for {
+				select {
+				case span := <-this.queue:
+					batch = append(batch, span)
+					if len(batch) >= this.config.BatchSize {
+						batch = this.export(batch)
+					}
+				default:
+					this.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (this *spanProcessor) export(batch []*SpanData) []*SpanData {
+	if len(batch) == 0 {
+		return batch
+	}
+	for _, exporter := range this.exporters {
+		ctx, cancel := context.WithTimeout(context.Background(), this.config.FlushInterval)
+		err := exporter.ExportSpans(ctx, batch)
+		cancel()
+		if err != nil {
+			this.logger.Error("export spans failed", zap.Int("spans", len(batch)), zap.Error(err))
+		}
+	}
+	for i := range batch {
+		batch[i] = nil
+	}
+	return batch[:0]
+}
+
+func (this *spanProcessor) close(ctx context.Context) error {
+	this.once.Do(func() {
+		close(this.closeCh)
+	})
+	select {
+	case <-this.doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if dropped := atomic.LoadUint64(&this.dropped); dropped > 0 {
+		this.logger.Warn("spans dropped, queue full", zap.Uint64("dropped", dropped))
+	}
+	for _, exporter := range this.exporters {
+		if closer, ok := exporter.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				this.logger.Error("close span exporter failed", zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+var spanProcessors = struct {
+	sync.Mutex
+	list []*spanProcessor
+}{}
+
+// CloseSpanProcessors exports the pending spans of mid.Trace and closes the exporters, called by web.Shutdown
+func CloseSpanProcessors(ctx context.Context) error {
+	spanProcessors.Lock()
+	list := spanProcessors.list
+	spanProcessors.list = nil
+	spanProcessors.Unlock()
+	var firstErr error
+	for _, processor := range list {
+		if err := processor.close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func newSpanProcessorWithConfig(config SpanConfig, logger log.ZapLog) *spanProcessor {
+	if !config.Enabled {
+		return nil
+	}
+	exporters := make([]SpanExporter, 0, 4)
+	if config.Exporter != nil {
+		exporters = append(exporters, config.Exporter)
+	}
+	if config.Stdout {
+		exporters = append(exporters, NewWriterSpanExporter(os.Stdout))
+	}
+	if config.File != "" {
+		exporter, err := NewFileSpanExporter(config.File)
+		if err != nil {
+			panic(fmt.Sprintf("open span file exporter failed: %v", err))
+		}
+		exporters = append(exporters, exporter)
+	}
+	if config.OTLP.Endpoint != "" {
+		exporters = append(exporters, NewOTLPSpanExporter(config.OTLP))
+	}
+	if len(exporters) == 0 {
+		return nil
+	}
+	processor := newSpanProcessor(config, logger, exporters...)
+	spanProcessors.Lock()
+	spanProcessors.list = append(spanProcessors.list, processor)
+	spanProcessors.Unlock()
+	return processor
+}
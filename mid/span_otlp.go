@@ -0,0 +1,226 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLPExporterConfig posts spans to an OpenTelemetry collector, OTLP/HTTP with JSON encoding
+type OTLPExporterConfig struct {
+	// Endpoint traces url of the collector, e.g. 'http://otel-collector:4318/v1/traces', empty disables the exporter
+	Endpoint string `toml:"endpoint" json:"endpoint"`
+	// Headers added to every export request, e.g. authentication of a hosted collector
+	Headers map[string]string `toml:"headers" json:"headers"`
+	Timeout time.Duration     `toml:"timeout" json:"timeout"`
+}
+
+const otlpScopeName = "github.com/guestin/kboot-web-echo-starter/mid"
+
+// OTLPSpanExporter SpanExporter of OTLPExporterConfig, the 'service.name' attribute of spans
+// becomes the resource attribute
+type OTLPSpanExporter struct {
+	config OTLPExporterConfig
+	client *http.Client
+}
+
+func NewOTLPSpanExporter(config OTLPExporterConfig) *OTLPSpanExporter {
+	if config.Endpoint == "" {
+		panic("otlp exporter endpoint must not be empty")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 10
+	}
+	return &OTLPSpanExporter{config: config, client: &http.Client{Timeout: config.Timeout}}
+}
+
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceId           string         `json:"traceId"`
+		SpanId            string         `json:"spanId"`
+		ParentSpanId      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		BoolValue   *bool           `json:"boolValue,omitempty"`
+		IntValue    *string         `json:"intValue,omitempty"`
+		DoubleValue *float64        `json:"doubleValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	}
+	otlpArrayValue struct {
+		Values []otlpAnyValue `json:"values"`
+	}
+)
+
+func (this *OTLPSpanExporter) ExportSpans(ctx context.Context, spans []*SpanData) error {
+	body, err := json.Marshal(otlpEncode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", MIMEApplicationJSON)
+	for k, v := range this.config.Headers {
+		req.Header.Set(k, v)
+	}
+	rsp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rsp.Body.Close() }()
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		return fmt.Errorf("otlp export to %s failed, status %d: %s", this.config.Endpoint, rsp.StatusCode, msg)
+	}
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	return nil
+}
+
+// otlpEncode groups spans by service name, one resource each
+func otlpEncode(spans []*SpanData) otlpTraces {
+	out := otlpTraces{ResourceSpans: make([]otlpResourceSpans, 0)}
+	index := make(map[string]int)
+	for _, span := range spans {
+		service, _ := span.Attributes["service.name"].(string)
+		i, ok := index[service]
+		if !ok {
+			resource := otlpResource{Attributes: make([]otlpKeyValue, 0, 1)}
+			if service != "" {
+				resource.Attributes = append(resource.Attributes, otlpAttribute("service.name", service))
+			}
+			out.ResourceSpans = append(out.ResourceSpans, otlpResourceSpans{
+				Resource:   resource,
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: otlpScopeName}}},
+			})
+			i = len(out.ResourceSpans) - 1
+			index[service] = i
+		}
+		scope := &out.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, otlpEncodeSpan(span))
+	}
+	return out
+}
+
+func otlpEncodeSpan(span *SpanData) otlpSpan {
+	out := otlpSpan{
+		TraceId:           span.TraceId,
+		SpanId:            span.SpanId,
+		ParentSpanId:      span.ParentSpanId,
+		Name:              span.Name,
+		Kind:              otlpSpanKind(span.Kind),
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusCode(span.Status), Message: span.StatusMessage},
+	}
+	keys := make([]string, 0, len(span.Attributes))
+	for k := range span.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "service.name" {
+			continue
+		}
+		out.Attributes = append(out.Attributes, otlpAttribute(k, span.Attributes[k]))
+	}
+	return out
+}
+
+// otlpSpanKind values of the OTLP SpanKind enum
+func otlpSpanKind(kind SpanKind) int {
+	switch kind {
+	case SpanKindInternal:
+		return 1
+	case SpanKindServer:
+		return 2
+	case SpanKindClient:
+		return 3
+	}
+	return 0
+}
+
+// otlpStatusCode values of the OTLP StatusCode enum
+func otlpStatusCode(status SpanStatusCode) int {
+	switch status {
+	case SpanStatusOk:
+		return 1
+	case SpanStatusError:
+		return 2
+	}
+	return 0
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue(value)}
+}
+
+func otlpValue(value interface{}) otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		// int64 values are strings in the JSON encoding of OTLP
+		s := fmt.Sprint(v)
+		return otlpAnyValue{IntValue: &s}
+	case float32:
+		f := float64(v)
+		return otlpAnyValue{DoubleValue: &f}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case []string:
+		values := make([]otlpAnyValue, 0, len(v))
+		for _, item := range v {
+			values = append(values, otlpValue(item))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case []interface{}:
+		values := make([]otlpAnyValue, 0, len(v))
+		for _, item := range v {
+			values = append(values, otlpValue(item))
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	}
+	s := fmt.Sprint(value)
+	return otlpAnyValue{StringValue: &s}
+}
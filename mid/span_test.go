@@ -0,0 +1,152 @@
+package mid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace_Spans(t *testing.T) {
+	var mu sync.Mutex
+	spans := make(map[string]*SpanData)
+	exporter := SpanExporterFunc(func(_ context.Context, batch []*SpanData) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, span := range batch {
+			spans[span.Name] = span
+		}
+		return nil
+	})
+	e := echo.New()
+	e.Use(TraceWithConfig(TraceConfig{
+		Logger: nopLogger,
+		Spans:  SpanConfig{Enabled: true, Exporter: exporter},
+	}))
+	e.Use(WithContext(context.Background()))
+	var ctxSpan *Span
+	e.GET("/orders/:id", Wrap(func(ctx echo.Context) (string, error) {
+		ctxSpan = SpanFromContext(UnwrapContext(ctx))
+		return ctx.Param("id"), nil
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	req.Header.Set(HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.NoError(t, CloseSpanProcessors(context.Background()))
+
+	server := spans["GET /orders/:id"]
+	assert.NotNil(t, server)
+	assert.Equal(t, SpanKindServer, server.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.TraceId)
+	assert.Equal(t, "00f067aa0ba902b7", server.ParentSpanId)
+	assert.Equal(t, http.StatusOK, server.Attributes["http.response.status_code"])
+	assert.Contains(t, rec.Header().Get(HeaderTraceParent), server.SpanId)
+
+	assert.NotNil(t, ctxSpan)
+	handler := spans[ctxSpan.data.Name]
+	assert.NotNil(t, handler)
+	assert.Equal(t, server.SpanId, handler.ParentSpanId)
+	assert.Equal(t, SpanKindInternal, handler.Kind)
+}
+
+func TestTrace_SpanStatus(t *testing.T) {
+	var mu sync.Mutex
+	spans := make(map[string]*SpanData)
+	exporter := SpanExporterFunc(func(_ context.Context, batch []*SpanData) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, span := range batch {
+			spans[span.Name] = span
+		}
+		return nil
+	})
+	e := echo.New()
+	e.HTTPErrorHandler = errorHandle
+	e.Validator = nopValidator{}
+	e.Use(TraceWithConfig(TraceConfig{
+		Logger: nopLogger,
+		Spans:  SpanConfig{Enabled: true, Exporter: exporter},
+	}))
+	type order struct {
+		Item string `json:"item"`
+	}
+	e.POST("/span-status/orders", Wrap(func(req order) error {
+		return kerrors.ErrNotExist()
+	}))
+	e.GET("/span-status/fail", Wrap(func() error {
+		return kerrors.ErrInternal()
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/span-status/orders", strings.NewReader(`{"item":"a"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/span-status/fail", nil))
+	assert.NoError(t, CloseSpanProcessors(context.Background()))
+
+	// a business error is answered with http.StatusOK and its code, the server did not fail
+	server := spans["POST /span-status/orders"]
+	assert.NotNil(t, server)
+	assert.Equal(t, SpanStatusUnset, server.Status)
+	assert.Equal(t, http.StatusOK, server.Attributes["http.response.status_code"])
+	assert.Equal(t, kerrors.CodeNotFound, server.Attributes["app.response.code"])
+	assert.Equal(t, server.SpanId, spans["bind"].ParentSpanId)
+	assert.Equal(t, server.SpanId, spans["validate"].ParentSpanId)
+
+	server = spans["GET /span-status/fail"]
+	assert.NotNil(t, server)
+	assert.Equal(t, SpanStatusError, server.Status)
+	assert.Equal(t, kerrors.CodeInternalServer, server.Attributes["app.response.code"])
+}
+
+func TestOTLPSpanExporter(t *testing.T) {
+	var body map[string]interface{}
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+	exporter := NewOTLPSpanExporter(OTLPExporterConfig{
+		Endpoint: collector.URL,
+		Headers:  map[string]string{"Authorization": "Bearer t"},
+	})
+	now := time.Now()
+	err := exporter.ExportSpans(context.Background(), []*SpanData{{
+		TraceId:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanId:     "00f067aa0ba902b7",
+		Name:       "GET /orders/:id",
+		Kind:       SpanKindServer,
+		Start:      now,
+		End:        now,
+		Status:     SpanStatusError,
+		Attributes: map[string]interface{}{"service.name": "orders", "http.response.status_code": 500},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer t", auth)
+
+	resourceSpans := body["resourceSpans"].([]interface{})
+	assert.Len(t, resourceSpans, 1)
+	resource := resourceSpans[0].(map[string]interface{})
+	attr := resource["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "service.name", attr["key"])
+	assert.Equal(t, "orders", attr["value"].(map[string]interface{})["stringValue"])
+	span := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, float64(2), span["kind"])
+	assert.Equal(t, float64(2), span["status"].(map[string]interface{})["code"])
+	attr = span["attributes"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "http.response.status_code", attr["key"])
+	assert.Equal(t, "500", attr["value"].(map[string]interface{})["intValue"])
+
+	collector.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	assert.Error(t, exporter.ExportSpans(context.Background(), []*SpanData{{Start: now, End: now}}))
+}
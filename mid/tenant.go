@@ -0,0 +1,282 @@
+package mid
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type (
+	TenantContext interface {
+		TenantId() string
+		// Source the name of the resolver which resolved the tenant
+		Source() string
+	}
+	TenantResolver interface {
+		Name() string
+		// ResolveTenant returns the tenant id, empty if not resolved
+		ResolveTenant(ctx echo.Context) (string, error)
+	}
+	// AuthSessionClaims optional interface of AuthSessionInfo, exposes session claims (e.g. from a JWT)
+	AuthSessionClaims interface {
+		Claim(name string) (interface{}, bool)
+	}
+	// TenantVerifier reports whether the caller may act in tenantId, e.g. by looking up its memberships
+	TenantVerifier func(ctx echo.Context, tenantId string) (bool, error)
+	TenantConfig   struct {
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		// Required reject requests whose tenant can not be resolved
+		Required bool `toml:"required" json:"required" mapstructure:"required"`
+		// DefaultTenant used when not required and no resolver matched
+		DefaultTenant string `toml:"defaultTenant" json:"defaultTenant" mapstructure:"defaultTenant"`
+		// built-in resolvers, tried in order: Claim, Header, Host, PathPrefix. empty means not used
+		// Host / PathPrefix are templates with a '{tenant}' placeholder, e.g. '{tenant}.example.com', '/t/{tenant}'
+		Claim      string `toml:"claim" json:"claim" mapstructure:"claim"`
+		Header     string `toml:"header" json:"header" mapstructure:"header"`
+		Host       string `toml:"host" json:"host" mapstructure:"host"`
+		PathPrefix string `toml:"pathPrefix" json:"pathPrefix" mapstructure:"pathPrefix"`
+		// Resolvers custom resolvers, tried after the built-in ones
+		Resolvers []TenantResolver
+		// the claim resolver is trusted, tenants of the other resolvers are chosen by the client and verified:
+		// against TenantsClaim, a claim listing the tenants of the caller, if the session has it, by Verifier
+		// otherwise; unverified tenants are rejected with kerrors.ErrForbidden unless AllowUnverified is set,
+		// e.g. for public sites selecting the tenant by host
+		TenantsClaim    string `toml:"tenantsClaim" json:"tenantsClaim" mapstructure:"tenantsClaim"`
+		Verifier        TenantVerifier
+		AllowUnverified bool `toml:"allowUnverified" json:"allowUnverified" mapstructure:"allowUnverified"`
+		Skipper         Skipper
+	}
+)
+
+var DefaultTenantConfig = TenantConfig{
+	Enabled: false,
+}
+
+const tenantPlaceholder = "{tenant}"
+
+type _tenantCtx struct {
+	tenantId string
+	source   string
+}
+
+func (this *_tenantCtx) TenantId() string {
+	return this.tenantId
+}
+
+func (this *_tenantCtx) Source() string {
+	return this.source
+}
+
+func CurrentTenantContext(ctx echo.Context) TenantContext {
+	return ctx.Get(CtxTenantKey).(TenantContext)
+}
+
+// currentTenantId returns empty if mid.Tenant not installed
+func currentTenantId(ctx echo.Context) string {
+	if tenantCtx, ok := ctx.Get(CtxTenantKey).(TenantContext); ok && tenantCtx != nil {
+		return tenantCtx.TenantId()
+	}
+	return ""
+}
+
+type _tenantResolver struct {
+	name string
+	f    func(ctx echo.Context) (string, error)
+}
+
+func (this *_tenantResolver) Name() string {
+	return this.name
+}
+
+func (this *_tenantResolver) ResolveTenant(ctx echo.Context) (string, error) {
+	return this.f(ctx)
+}
+
+func NewTenantResolver(name string, f func(ctx echo.Context) (string, error)) TenantResolver {
+	return &_tenantResolver{name: name, f: f}
+}
+
+// TenantFromHeader resolves the tenant from a request header
+func TenantFromHeader(header string) TenantResolver {
+	return NewTenantResolver("header", func(ctx echo.Context) (string, error) {
+		return strings.TrimSpace(ctx.Request().Header.Get(header)), nil
+	})
+}
+
+// TenantFromHost resolves the tenant from host, e.g. '{tenant}.example.com'
+func TenantFromHost(pattern string) TenantResolver {
+	reg := compileTenantTemplate(strings.ToLower(pattern), "[^.]+", "$")
+	return NewTenantResolver("host", func(ctx echo.Context) (string, error) {
+		host := ctx.Request().Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if m := reg.FindStringSubmatch(strings.ToLower(host)); m != nil {
+			return m[1], nil
+		}
+		return "", nil
+	})
+}
+
+// TenantFromPathPrefix resolves the tenant from path prefix, e.g. '/t/{tenant}'
+func TenantFromPathPrefix(pattern string) TenantResolver {
+	reg := compileTenantTemplate(pattern, "[^/]+", "(/|$)")
+	return NewTenantResolver("pathPrefix", func(ctx echo.Context) (string, error) {
+		if m := reg.FindStringSubmatch(ctx.Request().URL.Path); m != nil {
+			return m[1], nil
+		}
+		return "", nil
+	})
+}
+
+// TenantFromClaim resolves the tenant from a claim of the auth session, see AuthSessionClaims
+func TenantFromClaim(claim string) TenantResolver {
+	return NewTenantResolver("claim", func(ctx echo.Context) (string, error) {
+		if v, ok := sessionClaim(ctx, claim); ok {
+			return fmt.Sprint(v), nil
+		}
+		return "", nil
+	})
+}
+
+// sessionClaim a claim of the authenticated caller
+func sessionClaim(ctx echo.Context, claim string) (interface{}, bool) {
+	authCtx, ok := ctx.Get(CtxCallerInfoKey).(AuthContext)
+	if !ok || authCtx == nil || authCtx.IsAnonymous() {
+		return nil, false
+	}
+	claims, ok := authCtx.SessionInfo().(AuthSessionClaims)
+	if !ok {
+		return nil, false
+	}
+	v, ok := claims.Claim(claim)
+	return v, ok && v != nil
+}
+
+// claimList a list claim, a string is taken as a comma separated list
+func claimList(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		out := make([]string, 0)
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+		return out
+	case []string:
+		return v
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			out = append(out, fmt.Sprint(item))
+		}
+		return out
+	}
+	return []string{fmt.Sprint(claim)}
+}
+
+// verifyTenant a tenant chosen by the client, see TenantConfig.TenantsClaim
+func verifyTenant(ctx echo.Context, config TenantConfig, tenantId string) (bool, error) {
+	if config.TenantsClaim != "" {
+		if tenants, ok := sessionClaim(ctx, config.TenantsClaim); ok {
+			return policyContains(claimList(tenants), tenantId), nil
+		}
+	}
+	if config.Verifier != nil {
+		return config.Verifier(ctx, tenantId)
+	}
+	return config.AllowUnverified, nil
+}
+
+func compileTenantTemplate(pattern string, segment string, suffix string) *regexp.Regexp {
+	idx := strings.Index(pattern, tenantPlaceholder)
+	if idx == -1 {
+		panic(fmt.Sprintf("tenant pattern '%s' must contain '%s'", pattern, tenantPlaceholder))
+	}
+	prefix := regexp.QuoteMeta(pattern[:idx])
+	rest := regexp.QuoteMeta(pattern[idx+len(tenantPlaceholder):])
+	return regexp.MustCompile(fmt.Sprintf("^%s(%s)%s%s", prefix, segment, rest, suffix))
+}
+
+func Tenant(config TenantConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	resolvers := make([]TenantResolver, 0)
+	// the only resolver whose tenant is not chosen by the client
+	var claimResolver TenantResolver
+	if config.Claim != "" {
+		claimResolver = TenantFromClaim(config.Claim)
+		resolvers = append(resolvers, claimResolver)
+	}
+	if config.Header != "" {
+		resolvers = append(resolvers, TenantFromHeader(config.Header))
+	}
+	if config.Host != "" {
+		resolvers = append(resolvers, TenantFromHost(config.Host))
+	}
+	if config.PathPrefix != "" {
+		resolvers = append(resolvers, TenantFromPathPrefix(config.PathPrefix))
+	}
+	resolvers = append(resolvers, config.Resolvers...)
+	ctxPool := &sync.Pool{
+		New: func() interface{} { return new(_tenantCtx) },
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			tenantCtx := ctxPool.Get().(*_tenantCtx)
+			tenantCtx.tenantId = ""
+			tenantCtx.source = ""
+			defer func() {
+				ctxPool.Put(tenantCtx)
+				ctx.Set(CtxTenantKey, nil)
+			}()
+			ctx.Set(CtxTenantKey, tenantCtx)
+			if !config.Enabled || config.Skipper(ctx) {
+				return next(ctx)
+			}
+			for _, resolver := range resolvers {
+				tenantId, err := resolver.ResolveTenant(ctx)
+				if err != nil {
+					return err
+				}
+				if tenantId == "" {
+					continue
+				}
+				if resolver != claimResolver {
+					allowed, err := verifyTenant(ctx, config, tenantId)
+					if err != nil {
+						return err
+					}
+					if !allowed {
+						return kerrors.ErrForbiddenf("tenant '%s' is not allowed", tenantId)
+					}
+				}
+				tenantCtx.tenantId = tenantId
+				tenantCtx.source = resolver.Name()
+				break
+			}
+			if tenantCtx.tenantId == "" {
+				if config.Required {
+					return kerrors.ErrBadRequestf("tenant not resolved")
+				}
+				tenantCtx.tenantId = config.DefaultTenant
+				tenantCtx.source = "default"
+			}
+			if tenantCtx.tenantId != "" {
+				if logger, ok := ctx.Get(CtxZapLoggerKey).(log.ZapLog); ok && logger != nil {
+					ctx.Set(CtxZapLoggerKey, logger.With(log.UseFields(zap.String("tenantId", tenantCtx.tenantId))))
+				}
+			}
+			return next(ctx)
+		}
+	}
+}
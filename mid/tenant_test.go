@@ -0,0 +1,101 @@
+package mid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClaimsSession map[string]interface{}
+
+func (this testClaimsSession) UserId() string  { return "u1" }
+func (this testClaimsSession) ExpireAt() int64 { return 0 }
+
+func (this testClaimsSession) Claim(name string) (interface{}, bool) {
+	v, ok := this[name]
+	return v, ok
+}
+
+// testClaimsProvider takes the claims from X-Claims, e.g. 'tenantId=t1;tenants=t1,t2'
+type testClaimsProvider struct{}
+
+func (testClaimsProvider) Auth(ctx echo.Context) (AuthSessionInfo, error) {
+	raw := ctx.Request().Header.Get("X-Claims")
+	if raw == "" {
+		return nil, kerrors.ErrUnauthorized()
+	}
+	session := testClaimsSession{}
+	for _, pair := range strings.Split(raw, ";") {
+		k, v, _ := strings.Cut(pair, "=")
+		session[k] = v
+	}
+	return session, nil
+}
+
+func TestTenant(t *testing.T) {
+	newServer := func(config TenantConfig) func(host, claims, header string) (string, string, int) {
+		e := echo.New()
+		e.HTTPErrorHandler = errorHandle
+		e.Use(AuthWithConfig(AuthConfig{Enabled: true, WhitelistRules: []WhitelistRule{{Path: "/**"}}}, testClaimsProvider{}))
+		config.Enabled = true
+		e.Use(Tenant(config))
+		var tenantId, source string
+		e.GET("/items", func(ctx echo.Context) error {
+			tenantId, source = CurrentTenantContext(ctx).TenantId(), CurrentTenantContext(ctx).Source()
+			return nil
+		})
+		return func(host, claims, header string) (string, string, int) {
+			tenantId, source = "", ""
+			req := httptest.NewRequest(http.MethodGet, "/items", nil)
+			req.Host = host
+			req.Header.Set("X-Claims", claims)
+			req.Header.Set("X-Tenant-Id", header)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			rsp := map[string]interface{}{}
+			_ = json.Unmarshal(rec.Body.Bytes(), &rsp)
+			code, _ := rsp["code"].(float64)
+			return tenantId, source, int(code)
+		}
+	}
+
+	call := newServer(TenantConfig{Claim: "tenantId", Header: "X-Tenant-Id", Host: "{tenant}.example.com", TenantsClaim: "tenants"})
+	// the claim comes first and is trusted, the header is ignored then
+	tenantId, source, _ := call("", "tenantId=t1", "t9")
+	assert.Equal(t, "t1", tenantId)
+	assert.Equal(t, "claim", source)
+	// the header before the host, verified against the tenants claim
+	tenantId, source, _ = call("t2.example.com", "tenants=t1,t3", "t3")
+	assert.Equal(t, "t3", tenantId)
+	assert.Equal(t, "header", source)
+	_, _, code := call("", "tenants=t1,t3", "t2")
+	assert.Equal(t, kerrors.CodeForbidden, code)
+	tenantId, source, _ = call("t1.example.com", "tenants=t1", "")
+	assert.Equal(t, "t1", tenantId)
+	assert.Equal(t, "host", source)
+	// without the tenants claim nor a verifier, client chosen tenants are rejected
+	_, _, code = call("", "", "t1")
+	assert.Equal(t, kerrors.CodeForbidden, code)
+
+	call = newServer(TenantConfig{Header: "X-Tenant-Id", TenantsClaim: "tenants",
+		Verifier: func(ctx echo.Context, tenantId string) (bool, error) {
+			return tenantId == "public", nil
+		}})
+	tenantId, _, _ = call("", "", "public")
+	assert.Equal(t, "public", tenantId)
+	_, _, code = call("", "", "t1")
+	assert.Equal(t, kerrors.CodeForbidden, code)
+	// the tenants claim takes precedence over the verifier
+	_, _, code = call("", "tenants=t1", "public")
+	assert.Equal(t, kerrors.CodeForbidden, code)
+
+	call = newServer(TenantConfig{Host: "{tenant}.example.com", AllowUnverified: true})
+	tenantId, _, _ = call("shop.example.com", "", "")
+	assert.Equal(t, "shop", tenantId)
+}
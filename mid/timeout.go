@@ -0,0 +1,170 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// HeaderRequestTimeout inbound timeout, a duration like '1.5s' or integer milliseconds
+	HeaderRequestTimeout = "X-Request-Timeout"
+	// HeaderGrpcTimeout gRPC style inbound timeout, e.g. '500m', '2S'
+	HeaderGrpcTimeout = "Grpc-Timeout"
+)
+
+type (
+	// TimeoutConfig defines the config for Timeout middleware. Timeouts are cooperative: the request
+	// context gets a deadline, handlers and the calls they make are expected to honor it.
+	TimeoutConfig struct {
+		Enabled bool `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		// Timeout default of every route, <= 0 means no deadline
+		Timeout time.Duration `toml:"timeout" json:"timeout" mapstructure:"timeout"`
+		// Routes overrides per 'METHOD /route/template', e.g. "POST /reports/:id" = "5m", keys are case insensitive
+		Routes map[string]time.Duration `toml:"routes" json:"routes" mapstructure:"routes"`
+		// HonorHeader shortens the deadline to the inbound X-Request-Timeout / Grpc-Timeout header,
+		// never beyond the server side timeout
+		HonorHeader bool `toml:"honorHeader" json:"honorHeader" mapstructure:"honorHeader"`
+		Skipper     Skipper
+	}
+)
+
+var DefaultTimeoutConfig = TimeoutConfig{
+	Enabled:     false,
+	Timeout:     time.Second * 30,
+	HonorHeader: true,
+}
+
+// WithTimeout overrides the timeout of the route, measured from the start of the request.
+// Without the Timeout middleware, the deadline is set by mid.Wrap itself
+func WithTimeout(timeout time.Duration) WrapOption {
+	return wrapOptionFunc(func(cfg *wrapCtx) {
+		cfg.Timeout = timeout
+	})
+}
+
+// _timeoutCtx keeps the context before any deadline, so a route override can extend the default
+type _timeoutCtx struct {
+	base           context.Context
+	begin          time.Time
+	headerDeadline time.Time
+	cancel         context.CancelFunc
+}
+
+func (this *_timeoutCtx) apply(ctx echo.Context, timeout time.Duration) {
+	if this.cancel != nil {
+		this.cancel()
+		this.cancel = nil
+	}
+	deadline := this.headerDeadline
+	if timeout > 0 {
+		if routeDeadline := this.begin.Add(timeout); deadline.IsZero() || routeDeadline.Before(deadline) {
+			deadline = routeDeadline
+		}
+	}
+	reqCtx := this.base
+	if !deadline.IsZero() {
+		reqCtx, this.cancel = context.WithDeadline(this.base, deadline)
+	}
+	ctx.SetRequest(ctx.Request().WithContext(reqCtx))
+}
+
+func (this *_timeoutCtx) release() {
+	if this.cancel != nil {
+		this.cancel()
+	}
+}
+
+func Timeout(config TimeoutConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	routes := routeOverrides("timeout", config.Routes)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.Enabled || config.Skipper(ctx) {
+				return next(ctx)
+			}
+			timeoutCtx := &_timeoutCtx{
+				base:  ctx.Request().Context(),
+				begin: time.Now(),
+			}
+			timeout := config.Timeout
+			if routeTimeout, ok := lookupRouteOverride(routes, ctx.Request().Method, ctx.Path()); ok {
+				timeout = routeTimeout
+			}
+			if config.HonorHeader {
+				// the caller may only shorten the server side timeout, see apply
+				if headerTimeout, ok := inboundTimeout(ctx.Request().Header); ok {
+					timeoutCtx.headerDeadline = timeoutCtx.begin.Add(headerTimeout)
+				}
+			}
+			timeoutCtx.apply(ctx, timeout)
+			ctx.Set(CtxTimeoutKey, timeoutCtx)
+			defer func() {
+				timeoutCtx.release()
+				ctx.Set(CtxTimeoutKey, nil)
+			}()
+			return timeoutErr(ctx, next(ctx))
+		}
+	}
+}
+
+// applyRouteTimeout called by mid.Wrap for WithTimeout, returns the release func
+func applyRouteTimeout(ctx echo.Context, timeout time.Duration) func() {
+	if timeoutCtx, ok := ctx.Get(CtxTimeoutKey).(*_timeoutCtx); ok && timeoutCtx != nil {
+		timeoutCtx.apply(ctx, timeout)
+		// released by the middleware
+		return func() {}
+	}
+	timeoutCtx := &_timeoutCtx{base: ctx.Request().Context(), begin: time.Now()}
+	timeoutCtx.apply(ctx, timeout)
+	return timeoutCtx.release
+}
+
+// timeoutErr replaces the error of a handler which overran its deadline, or ended without response after it
+func timeoutErr(ctx echo.Context, err error) error {
+	if ctx.Request().Context().Err() != context.DeadlineExceeded {
+		return err
+	}
+	if err != nil || !ctx.Response().Committed {
+		return kerrors.ErrTimeout()
+	}
+	return err
+}
+
+// inboundTimeout parses X-Request-Timeout, then Grpc-Timeout
+func inboundTimeout(header http.Header) (time.Duration, bool) {
+	if value := strings.TrimSpace(header.Get(HeaderRequestTimeout)); value != "" {
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d, true
+		}
+	}
+	if value := strings.TrimSpace(header.Get(HeaderGrpcTimeout)); len(value) > 1 && len(value) <= 9 {
+		amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil || amount <= 0 {
+			return 0, false
+		}
+		unit := map[byte]time.Duration{
+			'H': time.Hour,
+			'M': time.Minute,
+			'S': time.Second,
+			'm': time.Millisecond,
+			'u': time.Microsecond,
+			'n': time.Nanosecond,
+		}[value[len(value)-1]]
+		if unit == 0 {
+			return 0, false
+		}
+		return time.Duration(amount) * unit, true
+	}
+	return 0, false
+}
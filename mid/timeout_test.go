@@ -0,0 +1,98 @@
+package mid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeout(t *testing.T) {
+	e := echo.New()
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(Timeout(TimeoutConfig{Enabled: true, Timeout: time.Millisecond * 20, HonorHeader: true}))
+	var remaining time.Duration
+	handler := func(ctx echo.Context) error {
+		reqCtx := ctx.Request().Context()
+		deadline, _ := reqCtx.Deadline()
+		remaining = time.Until(deadline)
+		<-reqCtx.Done()
+		return reqCtx.Err()
+	}
+	e.GET("/slow", Wrap(handler))
+	e.GET("/long", Wrap(func(ctx echo.Context) error {
+		deadline, _ := ctx.Request().Context().Deadline()
+		remaining = time.Until(deadline)
+		return nil
+	}, WithTimeout(time.Minute)))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	rsp := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	assert.Equal(t, float64(kerrors.CodeTimeout), rsp["code"])
+
+	// the route override extends the default
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/long", nil))
+	assert.True(t, remaining > time.Second*50)
+
+	// the inbound header shortens, never extends
+	req := httptest.NewRequest(http.MethodGet, "/long", nil)
+	req.Header.Set(HeaderRequestTimeout, "1s")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, remaining <= time.Second)
+}
+
+func TestInboundTimeout(t *testing.T) {
+	for value, expect := range map[string]time.Duration{
+		"1500": time.Millisecond * 1500,
+		"1.5s": time.Millisecond * 1500,
+		"-1s":  0,
+	} {
+		header := http.Header{}
+		header.Set(HeaderRequestTimeout, value)
+		d, _ := inboundTimeout(header)
+		assert.Equal(t, expect, d, value)
+	}
+	for value, expect := range map[string]time.Duration{
+		"500m": time.Millisecond * 500,
+		"2S":   time.Second * 2,
+		"1H":   time.Hour,
+		"10x":  0,
+	} {
+		header := http.Header{}
+		header.Set(HeaderGrpcTimeout, value)
+		d, _ := inboundTimeout(header)
+		assert.Equal(t, expect, d, value)
+	}
+	_, ok := inboundTimeout(http.Header{})
+	assert.False(t, ok)
+}
+
+// TestTimeout_RouteKeys keys as viper, used by kboot to load the config, hands them over: lowercased
+func TestTimeout_RouteKeys(t *testing.T) {
+	e := echo.New()
+	e.Use(Timeout(TimeoutConfig{
+		Enabled: true,
+		Timeout: time.Second,
+		Routes:  map[string]time.Duration{"post  /reports/:id": time.Minute},
+	}))
+	var remaining time.Duration
+	e.POST("/reports/:id", func(ctx echo.Context) error {
+		deadline, _ := ctx.Request().Context().Deadline()
+		remaining = time.Until(deadline)
+		return nil
+	})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/reports/1", nil))
+	assert.True(t, remaining > time.Second*50)
+
+	defer func() {
+		assert.NotNil(t, recover())
+	}()
+	routeOverrides("timeout", map[string]int{"POST /a": 1, "post /a": 2})
+}
@@ -0,0 +1,168 @@
+package mid
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const HeaderServerTiming = "Server-Timing"
+
+type (
+	// TimingThreshold latency from which a request is logged as slow, 0 disables the level
+	TimingThreshold struct {
+		Warn  time.Duration `toml:"warn" json:"warn" mapstructure:"warn"`
+		Error time.Duration `toml:"error" json:"error" mapstructure:"error"`
+	}
+	// TimingConfig defines the config for Timing middleware
+	TimingConfig struct {
+		Enabled   bool            `toml:"enabled" json:"enabled" mapstructure:"enabled"`
+		Threshold TimingThreshold `toml:"threshold" json:"threshold" mapstructure:"threshold"`
+		// Routes overrides Threshold per 'METHOD /route/template', keys are case insensitive
+		Routes map[string]TimingThreshold `toml:"routes" json:"routes" mapstructure:"routes"`
+		// ServerTiming emits the stage breakdown in the Server-Timing response header, enabled in debug mode
+		ServerTiming bool `toml:"serverTiming" json:"serverTiming" mapstructure:"serverTiming"`
+		Skipper      Skipper
+		// Logger defaults to the trace logger
+		Logger log.ZapLog
+	}
+	// StageTiming time spent in a stage of the request, e.g. auth, acl, bind, validate, handler, encode
+	StageTiming struct {
+		Name     string
+		Duration time.Duration
+	}
+	// RequestTimings stages recorded by mid.Wrap and the mid middlewares, see CurrentTimings
+	RequestTimings struct {
+		mu     sync.Mutex
+		begin  time.Time
+		stages []StageTiming
+	}
+)
+
+var DefaultTimingConfig = TimingConfig{
+	Enabled: false,
+	Threshold: TimingThreshold{
+		Warn:  time.Second,
+		Error: time.Second * 5,
+	},
+}
+
+// CurrentTimings nil if mid.Timing is not installed or skipped
+func CurrentTimings(ctx echo.Context) *RequestTimings {
+	if timings, ok := ctx.Get(CtxTimingKey).(*RequestTimings); ok {
+		return timings
+	}
+	return nil
+}
+
+// Stages in the order they first ran, durations of a stage running several times are summed
+func (this *RequestTimings) Stages() []StageTiming {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]StageTiming{}, this.stages...)
+}
+
+func (this *RequestTimings) add(name string, d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i := range this.stages {
+		if this.stages[i].Name == name {
+			this.stages[i].Duration += d
+			return
+		}
+	}
+	this.stages = append(this.stages, StageTiming{Name: name, Duration: d})
+}
+
+// serverTiming Server-Timing header value, durations in milliseconds
+func (this *RequestTimings) serverTiming() string {
+	stages := this.Stages()
+	parts := make([]string, 0, len(stages)+1)
+	for _, stage := range stages {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.3f", stage.Name, float64(stage.Duration.Microseconds())/1000))
+	}
+	parts = append(parts, fmt.Sprintf("total;dur=%.3f", float64(time.Since(this.begin).Microseconds())/1000))
+	return strings.Join(parts, ", ")
+}
+
+func (this *RequestTimings) logField() zap.Field {
+	stages := this.Stages()
+	ms := make(map[string]int64, len(stages))
+	for _, stage := range stages {
+		ms[stage.Name] = stage.Duration.Milliseconds()
+	}
+	return zap.Any("stagesMs", ms)
+}
+
+// startStage returns the func ending the stage, a no-op if timings are not recorded
+func startStage(ctx echo.Context, name string) func() {
+	timings := CurrentTimings(ctx)
+	if timings == nil {
+		return func() {}
+	}
+	begin := time.Now()
+	return func() {
+		timings.add(name, time.Since(begin))
+	}
+}
+
+// Timing records the stage breakdown of requests and logs the ones over the latency thresholds
+func Timing(config TimingConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	routes := routeOverrides("timing", config.Routes)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !config.Enabled || config.Skipper(ctx) {
+				return next(ctx)
+			}
+			timings := &RequestTimings{begin: time.Now()}
+			ctx.Set(CtxTimingKey, timings)
+			if config.ServerTiming {
+				ctx.Response().Before(func() {
+					ctx.Response().Header().Set(HeaderServerTiming, timings.serverTiming())
+				})
+			}
+			err := next(ctx)
+			latency := time.Since(timings.begin)
+			route := routeKey(ctx.Request().Method, ctx.Path())
+			threshold := config.Threshold
+			if routeThreshold, ok := lookupRouteOverride(routes, ctx.Request().Method, ctx.Path()); ok {
+				threshold = routeThreshold
+			}
+			var output func(msg string, fields ...zap.Field)
+			var limit time.Duration
+			switch {
+			case threshold.Error > 0 && latency >= threshold.Error:
+				output, limit = timingLogger(ctx, config).Error, threshold.Error
+			case threshold.Warn > 0 && latency >= threshold.Warn:
+				output, limit = timingLogger(ctx, config).Warn, threshold.Warn
+			default:
+				return err
+			}
+			output("slow request",
+				zap.String("route", route),
+				zap.String("path", ctx.Request().URL.Path),
+				zap.Int64("latencyMs", latency.Milliseconds()),
+				zap.Int64("thresholdMs", limit.Milliseconds()),
+				timings.logField())
+			return err
+		}
+	}
+}
+
+func timingLogger(ctx echo.Context, config TimingConfig) log.ZapLog {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	if logger, ok := ctx.Get(CtxZapLoggerKey).(log.ZapLog); ok {
+		return logger
+	}
+	return nopLogger
+}
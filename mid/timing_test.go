@@ -0,0 +1,58 @@
+package mid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guestin/log"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTiming(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	e := echo.New()
+	e.Use(TraceWithConfig(TraceConfig{Logger: nopLogger}))
+	e.Use(Timing(TimingConfig{
+		Enabled:      true,
+		Threshold:    TimingThreshold{Warn: time.Millisecond * 10, Error: time.Millisecond * 30},
+		Routes:       map[string]TimingThreshold{"GET /report": {Warn: time.Minute}},
+		ServerTiming: true,
+		Logger:       log.NewTaggedZapLogger(zap.New(core), "timing"),
+	}))
+	sleep := func(d time.Duration) func(echo.Context) error {
+		return func(echo.Context) error {
+			time.Sleep(d)
+			return nil
+		}
+	}
+	e.GET("/fast", Wrap(sleep(0)))
+	e.GET("/slow", Wrap(sleep(time.Millisecond*15)))
+	e.GET("/slower", Wrap(sleep(time.Millisecond*35)))
+	e.GET("/report", Wrap(sleep(time.Millisecond*35)))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	header := rec.Header().Get(HeaderServerTiming)
+	assert.True(t, strings.HasPrefix(header, "handler;dur="), header)
+	assert.Contains(t, header, ", total;dur=")
+	assert.Equal(t, 0, logs.Len())
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slower", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/report", nil))
+	entries := logs.All()
+	if assert.Equal(t, 2, len(entries)) {
+		assert.Equal(t, zapcore.WarnLevel, entries[0].Level)
+		assert.Equal(t, "GET /slow", entries[0].ContextMap()["route"])
+		assert.Equal(t, zapcore.ErrorLevel, entries[1].Level)
+		stages := entries[1].ContextMap()["stagesMs"].(map[string]int64)
+		assert.True(t, stages["handler"] >= 35)
+	}
+}
@@ -1,11 +1,13 @@
 package mid
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
+	"github.com/guestin/kboot-web-echo-starter/kerrors"
 	"github.com/guestin/log"
-	"github.com/guestin/mob"
 	"github.com/labstack/echo/v4"
 )
 
@@ -16,8 +18,8 @@ type (
 		// Skipper defines a function to skip middleware.
 		Skipper Skipper
 
-		// Generator defines a function to generate an ID.
-		// Optional. Defaults to generator for random string of length 32.
+		// Generator defines a function to generate an ID, used when no trace is extracted.
+		// Optional. Defaults to generator for date prefixed random hex of length 32, W3C compatible.
 		Generator func() string
 
 		// TraceIDHandler defines a function which is executed for a request id.
@@ -25,6 +27,14 @@ type (
 
 		// TargetHeader defines what header to look for to populate the id
 		TargetHeader string `toml:"targetHeader" json:"targetHeader"`
+
+		// Extract formats tried in order to join an incoming trace, TraceFormatCustom reads TargetHeader
+		Extract []TraceFormat `toml:"extract" json:"extract"`
+		// Inject formats written to the response, also the default of TraceContext.Inject for outbound requests
+		Inject []TraceFormat `toml:"inject" json:"inject"`
+
+		// Spans server and child spans of sampled requests
+		Spans SpanConfig `toml:"spans" json:"spans"`
 	}
 )
 
@@ -34,6 +44,9 @@ var DefaultTraceConfig = TraceConfig{
 	Skipper:      DefaultSkipper,
 	Generator:    generator,
 	TargetHeader: "Kboot-Trace-Id",
+	Extract:      []TraceFormat{TraceFormatW3C, TraceFormatB3, TraceFormatB3Multi, TraceFormatCustom},
+	Inject:       []TraceFormat{TraceFormatW3C, TraceFormatCustom},
+	Spans:        DefaultSpanConfig,
 }
 
 // Trace returns a X-Request-ID middleware.
@@ -58,6 +71,13 @@ func TraceWithConfig(config TraceConfig) echo.MiddlewareFunc {
 	if config.TargetHeader == "" {
 		config.TargetHeader = DefaultTraceConfig.TargetHeader
 	}
+	if len(config.Extract) == 0 {
+		config.Extract = DefaultTraceConfig.Extract
+	}
+	if len(config.Inject) == 0 {
+		config.Inject = DefaultTraceConfig.Inject
+	}
+	processor := newSpanProcessorWithConfig(config.Spans, config.Logger)
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) error {
@@ -66,29 +86,86 @@ func TraceWithConfig(config TraceConfig) echo.MiddlewareFunc {
 			}
 			req := ctx.Request()
 			res := ctx.Response()
-			traceId := req.Header.Get(config.TargetHeader)
-			if traceId == "" {
-				traceId = config.Generator()
+			tc := extractTraceContext(req.Header, config.Extract, config.TargetHeader)
+			if tc == nil {
+				tc = &TraceContext{TraceId: config.Generator(), Sampled: true}
 			}
+			tc.SpanId = newSpanId()
+			tc.inject = config.Inject
+			tc.targetHeader = config.TargetHeader
+			traceId := tc.TraceId
 			traceLogger := config.Logger.With(log.UseSubTag(log.NewFixStyleText(traceId, log.Blue, false)))
 			ctx.Set(CtxTraceIdKey, traceId)
+			ctx.Set(CtxTraceContextKey, tc)
 			ctx.Set(CtxZapLoggerKey, traceLogger)
 			defer func() {
 				ctx.Set(CtxTraceIdKey, nil)
+				ctx.Set(CtxTraceContextKey, nil)
 			}()
-			res.Header().Set(config.TargetHeader, traceId)
+			tc.Inject(res.Header())
 			if config.TraceIDHandler != nil {
 				config.TraceIDHandler(ctx, traceId)
 			}
-			return next(ctx)
+			if processor == nil || !tc.Sampled {
+				return next(ctx)
+			}
+			span := newServerSpan(processor, tc, config.Spans.ServiceName)
+			ctx.Set(CtxSpanKey, span)
+			defer ctx.Set(CtxSpanKey, nil)
+			err := next(ctx)
+			endServerSpan(ctx, span, err)
+			return err
 		}
 	}
 }
 
+func endServerSpan(ctx echo.Context, span *Span, err error) {
+	req := ctx.Request()
+	// the route template is known once routed
+	span.SetName(fmt.Sprintf("%s %s", req.Method, ctx.Path()))
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("http.route", ctx.Path())
+	span.SetAttribute("url.path", req.URL.Path)
+	span.SetAttribute("client.address", ctx.RealIP())
+	span.SetAttribute("user_agent.original", req.UserAgent())
+	status := ctx.Response().Status
+	// set when mid.Wrap answered the error itself
+	code, _ := ctx.Get(CtxErrorCodeKey).(int)
+	if err != nil {
+		code = errorCode(err)
+		if !ctx.Response().Committed {
+			// the error handler writes the response later, errors other than echo.HTTPError
+			// are answered with http.StatusOK and their code
+			status = http.StatusOK
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				status = he.Code
+			}
+		}
+	}
+	span.SetAttribute("http.response.status_code", status)
+	if code != kerrors.CodeOk {
+		span.SetAttribute("app.response.code", code)
+	}
+	// business errors are expected outcomes, not failures of the server
+	switch {
+	case code < kerrors.CodeInternalServer && status < http.StatusInternalServerError:
+	case err != nil:
+		span.RecordError(err)
+	case code >= kerrors.CodeInternalServer:
+		span.SetStatus(SpanStatusError, kerrors.CodeText(code))
+	default:
+		span.SetStatus(SpanStatusError, http.StatusText(status))
+	}
+	span.End()
+}
+
 func generator() string {
-	return fmt.Sprintf("%s%s", time.Now().Format("060102"), mob.GenRandomUUID()[6:])
+	return fmt.Sprintf("%s%s", time.Now().Format("060102"), newTraceId()[6:])
 }
 
+// GetTraceId the W3C trace id when the trace was extracted from W3C / B3 headers or generated,
+// otherwise the TargetHeader value
 func GetTraceId(ctx echo.Context) string {
 	return fmt.Sprintf("%v", ctx.Get(CtxTraceIdKey))
 }
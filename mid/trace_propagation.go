@@ -0,0 +1,252 @@
+package mid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TraceFormat a trace propagation format, see TraceConfig.Extract and TraceConfig.Inject
+type TraceFormat string
+
+const (
+	// TraceFormatW3C 'traceparent' and 'tracestate' headers, https://www.w3.org/TR/trace-context/
+	TraceFormatW3C TraceFormat = "w3c"
+	// TraceFormatB3 single 'b3' header
+	TraceFormatB3 TraceFormat = "b3"
+	// TraceFormatB3Multi 'X-B3-TraceId', 'X-B3-SpanId', 'X-B3-ParentSpanId', 'X-B3-Sampled' and 'X-B3-Flags' headers
+	TraceFormatB3Multi TraceFormat = "b3multi"
+	// TraceFormatCustom the TraceConfig.TargetHeader, carries the trace id only
+	TraceFormatCustom TraceFormat = "custom"
+)
+
+const (
+	HeaderTraceParent    = "traceparent"
+	HeaderTraceState     = "tracestate"
+	HeaderB3             = "b3"
+	HeaderB3TraceId      = "X-B3-TraceId"
+	HeaderB3SpanId       = "X-B3-SpanId"
+	HeaderB3ParentSpanId = "X-B3-ParentSpanId"
+	HeaderB3Sampled      = "X-B3-Sampled"
+	HeaderB3Flags        = "X-B3-Flags"
+)
+
+// TraceContext the trace of the current request, see CurrentTraceContext
+type TraceContext struct {
+	// TraceId 32 lowercase hex when extracted from W3C / B3 headers or generated,
+	// a custom header value is kept as is
+	TraceId string
+	// SpanId new span id of the current request
+	SpanId string
+	// ParentSpanId span id of the caller, empty if the trace started here
+	ParentSpanId string
+	Sampled      bool
+	// TraceState W3C vendor state, propagated untouched
+	TraceState string
+	// Format the format the trace was extracted from, empty if the trace started here
+	Format TraceFormat
+
+	inject       []TraceFormat
+	targetHeader string
+}
+
+// CurrentTraceContext nil if mid.Trace is not installed or skipped
+func CurrentTraceContext(ctx echo.Context) *TraceContext {
+	if tc, ok := ctx.Get(CtxTraceContextKey).(*TraceContext); ok {
+		return tc
+	}
+	return nil
+}
+
+// IsW3C whether TraceId can be propagated in W3C / B3 headers
+func (this *TraceContext) IsW3C() bool {
+	return isValidTraceId(this.TraceId)
+}
+
+// Inject writes the trace into header, e.g. the response or an outbound request,
+// formats default to TraceConfig.Inject. W3C / B3 formats are skipped if TraceId is not W3C compatible
+func (this *TraceContext) Inject(header http.Header, formats ...TraceFormat) {
+	if len(formats) == 0 {
+		formats = this.inject
+	}
+	sampled := "0"
+	if this.Sampled {
+		sampled = "1"
+	}
+	for _, format := range formats {
+		switch format {
+		case TraceFormatCustom:
+			if this.targetHeader != "" {
+				header.Set(this.targetHeader, this.TraceId)
+			}
+		case TraceFormatW3C:
+			if !this.IsW3C() {
+				continue
+			}
+			header.Set(HeaderTraceParent, fmt.Sprintf("00-%s-%s-0%s", this.TraceId, this.SpanId, sampled))
+			if this.TraceState != "" {
+				header.Set(HeaderTraceState, this.TraceState)
+			}
+		case TraceFormatB3:
+			if !this.IsW3C() {
+				continue
+			}
+			header.Set(HeaderB3, fmt.Sprintf("%s-%s-%s", this.TraceId, this.SpanId, sampled))
+		case TraceFormatB3Multi:
+			if !this.IsW3C() {
+				continue
+			}
+			header.Set(HeaderB3TraceId, this.TraceId)
+			header.Set(HeaderB3SpanId, this.SpanId)
+			header.Set(HeaderB3Sampled, sampled)
+		}
+	}
+}
+
+// extractTraceContext tries formats in order, returns nil if none of them is present or valid
+func extractTraceContext(header http.Header, formats []TraceFormat, targetHeader string) *TraceContext {
+	for _, format := range formats {
+		var tc *TraceContext
+		switch format {
+		case TraceFormatW3C:
+			tc = parseTraceParent(header.Get(HeaderTraceParent))
+			if tc != nil {
+				tc.TraceState = strings.TrimSpace(header.Get(HeaderTraceState))
+			}
+		case TraceFormatB3:
+			tc = parseB3Single(header.Get(HeaderB3))
+		case TraceFormatB3Multi:
+			tc = parseB3Multi(header)
+		case TraceFormatCustom:
+			if traceId := header.Get(targetHeader); traceId != "" {
+				tc = &TraceContext{TraceId: traceId, Sampled: true}
+			}
+		}
+		if tc != nil {
+			tc.Format = format
+			return tc
+		}
+	}
+	return nil
+}
+
+// parseTraceParent 'version-traceid-parentid-flags'
+func parseTraceParent(value string) *TraceContext {
+	value = strings.TrimSpace(value)
+	if len(value) < 55 {
+		return nil
+	}
+	parts := strings.SplitN(value, "-", 5)
+	if len(parts) < 4 || len(parts[0]) != 2 || !isHex(parts[0]) || parts[0] == "ff" {
+		return nil
+	}
+	// version 00 has exactly 4 fields, future versions may append fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil
+	}
+	if !isValidTraceId(parts[1]) || !isValidSpanId(parts[2]) || len(parts[3]) != 2 || !isHex(parts[3]) {
+		return nil
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return &TraceContext{
+		TraceId:      parts[1],
+		ParentSpanId: parts[2],
+		Sampled:      flags[0]&0x01 == 0x01,
+	}
+}
+
+// parseB3Single '{TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}', the last two are optional
+func parseB3Single(value string) *TraceContext {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	// a lone sampling state carries no trace
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil
+	}
+	traceId := padB3TraceId(strings.ToLower(parts[0]))
+	spanId := strings.ToLower(parts[1])
+	if !isValidTraceId(traceId) || !isValidSpanId(spanId) {
+		return nil
+	}
+	tc := &TraceContext{TraceId: traceId, ParentSpanId: spanId, Sampled: true}
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "0":
+			tc.Sampled = false
+		case "1", "d":
+		default:
+			return nil
+		}
+	}
+	return tc
+}
+
+func parseB3Multi(header http.Header) *TraceContext {
+	traceId := padB3TraceId(strings.ToLower(strings.TrimSpace(header.Get(HeaderB3TraceId))))
+	spanId := strings.ToLower(strings.TrimSpace(header.Get(HeaderB3SpanId)))
+	if !isValidTraceId(traceId) || !isValidSpanId(spanId) {
+		return nil
+	}
+	tc := &TraceContext{TraceId: traceId, ParentSpanId: spanId, Sampled: true}
+	switch strings.ToLower(header.Get(HeaderB3Sampled)) {
+	case "0", "false":
+		tc.Sampled = false
+	}
+	if header.Get(HeaderB3Flags) == "1" {
+		tc.Sampled = true
+	}
+	return tc
+}
+
+// padB3TraceId B3 allows 64 bit trace ids
+func padB3TraceId(traceId string) string {
+	if len(traceId) == 16 {
+		return strings.Repeat("0", 16) + traceId
+	}
+	return traceId
+}
+
+func isValidTraceId(id string) bool {
+	return len(id) == 32 && isLowerHex(id) && id != strings.Repeat("0", 32)
+}
+
+func isValidSpanId(id string) bool {
+	return len(id) == 16 && isLowerHex(id) && id != strings.Repeat("0", 16)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceId() string {
+	return randomHexId(16)
+}
+
+func newSpanId() string {
+	return randomHexId(8)
+}
+
+func randomHexId(size int) string {
+	buf := make([]byte, size)
+	for {
+		_, _ = rand.Read(buf)
+		for _, b := range buf {
+			if b != 0 {
+				return hex.EncodeToString(buf)
+			}
+		}
+	}
+}
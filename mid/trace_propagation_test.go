@@ -0,0 +1,70 @@
+package mid
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractTraceContext(t *testing.T) {
+	formats := DefaultTraceConfig.Extract
+	header := http.Header{}
+	header.Set(HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Set(HeaderTraceState, "congo=t61rcWkgMzE")
+	header.Set("Kboot-Trace-Id", "legacy")
+	tc := extractTraceContext(header, formats, "Kboot-Trace-Id")
+	assert.Equal(t, TraceFormatW3C, tc.Format)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.TraceId)
+	assert.Equal(t, "00f067aa0ba902b7", tc.ParentSpanId)
+	assert.Equal(t, "congo=t61rcWkgMzE", tc.TraceState)
+	assert.True(t, tc.Sampled)
+
+	// invalid traceparent falls through to the next format
+	header.Set(HeaderTraceParent, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	header.Set(HeaderB3, "a3ce929d0e0e4736-00f067aa0ba902b7-0")
+	tc = extractTraceContext(header, formats, "Kboot-Trace-Id")
+	assert.Equal(t, TraceFormatB3, tc.Format)
+	assert.Equal(t, "0000000000000000a3ce929d0e0e4736", tc.TraceId)
+	assert.False(t, tc.Sampled)
+
+	header = http.Header{}
+	header.Set(HeaderB3TraceId, "4bf92f3577b34da6a3ce929d0e0e4736")
+	header.Set(HeaderB3SpanId, "00f067aa0ba902b7")
+	header.Set(HeaderB3Sampled, "1")
+	tc = extractTraceContext(header, formats, "Kboot-Trace-Id")
+	assert.Equal(t, TraceFormatB3Multi, tc.Format)
+	assert.Equal(t, "00f067aa0ba902b7", tc.ParentSpanId)
+
+	header = http.Header{}
+	header.Set("Kboot-Trace-Id", "legacy")
+	tc = extractTraceContext(header, formats, "Kboot-Trace-Id")
+	assert.Equal(t, TraceFormatCustom, tc.Format)
+	assert.False(t, tc.IsW3C())
+
+	assert.Nil(t, extractTraceContext(http.Header{}, formats, "Kboot-Trace-Id"))
+}
+
+func TestTraceContext_Inject(t *testing.T) {
+	tc := &TraceContext{
+		TraceId:      "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanId:       "b7ad6b7169203331",
+		Sampled:      true,
+		TraceState:   "congo=t61rcWkgMzE",
+		inject:       DefaultTraceConfig.Inject,
+		targetHeader: "Kboot-Trace-Id",
+	}
+	header := http.Header{}
+	tc.Inject(header)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01", header.Get(HeaderTraceParent))
+	assert.Equal(t, "congo=t61rcWkgMzE", header.Get(HeaderTraceState))
+	assert.Equal(t, tc.TraceId, header.Get("Kboot-Trace-Id"))
+
+	header = http.Header{}
+	tc.Inject(header, TraceFormatB3, TraceFormatB3Multi)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-1", header.Get(HeaderB3))
+	assert.Equal(t, "b7ad6b7169203331", header.Get(HeaderB3SpanId))
+	assert.Empty(t, header.Get(HeaderTraceParent))
+
+	assert.True(t, isValidTraceId(generator()))
+}
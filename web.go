@@ -1,6 +1,11 @@
 package web
 
-import "github.com/labstack/echo/v4"
+import (
+	"net/http"
+
+	"github.com/guestin/kboot-web-echo-starter/mid"
+	"github.com/labstack/echo/v4"
+)
 
 func EchoCtx() *echo.Echo {
 	return _gWeb.echoCtx
@@ -10,6 +15,11 @@ func GetConfig() *Config {
 	return _gWeb.cfg
 }
 
+// HTTPClient client for calling other services on behalf of the request, see mid.OutboundClient
+func HTTPClient(ctx echo.Context) *http.Client {
+	return mid.OutboundClient(ctx, _gWeb.cfg.Outbound)
+}
+
 func Start() error {
 	return _gWeb.Start()
 }